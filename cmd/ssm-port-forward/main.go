@@ -0,0 +1,184 @@
+// Command ssm-port-forward forwards local ports to an instance, or to hosts reachable from the instance, using SSM
+// Session Manager port forwarding sessions.
+//
+// Usage: ssm-port-forward [-profile name] [-region name] [-bind address] -L spec [-L spec ...] target
+//
+// Each -L flag starts a port forwarding session, and is either localPort:remotePort, which forwards the local port to
+// the remote port on the instance, or localPort:host:remotePort, which forwards the local port to the remote port on
+// a host reachable from the instance (like a database endpoint).  A local port of 0 listens on a random port.  The
+// target is an EC2 instance ID, managed instance ID, instance ARN, or any value which can be resolved to an instance
+// ID.  The sessions are terminated when the program is interrupted.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/dweidenfeld/ssm-session-client/ssmclient"
+)
+
+// errInvalidSpec is returned for a -L flag value which is not in one of the supported forms.
+var errInvalidSpec = errors.New("invalid forwarding spec, expected localPort:remotePort or localPort:host:remotePort")
+
+// forward is the local port, remote host, and remote port parsed from a -L flag.
+type forward struct {
+	localPort  int
+	remoteHost string
+	remotePort int
+}
+
+// forwards is the flag.Value collecting the repeatable -L flag.
+type forwards []forward
+
+func (f *forwards) String() string {
+	specs := make([]string, 0, len(*f))
+	for _, fw := range *f {
+		if len(fw.remoteHost) > 0 {
+			specs = append(specs, fmt.Sprintf("%d:%s:%d", fw.localPort, fw.remoteHost, fw.remotePort))
+			continue
+		}
+		specs = append(specs, fmt.Sprintf("%d:%d", fw.localPort, fw.remotePort))
+	}
+	return strings.Join(specs, ",")
+}
+
+func (f *forwards) Set(v string) error {
+	fw, err := parseForward(v)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, fw)
+	return nil
+}
+
+// parseForward parses localPort:remotePort or localPort:host:remotePort.  The host may be an IPv6 address, with or
+// without brackets.
+func parseForward(spec string) (forward, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 {
+		return forward{}, fmt.Errorf("%w: %s", errInvalidSpec, spec)
+	}
+
+	local, err := net.LookupPort("tcp", parts[0])
+	if err != nil {
+		return forward{}, fmt.Errorf("%w: %s", errInvalidSpec, spec)
+	}
+
+	remote, err := net.LookupPort("tcp", parts[len(parts)-1])
+	if err != nil || remote < 1 {
+		return forward{}, fmt.Errorf("%w: %s", errInvalidSpec, spec)
+	}
+
+	host := strings.Join(parts[1:len(parts)-1], ":")
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if len(parts) > 2 && len(host) < 1 {
+		return forward{}, fmt.Errorf("%w: %s", errInvalidSpec, spec)
+	}
+
+	return forward{localPort: local, remoteHost: host, remotePort: remote}, nil
+}
+
+func main() {
+	var fwds forwards
+	profile := flag.String("profile", "", "name of the AWS configuration profile (AWS_PROFILE is used if not set)")
+	region := flag.String("region", "", "AWS region of the target (the configured region is used if not set)")
+	bind := flag.String("bind", "localhost", "local address to listen on, empty to listen on all addresses")
+	flag.Var(&fwds, "L", "forward `localPort:[host:]remotePort`, may be repeated")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] -L spec [-L spec ...] target\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 || len(fwds) < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cfg, tgt, err := loadTarget(*profile, *region, flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	forwarders := make([]*ssmclient.PortForwarder, 0, len(fwds))
+	closeAll := func() {
+		for _, f := range forwarders {
+			_ = f.Close()
+		}
+	}
+
+	for _, fw := range fwds {
+		f, err := ssmclient.NewPortForwarder(cfg, &ssmclient.PortForwardingInput{
+			Target:       tgt,
+			RemoteHost:   fw.remoteHost,
+			RemotePort:   fw.remotePort,
+			LocalPort:    fw.localPort,
+			LocalAddress: *bind,
+		})
+		if err != nil {
+			closeAll()
+			log.Fatal(err)
+		}
+		forwarders = append(forwarders, f)
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		closeAll()
+	}()
+
+	// the first session to fail ends the others, so a broken tunnel isn't left unnoticed
+	errCh := make(chan error, len(forwarders))
+	var wg sync.WaitGroup
+	for _, f := range forwarders {
+		wg.Add(1)
+		go func(f *ssmclient.PortForwarder) {
+			defer wg.Done()
+			if err := f.Serve(); err != nil {
+				errCh <- err
+				closeAll()
+			}
+		}(f)
+	}
+	wg.Wait()
+	close(errCh)
+
+	if err, ok := <-errCh; ok {
+		log.Fatal(err)
+	}
+}
+
+// loadTarget loads the AWS configuration, and returns it with the instance ID of the target.  The region of the
+// configuration is taken from the target if it is an ARN.
+func loadTarget(profile, region, target string) (aws.Config, string, error) {
+	opts := []func(*config.LoadOptions) error{config.WithSharedConfigProfile(profile)}
+	if len(region) > 0 {
+		opts = append(opts, config.WithRegion(region))
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		return cfg, "", err
+	}
+
+	cfg, target, err = ssmclient.TargetConfig(cfg, target)
+	if err != nil {
+		return cfg, "", err
+	}
+
+	tgt, err := ssmclient.ResolveTarget(target, cfg)
+	return cfg, tgt, err
+}
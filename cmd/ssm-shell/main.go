@@ -0,0 +1,72 @@
+// Command ssm-shell starts an interactive shell session with an instance using SSM Session Manager.
+//
+// Usage: ssm-shell [-profile name] [-region name] [-document name] [-reason text] target
+//
+// The target is an EC2 instance ID, managed instance ID, instance ARN, or any value which can be resolved to an
+// instance ID (tag:Name=value, IP address, DNS name, or the computer name reported by the SSM agent).  The local
+// terminal is put in raw mode for the duration of the session, and the size of the remote terminal follows the size
+// of the local terminal.  The program exits with the exit status of the remote shell, when the agent reports it.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/dweidenfeld/ssm-session-client/ssmclient"
+)
+
+func main() {
+	profile := flag.String("profile", "", "name of the AWS configuration profile (AWS_PROFILE is used if not set)")
+	region := flag.String("region", "", "AWS region of the target (the configured region is used if not set)")
+	document := flag.String("document", "", "name of the SSM document used to start the session")
+	reason := flag.String("reason", "", "reason for the session, shown in the session history")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] target\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	opts := []func(*config.LoadOptions) error{config.WithSharedConfigProfile(*profile)}
+	if len(*region) > 0 {
+		opts = append(opts, config.WithRegion(*region))
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cfg, target, err := ssmclient.TargetConfig(cfg, flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tgt, err := ssmclient.ResolveTarget(target, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	in := ssmclient.ShellInput{
+		Target:       tgt,
+		DocumentName: *document,
+		Reason:       *reason,
+	}
+
+	if err = ssmclient.ShellSession(cfg, &in); err != nil {
+		var exitErr *ssmclient.ExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.Code)
+		}
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,108 @@
+// Command ssm-socks runs a local SOCKS5 proxy which tunnels connections through an instance, using SSM Session
+// Manager port forwarding sessions to remote hosts.
+//
+// Usage: ssm-socks [-profile name] [-region name] [-listen address] [-user name] [-allow cidrs] target
+//
+// Each connection to the proxy starts a session with the target instance, which connects to the requested host and
+// port from the network of the instance.  The target is an EC2 instance ID, managed instance ID, instance ARN, or any
+// value which can be resolved to an instance ID.  If -user is given, clients must authenticate with the username and
+// the password taken from the SSM_SOCKS_PASSWORD environment variable.  The -allow flag restricts the destinations to
+// a comma separated list of CIDR blocks.  The sessions are terminated when the program is interrupted.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/dweidenfeld/ssm-session-client/socks"
+	"github.com/dweidenfeld/ssm-session-client/ssmclient"
+)
+
+// passwordEnv is the environment variable holding the password, so it isn't visible in the process list.
+const passwordEnv = "SSM_SOCKS_PASSWORD"
+
+func main() {
+	profile := flag.String("profile", "", "name of the AWS configuration profile (AWS_PROFILE is used if not set)")
+	region := flag.String("region", "", "AWS region of the target (the configured region is used if not set)")
+	listen := flag.String("listen", "localhost:1080", "local address of the SOCKS listener")
+	user := flag.String("user", "", "username clients must authenticate with, the password is read from "+passwordEnv)
+	allow := flag.String("allow", "", "comma separated list of CIDR blocks of the allowed destinations (default all)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] target\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	opts := []func(*config.LoadOptions) error{config.WithSharedConfigProfile(*profile)}
+	if len(*region) > 0 {
+		opts = append(opts, config.WithRegion(*region))
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cfg, target, err := ssmclient.TargetConfig(cfg, flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	m := ssmclient.NewSessionManager(cfg)
+
+	// resolve the target up front, so a bad target fails now rather than on the first connection
+	tgt, err := m.ResolveTarget(target)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s := socks.NewServer(m, tgt)
+
+	if len(*user) > 0 {
+		password, ok := os.LookupEnv(passwordEnv)
+		if !ok {
+			log.Fatalf("%s must be set when -user is given", passwordEnv)
+		}
+		s.SetCredentials(*user, password)
+	}
+
+	if len(*allow) > 0 {
+		if err = s.SetAllowedNetworks(strings.Split(*allow, ",")); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		_ = s.Close()
+	}()
+
+	log.Printf("SOCKS proxy listening on %s, forwarding through %s", l.Addr(), tgt)
+	err = s.Serve(l)
+	m.Shutdown()
+
+	if err != nil && !errors.Is(err, socks.ErrServerClosed) {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,89 @@
+// Command ssm-ssh connects stdio to the SSH port of an instance using an SSM Session Manager SSH session, for use as
+// an OpenSSH ProxyCommand.  Unlike the AWS CLI, it does not need the session manager plugin to be installed.
+//
+// Usage: ssm-ssh [-profile name] [-region name] [-v] host [port]
+//
+// The host is an EC2 instance ID, managed instance ID, instance ARN, or any value which can be resolved to an
+// instance ID (tag:Name=value, IP address, DNS name, or the computer name reported by the SSM agent).  If the port is
+// not provided, the default SSH port (22) is used.  Add the following to ~/.ssh/config to use it with ssh, scp, and
+// rsync:
+//
+//	Host i-* mi-*
+//	    ProxyCommand ssm-ssh %h %p
+//
+// Only warnings and errors are written to stderr, since ssh shows the stderr of the ProxyCommand, -v also writes the
+// session progress.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/dweidenfeld/ssm-session-client/datachannel"
+	"github.com/dweidenfeld/ssm-session-client/ssmclient"
+)
+
+func main() {
+	profile := flag.String("profile", "", "name of the AWS configuration profile (AWS_PROFILE is used if not set)")
+	region := flag.String("region", "", "AWS region of the target (the configured region is used if not set)")
+	verbose := flag.Bool("v", false, "log the progress of the session to stderr")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] host [port]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 || flag.NArg() > 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	level := datachannel.LevelWarn
+	if *verbose {
+		level = datachannel.LevelDebug
+	}
+	ssmclient.Logger = datachannel.NewLevelLogger(datachannel.StdLogger, level)
+
+	var port int
+	if flag.NArg() > 1 {
+		var err error
+		if port, err = net.LookupPort("tcp", flag.Arg(1)); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	opts := []func(*config.LoadOptions) error{config.WithSharedConfigProfile(*profile)}
+	if len(*region) > 0 {
+		opts = append(opts, config.WithRegion(*region))
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cfg, target, err := ssmclient.TargetConfig(cfg, flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tgt, err := ssmclient.ResolveTarget(target, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	in := ssmclient.SSHInput{
+		Target:     tgt,
+		RemotePort: port,
+	}
+
+	// only exit with a non-zero status on failure, ssh reports the exit status of the ProxyCommand
+	if err = ssmclient.SSHSession(cfg, &in); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,145 @@
+// Command ssm-tunnels runs a set of port forwarding tunnels defined in a JSON file, using SSM Session Manager port
+// forwarding sessions, and reloads the file when it receives SIGHUP.
+//
+// Usage: ssm-tunnels [-profile name] [-region name] file
+//
+// The file is a JSON object mapping the name of each tunnel to its definition:
+//
+//	{
+//	  "db": {"target": "i-0123456789abcdef0", "remote_host": "mydb.example.internal", "remote_port": 5432,
+//	         "local_port": 5432, "keep_alive": "30s"},
+//	  "web": {"target": "tag:Name=web", "remote_port": 80, "local_port": 8080, "multiplex": true}
+//	}
+//
+// On SIGHUP, tunnels which were added or changed are started, and tunnels which were removed or changed stop
+// accepting connections, and are terminated once their established connections are done.  Unchanged tunnels keep
+// running, and tunnels which ended on their own are started again.  If the file can't be loaded the running tunnels
+// are kept.  The tunnels are terminated when the program is interrupted.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/dweidenfeld/ssm-session-client/ssmclient"
+)
+
+// tunnelDef is the definition of a tunnel in the file, see ssmclient.PortForwardingInput for the fields.  The local
+// address defaults to localhost.
+type tunnelDef struct {
+	Target         string   `json:"target"`
+	RemoteHost     string   `json:"remote_host,omitempty"`
+	RemotePort     int      `json:"remote_port"`
+	LocalAddress   *string  `json:"local_address,omitempty"`
+	LocalPort      int      `json:"local_port"`
+	KeepAlive      duration `json:"keep_alive,omitempty"`
+	IdleTimeout    duration `json:"idle_timeout,omitempty"`
+	MaxConnections int      `json:"max_connections,omitempty"`
+	Multiplex      bool     `json:"multiplex,omitempty"`
+	Reason         string   `json:"reason,omitempty"`
+}
+
+// duration is a time.Duration written as a string in the file, like "30s".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func main() {
+	profile := flag.String("profile", "", "name of the AWS configuration profile (AWS_PROFILE is used if not set)")
+	region := flag.String("region", "", "AWS region of the targets (the configured region is used if not set)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] file\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	path := flag.Arg(0)
+
+	opts := []func(*config.LoadOptions) error{config.WithSharedConfigProfile(*profile)}
+	if len(*region) > 0 {
+		opts = append(opts, config.WithRegion(*region))
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	m := ssmclient.NewSessionManager(cfg)
+	d := ssmclient.NewTunnelDaemon(m)
+	if err = reload(d, path); err != nil {
+		log.Fatal(err)
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigCh {
+		if sig != syscall.SIGHUP {
+			break
+		}
+
+		if err = reload(d, path); err != nil {
+			log.Printf("keeping the running tunnels: %v", err)
+		}
+	}
+	m.Shutdown()
+}
+
+// reload loads the tunnel definitions from the file, and applies them to the daemon.
+func reload(d *ssmclient.TunnelDaemon, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var defs map[string]tunnelDef
+	if err = json.Unmarshal(data, &defs); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	tunnels := make(map[string]*ssmclient.PortForwardingInput, len(defs))
+	for name, def := range defs {
+		addr := "localhost"
+		if def.LocalAddress != nil {
+			addr = *def.LocalAddress
+		}
+
+		tunnels[name] = &ssmclient.PortForwardingInput{
+			Target:         def.Target,
+			RemoteHost:     def.RemoteHost,
+			RemotePort:     def.RemotePort,
+			LocalAddress:   addr,
+			LocalPort:      def.LocalPort,
+			KeepAlive:      time.Duration(def.KeepAlive),
+			IdleTimeout:    time.Duration(def.IdleTimeout),
+			MaxConnections: def.MaxConnections,
+			Multiplex:      def.Multiplex,
+			Reason:         def.Reason,
+		}
+	}
+	return d.Reload(tunnels)
+}
@@ -13,6 +13,17 @@ import (
 
 const agentMsgHeaderLen = 116 // the binary size of all AgentMessage fields except payloadLength and Payload
 
+// ChecksumError is returned when unmarshaling a message where the payload digest in the message header does not
+// match the SHA-256 digest of the payload, which means the message was corrupted.
+type ChecksumError struct {
+	Expected []byte
+	Actual   []byte
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("payload digest mismatch, WANT: %x, GOT: %x", e.Expected, e.Actual)
+}
+
 // AgentMessage is the structural representation of the binary format of an SSM agent message use for communication
 // between local clients (like this), and remote agents installed on EC2 instances.
 // This is the order the fields must appear as on the wire
@@ -70,8 +81,9 @@ func (m *AgentMessage) ValidateMessage() error {
 		return fmt.Errorf("payload length mismatch, WANT: %d, GOT: %d", m.payloadLength, len(m.Payload))
 	}
 
-	if !bytes.Equal(m.sha256PayloadDigest(), m.payloadDigest) {
-		return errors.New("payload digest mismatch")
+	// channel_closed messages are generated by the service with a shorter header, only verify agent messages
+	if digest := m.sha256PayloadDigest(); m.MessageType != ChannelClosed && !bytes.Equal(digest, m.payloadDigest) {
+		return &ChecksumError{Expected: m.payloadDigest, Actual: digest}
 	}
 
 	return nil
@@ -80,6 +92,10 @@ func (m *AgentMessage) ValidateMessage() error {
 // UnmarshalBinary reads the wire format data and updates the fields in the method receiver.  Satisfies the
 // encoding.BinaryUnmarshaler interface.
 func (m *AgentMessage) UnmarshalBinary(data []byte) error {
+	if len(data) < agentMsgHeaderLen {
+		return errors.New("invalid message, too short")
+	}
+
 	m.headerLength = binary.BigEndian.Uint32(data)
 	m.MessageType = parseMessageType(data[4:36])
 	m.schemaVersion = binary.BigEndian.Uint32(data[36:40])
@@ -87,16 +103,25 @@ func (m *AgentMessage) UnmarshalBinary(data []byte) error {
 	m.SequenceNumber = int64(binary.BigEndian.Uint64(data[48:56]))
 	m.Flags = AgentMessageFlag(binary.BigEndian.Uint64(data[56:64]))
 	m.messageID = uuid.Must(uuid.FromBytes(formatUUIDBytes(data[64:80])))
-	m.payloadDigest = data[80 : 80+sha256.Size]
+	// the payload and digest are copied, since readers re-use their buffer while messages can be held for later
+	m.payloadDigest = append([]byte(nil), data[80:80+sha256.Size]...)
 
 	// The channel_closed message has a header length of 112 bytes, assuming this is what's dropped
 	if m.headerLength == agentMsgHeaderLen {
 		m.PayloadType = PayloadType(binary.BigEndian.Uint32(data[112:m.headerLength]))
 	}
 
-	payloadLenEnd := m.headerLength + 4
+	// the lengths come from the wire, check them before using them as offsets
+	payloadLenEnd := int64(m.headerLength) + 4
+	if payloadLenEnd > int64(len(data)) {
+		return errors.New("invalid message header length")
+	}
+
 	m.payloadLength = binary.BigEndian.Uint32(data[m.headerLength:payloadLenEnd])
-	m.Payload = data[payloadLenEnd : payloadLenEnd+m.payloadLength]
+	if payloadLenEnd+int64(m.payloadLength) > int64(len(data)) {
+		return fmt.Errorf("payload length mismatch, WANT: %d, GOT: %d", m.payloadLength, int64(len(data))-payloadLenEnd)
+	}
+	m.Payload = append([]byte(nil), data[payloadLenEnd:payloadLenEnd+int64(m.payloadLength)]...)
 
 	return m.ValidateMessage()
 }
@@ -106,7 +131,7 @@ func (m *AgentMessage) UnmarshalBinary(data []byte) error {
 func (m *AgentMessage) MarshalBinary() ([]byte, error) {
 	buf := new(bytes.Buffer)
 
-	m.sha256PayloadDigest()
+	m.payloadDigest = m.sha256PayloadDigest()
 	m.payloadLength = uint32(len(m.Payload))
 
 	if err := m.ValidateMessage(); err != nil {
@@ -179,10 +204,8 @@ func (m *AgentMessage) convertMessageType() []byte {
 }
 
 func (m *AgentMessage) sha256PayloadDigest() []byte {
-	digest := sha256.New()
-	_, _ = digest.Write(m.Payload)
-	m.payloadDigest = digest.Sum(nil)
-	return m.payloadDigest
+	digest := sha256.Sum256(m.Payload)
+	return digest[:]
 }
 
 // channel_closed message type is nul padded, others are space padded.  Handle both.
@@ -196,6 +219,8 @@ func parseTime(data []byte) time.Time {
 	return time.Unix(0, d.Nanoseconds())
 }
 
+// formatUUIDBytes swaps the halves of the UUID, into a new slice so the data isn't modified.
 func formatUUIDBytes(data []byte) []byte {
-	return append(data[8:], data[:8]...)
+	out := make([]byte, 0, len(data))
+	return append(append(out, data[8:]...), data[:8]...)
 }
@@ -0,0 +1,29 @@
+package datachannel
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func TestUnmarshalMalformedLengths(t *testing.T) {
+	tests := map[string]func(data []byte){
+		"header length": func(data []byte) {
+			binary.BigEndian.PutUint32(data, math.MaxUint32-2)
+		},
+		"payload length": func(data []byte) {
+			binary.BigEndian.PutUint32(data[agentMsgHeaderLen:], math.MaxUint32)
+		},
+	}
+
+	for name, corrupt := range tests {
+		t.Run(name, func(t *testing.T) {
+			data := outputMessage(t, 0, "payload")
+			corrupt(data)
+
+			if err := new(AgentMessage).UnmarshalBinary(data); err == nil {
+				t.Error("malformed message was accepted")
+			}
+		})
+	}
+}
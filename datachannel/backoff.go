@@ -0,0 +1,135 @@
+package datachannel
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// Default values used for unset fields of an ExponentialBackoff.
+const (
+	DefaultInitialDelay = 500 * time.Millisecond
+	DefaultMultiplier   = 2.0
+	DefaultMaxDelay     = 30 * time.Second
+	DefaultMaxAttempts  = 5
+
+	// DefaultJitter is the Jitter of the DefaultBackoff.  Unlike the other fields, an unset Jitter means none.
+	DefaultJitter = 0.2
+)
+
+// DefaultBackoff is the Backoff used for reconnecting the data channel, unless changed using SetReconnectBackoff.
+// The defaults suit an interactive session, where giving up quickly is better than leaving the user waiting.
+var DefaultBackoff Backoff = &ExponentialBackoff{Jitter: DefaultJitter}
+
+// Backoff provides the delay between attempts of an operation which is retried, like reconnecting the data channel.
+type Backoff interface {
+	// Next returns the delay before retry number attempt (starting at 1), or false if no more attempts should be made.
+	Next(attempt int) (time.Duration, bool)
+}
+
+// ExponentialBackoff is a Backoff where the delay grows by Multiplier after each attempt, starting at InitialDelay,
+// and limited to MaxDelay.  Jitter is the fraction (0 to 1) of each delay which is randomized, so many clients
+// don't retry in lock-step.  MaxAttempts is the number of retries before giving up, and a negative value retries
+// forever, which suits unattended daemons.  Unset (zero) fields use the Default values.
+type ExponentialBackoff struct {
+	InitialDelay time.Duration
+	Multiplier   float64
+	MaxDelay     time.Duration
+	Jitter       float64
+	MaxAttempts  int
+}
+
+// Next implements the Backoff interface.
+func (b *ExponentialBackoff) Next(attempt int) (time.Duration, bool) {
+	maxAttempts := b.MaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = DefaultMaxAttempts
+	}
+
+	if attempt < 1 || (maxAttempts > 0 && attempt > maxAttempts) {
+		return 0, false
+	}
+
+	initial := b.InitialDelay
+	if initial <= 0 {
+		initial = DefaultInitialDelay
+	}
+
+	mult := b.Multiplier
+	if mult < 1 {
+		mult = DefaultMultiplier
+	}
+
+	maxDelay := b.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = DefaultMaxDelay
+	}
+
+	d := float64(initial) * math.Pow(mult, float64(attempt-1))
+	if d > float64(maxDelay) {
+		d = float64(maxDelay)
+	}
+
+	if b.Jitter > 0 {
+		j := math.Min(b.Jitter, 1)
+		d -= d * j * rand.Float64() //nolint:gosec // jitter doesn't need a secure random source
+	}
+
+	return time.Duration(d), true
+}
+
+// SetReconnectBackoff configures the Backoff used between attempts to reconnect the data channel.  A nil value
+// restores the DefaultBackoff.
+func (c *SsmDataChannel) SetReconnectBackoff(b Backoff) {
+	c.backoff = b
+}
+
+// reconnectBackoff returns the configured Backoff, or the DefaultBackoff.
+func (c *SsmDataChannel) reconnectBackoff() Backoff {
+	if c.backoff == nil {
+		return DefaultBackoff
+	}
+	return c.backoff
+}
+
+// reconnect re-establishes the websocket connection to the stream URL and re-opens the data channel with the token,
+// retrying failed attempts according to the configured Backoff.
+func (c *SsmDataChannel) reconnect(url, token string) error {
+	b := c.reconnectBackoff()
+
+	for attempt := 1; ; attempt++ {
+		err := c.reconnectOnce(url, token)
+		if err == nil {
+			return nil
+		}
+
+		d, ok := b.Next(attempt)
+		if !ok {
+			return err
+		}
+		time.Sleep(d)
+	}
+}
+
+// reconnectOnce closes the current websocket connection, connects to the stream URL, and re-opens the data channel
+// with the token.
+func (c *SsmDataChannel) reconnectOnce(url, token string) error {
+	if c.ws != nil {
+		_ = c.ws.Close()
+	}
+
+	c.emit(Event{Type: EventReconnecting})
+
+	if err := c.dial(url); err != nil {
+		return err
+	}
+
+	if err := c.openDataChannel(token); err != nil {
+		return fmt.Errorf("error opening data channel: %w", err)
+	}
+
+	atomic.AddInt64(&c.stats.reconnect, 1)
+	return nil
+}
@@ -0,0 +1,108 @@
+package datachannel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// ErrHalfCloseUnsupported is returned by CloseRead and CloseWrite for connections which can't be half-closed.
+var ErrHalfCloseUnsupported = errors.New("connection does not support half-close")
+
+// Bridge connects the data channel with the provided net.Conn, copying data in both directions until both
+// directions are finished, or an error occurs in either direction.  See BridgeContext for details.
+func (c *SsmDataChannel) Bridge(conn net.Conn) error {
+	return c.BridgeContext(context.Background(), conn)
+}
+
+// BridgeContext connects the data channel with the provided net.Conn, copying data in both directions until both
+// directions are finished, an error occurs in either direction, or the context is cancelled.
+//
+// Each direction is shut down independently (a half-close).  If the local connection reaches EOF, the read side of
+// the connection is shut down, and data channel output continues to be delivered to the connection until the
+// remote side finishes.  If the remote side finishes first, the write side of the connection is shut down, so the
+// local peer sees EOF, and data from the connection continues to be sent until the local peer closes it.  Half-close
+// requires a connection supporting CloseRead and CloseWrite (like *net.TCPConn or *net.UnixConn), for other types of
+// connection the bridge ends as soon as the remote side finishes.
+//
+// The first error seen in either direction is returned; a clean shutdown of the data channel by the agent is not
+// considered an error.  The connection is always closed when this method returns, however the data channel is left
+// open so the caller can decide what to do with it.  Both directions are stopped before returning, so no output is
+// read from the data channel afterwards, and a message still being read is returned by the next read of the data
+// channel.
+func (c *SsmDataChannel) BridgeContext(ctx context.Context, conn net.Conn) error {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer func() {
+		// closing the connection unblocks the copies which are waiting on it
+		cancel()
+		_ = conn.Close()
+		wg.Wait()
+	}()
+
+	inErrCh := make(chan error, 1)
+	outErrCh := make(chan error, 1)
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		// local -> remote, ReadFrom does not report io.EOF when the connection is done sending
+		_, err := c.ReadFromContext(ctx, conn)
+		inErrCh <- err
+	}()
+
+	go func() {
+		defer wg.Done()
+		// remote -> local
+		_, err := c.WriteToContext(ctx, conn)
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+		outErrCh <- err
+	}()
+
+	// a nil channel is never selected, so once a direction is finished its case won't fire again
+	for inErrCh != nil || outErrCh != nil {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-inErrCh:
+			if err != nil {
+				return err
+			}
+			// local side is done sending, keep delivering data from the remote side until it's done too
+			inErrCh = nil
+			_ = CloseRead(conn)
+		case err := <-outErrCh:
+			if err != nil {
+				return err
+			}
+			// remote side is done sending, let the local peer know, and keep sending its data until it's done too
+			outErrCh = nil
+			if CloseWrite(conn) != nil {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// CloseRead shuts down the reading side of the connection, if the connection supports it (like *net.TCPConn or
+// *net.UnixConn).  Returns ErrHalfCloseUnsupported otherwise.
+func CloseRead(conn net.Conn) error {
+	if cr, ok := conn.(interface{ CloseRead() error }); ok {
+		return cr.CloseRead()
+	}
+	return ErrHalfCloseUnsupported
+}
+
+// CloseWrite shuts down the writing side of the connection, if the connection supports it (like *net.TCPConn or
+// *net.UnixConn).  Returns ErrHalfCloseUnsupported otherwise.
+func CloseWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return ErrHalfCloseUnsupported
+}
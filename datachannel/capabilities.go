@@ -0,0 +1,141 @@
+package datachannel
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// MessageSchemaVersion is the schema version sent by the client in the message which opens the data channel.  This
+// is the only version supported by the agent at the time of writing.
+const MessageSchemaVersion = "1.0"
+
+// DefaultClientVersion is the client version reported to the agent in the handshake, unless changed using
+// SetClientVersion.  This version does not enable any of the agent features gated on the client version.
+const DefaultClientVersion = "0.0.1"
+
+// MuxingClientVersion is the minimum client version for which the agent multiplexes streams over a port forwarding
+// session.  Clients which handle multiplexed streams can report it using SetClientVersion.
+const MuxingClientVersion = "1.1.70"
+
+// Minimum agent versions for protocol features, these are the same checks used by the session manager plugin.
+const (
+	muxingAgentVersion         = "3.0.196.0"
+	muxNoKeepAliveAgentVersion = "3.1.1511.0"
+	terminateFlagAgentVersion  = "2.3.722.0"
+)
+
+// Capabilities describes the protocol features of the agent at the remote end of the data channel, learned from the
+// messages and handshake sent by the agent.  Fields are zero values until the relevant messages are received.
+// MessageSchemaVersion is the schema version the client used to open the data channel.
+// AgentSchemaVersion is the highest schema version seen in the header of messages received from the agent.
+// AgentVersion is the version of the agent reported in the handshake request.
+// ClientActions are the actions the agent requested in the handshake request.
+// SessionType is the type of session requested by the agent in the handshake (for example Standard_Stream, Port,
+// InteractiveCommands, or NonInteractiveCommands).
+// Muxing reports the agent supports multiplexing multiple streams over a port forwarding session.
+// MuxKeepAlive reports the agent expects smux keepalive frames on multiplexed streams.  Later agents disable them,
+// since they keep the session from reaching the Session Manager idle timeout.
+// Encryption reports the agent requested KMS encryption of the session data.
+// TerminateFlag reports the agent supports the TerminateSession flag to end a session from the client.
+// StderrSeparation and ExitCodes report the agent sends the stderr output and the exit code of the command separately
+// from the standard output.
+type Capabilities struct {
+	MessageSchemaVersion string
+	AgentSchemaVersion   uint32
+	AgentVersion         string
+	ClientActions        []ActionType
+	SessionType          string
+	Muxing               bool
+	MuxKeepAlive         bool
+	Encryption           bool
+	TerminateFlag        bool
+	StderrSeparation     bool
+	ExitCodes            bool
+}
+
+// SetClientVersion configures the client version reported to the agent in the handshake.  The agent enables some
+// protocol features based on the client version, so this should only be raised by clients which handle those
+// features.  An empty value restores the DefaultClientVersion.
+func (c *SsmDataChannel) SetClientVersion(version string) {
+	c.clientVer = version
+}
+
+func (c *SsmDataChannel) getClientVersion() string {
+	if len(c.clientVer) < 1 {
+		return DefaultClientVersion
+	}
+	return c.clientVer
+}
+
+// Requested reports whether the agent requested the action in the handshake.
+func (c Capabilities) Requested(action ActionType) bool {
+	for _, a := range c.ClientActions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// Capabilities returns the protocol features of the agent detected so far.  The handshake is complete once
+// WaitForHandshakeComplete returns, after which the result is stable.
+func (c *SsmDataChannel) Capabilities() Capabilities {
+	caps := Capabilities{
+		MessageSchemaVersion: MessageSchemaVersion,
+		AgentSchemaVersion:   atomic.LoadUint32(&c.agentSchema),
+	}
+
+	if req, ok := c.handshake.Load().(*HandshakeRequestPayload); ok {
+		caps.AgentVersion = req.AgentVersion
+		caps.ClientActions = make([]ActionType, len(req.RequestedClientActions))
+		for i, a := range req.RequestedClientActions {
+			caps.ClientActions[i] = a.ActionType
+		}
+		caps.SessionType = c.SessionType()
+
+		caps.Muxing = compareVersions(req.AgentVersion, muxingAgentVersion) >= 0
+		caps.MuxKeepAlive = caps.Muxing && compareVersions(req.AgentVersion, muxNoKeepAliveAgentVersion) <= 0
+		caps.TerminateFlag = compareVersions(req.AgentVersion, terminateFlagAgentVersion) >= 0
+		caps.Encryption = caps.Requested(KMSEncryption)
+		// the agent sends stderr and the exit code of the command separately from the command output
+		caps.StderrSeparation = caps.SessionType == SessionTypeNonInteractiveCommands
+		caps.ExitCodes = caps.StderrSeparation
+	}
+	return caps
+}
+
+// compareVersions compares dotted numeric version strings, returning -1, 0, or 1 if a is less than, equal to, or
+// greater than b.  Missing or non-numeric components are treated as 0.
+func compareVersions(a, b string) int {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
+
+// recordSchemaVersion tracks the highest schema version of the messages received from the agent.
+func (c *SsmDataChannel) recordSchemaVersion(m *AgentMessage) {
+	for {
+		cur := atomic.LoadUint32(&c.agentSchema)
+		if m.schemaVersion <= cur || atomic.CompareAndSwapUint32(&c.agentSchema, cur, m.schemaVersion) {
+			return
+		}
+	}
+}
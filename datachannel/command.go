@@ -0,0 +1,45 @@
+package datachannel
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// SetStderr configures the writer which receives the stderr output of the command, for session types where the
+// agent sends stderr separately from the standard output (see Capabilities).  If not set, stderr output is returned
+// along with the standard output.
+func (c *SsmDataChannel) SetStderr(w io.Writer) {
+	c.stderr = w
+}
+
+// processStderr writes the stderr payload to the configured stderr writer, or returns it as output if there is
+// none.
+func (c *SsmDataChannel) processStderr(msg *AgentMessage) ([]byte, error) {
+	if c.stderr == nil {
+		return msg.Payload, nil
+	}
+
+	if _, err := c.stderr.Write(msg.Payload); err != nil {
+		return nil, fmt.Errorf("error writing stderr: %w", err)
+	}
+	return nil, nil
+}
+
+// ExitCode returns the exit status of the command, for session types where the agent reports it before closing the
+// channel (see Capabilities).  The bool result is false if the agent has not reported an exit status.
+func (c *SsmDataChannel) ExitCode() (int, bool) {
+	code, ok := c.exitCode.Load().(int)
+	return code, ok
+}
+
+// processExitCode records the exit status of the command, which the agent sends as a decimal string.
+func (c *SsmDataChannel) processExitCode(msg *AgentMessage) error {
+	code, err := strconv.Atoi(strings.TrimSpace(string(msg.Payload)))
+	if err != nil {
+		return fmt.Errorf("error decoding exit code: %w", err)
+	}
+	c.exitCode.Store(code)
+	return nil
+}
@@ -0,0 +1,239 @@
+package datachannel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// OutputStreamDataMessageHandler is the callback type registered with a PluginDataChannel to receive session
+// output.  The returned bool indicates if the handler was ready to process the payload.
+type OutputStreamDataMessageHandler func(payload []byte) (bool, error)
+
+// errHandlerNotReady is returned by the output stream handlers dispatch when a handler is not ready for the payload.
+var errHandlerNotReady = errors.New("output stream handler not ready")
+
+// Stop is the callback invoked by PluginDataChannel.OutputMessageHandler when the agent closes the channel.
+type Stop func()
+
+// PluginDataChannel is an adapter around an SsmDataChannel which exposes method names and semantics close to the
+// DataChannel type of the AWS session manager plugin, easing the migration of tools which embed the plugin code.
+// The main difference is that methods do not take a logger parameter.  The underlying SsmDataChannel is available
+// via the DataChannel() method.
+// REF: https://github.com/aws/session-manager-plugin/blob/mainline/src/datachannel/streaming.go.
+type PluginDataChannel struct {
+	c            *SsmDataChannel
+	mu           sync.Mutex
+	clientID     string
+	sessionID    string
+	targetID     string
+	streamURL    string
+	token        string
+	sessionType  string
+	agentVersion string
+	handlers     []OutputStreamDataMessageHandler
+}
+
+// NewPluginDataChannel creates a PluginDataChannel backed by a new SsmDataChannel.  Session output is delivered to
+// the registered output stream handlers before the message is acknowledged, so the agent sends the message again if
+// a handler fails, or is not ready.
+func NewPluginDataChannel() *PluginDataChannel {
+	d := &PluginDataChannel{c: new(SsmDataChannel)}
+	d.c.deliver = d.dispatch
+	return d
+}
+
+// DataChannel returns the underlying SsmDataChannel.
+func (d *PluginDataChannel) DataChannel() *SsmDataChannel {
+	return d.c
+}
+
+// Initialize records the identifiers of the session, and prepares the data channel for use.
+func (d *PluginDataChannel) Initialize(clientID, sessionID, targetID string) {
+	d.clientID = clientID
+	d.sessionID = sessionID
+	d.targetID = targetID
+	d.c.sessionID = sessionID
+	d.c.targetID = targetID
+	d.c.initialize()
+}
+
+// SetWebsocket sets the stream URL and token returned from the StartSession API, to be used by Open().
+func (d *PluginDataChannel) SetWebsocket(streamURL, tokenValue string) {
+	d.streamURL = streamURL
+	d.token = tokenValue
+}
+
+// Open connects the websocket to the stream URL configured with SetWebsocket, and sends the token to the service
+// to finalize the data channel setup.
+func (d *PluginDataChannel) Open() error {
+	return d.c.StartSessionFromDataChannelURL(d.streamURL, d.token)
+}
+
+// Close shuts down the websocket connection.
+func (d *PluginDataChannel) Close() error {
+	return d.c.Close()
+}
+
+// Reconnect closes the current websocket connection, and re-opens the data channel using the stream URL and
+// token configured with SetWebsocket.  Failed attempts are retried using the Backoff configured on the underlying
+// SsmDataChannel (see SsmDataChannel.SetReconnectBackoff).
+func (d *PluginDataChannel) Reconnect() error {
+	return d.c.reconnect(d.streamURL, d.token)
+}
+
+// FinalizeDataChannelHandshake sends the message which opens the data channel with the service using the token.
+func (d *PluginDataChannel) FinalizeDataChannelHandshake(tokenValue string) error {
+	if err := d.c.openDataChannel(tokenValue); err != nil {
+		return fmt.Errorf("error opening data channel: %w", err)
+	}
+	return nil
+}
+
+// SendFlag sends a flag message to the agent.  The TerminateSession flag is sent using the same semantics as
+// SsmDataChannel.TerminateSession(), all others are sent as data messages.
+func (d *PluginDataChannel) SendFlag(flag PayloadTypeFlag) error {
+	if flag == TerminateSession {
+		return d.c.TerminateSession()
+	}
+	return d.c.sendFlag(flag, Data)
+}
+
+// SendInputDataMessage sends the data to the agent as an input stream data message of the given payload type.
+// Output payloads are encrypted if the session uses KMS encryption.
+func (d *PluginDataChannel) SendInputDataMessage(payloadType PayloadType, inputData []byte) error {
+	if payloadType == Output {
+		var err error
+		if inputData, err = d.c.encrypt(inputData); err != nil {
+			return err
+		}
+	}
+
+	_, err := d.c.WriteMsg(NewInputStreamMessage(payloadType, inputData))
+	return err
+}
+
+// SendAcknowledgeMessage sends the Acknowledge message for the provided message to the agent.
+func (d *PluginDataChannel) SendAcknowledgeMessage(msg *AgentMessage) error {
+	return d.c.sendAcknowledgeMessage(msg)
+}
+
+// OutputMessageHandler processes a raw message read from the websocket.  Any output payload is delivered to the
+// registered output stream handlers, and the message is only acknowledged if they all succeed.  A handler which is not
+// ready is not an error, the agent sends the message again later.  If the agent closed the channel, the stopHandler
+// is called.
+func (d *PluginDataChannel) OutputMessageHandler(stopHandler Stop, sessionID string, rawMessage []byte) error {
+	payload, err := d.c.HandleMsg(rawMessage)
+
+	if errors.Is(err, errHandlerNotReady) {
+		return nil
+	}
+
+	if errors.Is(err, io.EOF) {
+		// the output of the ChannelClosed message is not delivered by the data channel
+		if len(payload) > 0 {
+			if e := d.dispatch(payload); e != nil && !errors.Is(e, errHandlerNotReady) {
+				return e
+			}
+		}
+
+		if stopHandler != nil {
+			stopHandler()
+		}
+		return nil
+	}
+	return err
+}
+
+// RegisterOutputStreamHandler adds a handler for session output.  Handlers are called in the order they were
+// registered, except session specific handlers which are called before any other handlers.  Processing of the
+// payload stops at the first handler which returns an error, or reports it is not ready.
+func (d *PluginDataChannel) RegisterOutputStreamHandler(handler OutputStreamDataMessageHandler, isSessionSpecific bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if isSessionSpecific {
+		d.handlers = append([]OutputStreamDataMessageHandler{handler}, d.handlers...)
+		return
+	}
+	d.handlers = append(d.handlers, handler)
+}
+
+// DeregisterOutputStreamHandler removes a previously registered handler.
+func (d *PluginDataChannel) DeregisterOutputStreamHandler(handler OutputStreamDataMessageHandler) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// funcs are not comparable, the plugin uses the same approach to find the handler
+	ptr := reflect.ValueOf(handler).Pointer()
+	for i, h := range d.handlers {
+		if reflect.ValueOf(h).Pointer() == ptr {
+			d.handlers = append(d.handlers[:i], d.handlers[i+1:]...)
+			return
+		}
+	}
+}
+
+// GetStreamDataSequenceNumber returns the sequence number of the last message sent to the agent.
+func (d *PluginDataChannel) GetStreamDataSequenceNumber() int64 {
+	return atomic.LoadInt64(&d.c.seqNum)
+}
+
+// GetSessionType returns the session type negotiated with the agent in the handshake, or if the handshake has not
+// set it, the session type recorded with SetSessionType.
+func (d *PluginDataChannel) GetSessionType() string {
+	if t := d.c.SessionType(); len(t) > 0 {
+		return t
+	}
+	return d.sessionType
+}
+
+// SetSessionType records the type of the session.
+func (d *PluginDataChannel) SetSessionType(sessionType string) {
+	d.sessionType = sessionType
+}
+
+// GetAgentVersion returns the agent version recorded with SetAgentVersion.
+func (d *PluginDataChannel) GetAgentVersion() string {
+	return d.agentVersion
+}
+
+// SetAgentVersion records the version of the remote agent.
+func (d *PluginDataChannel) SetAgentVersion(agentVersion string) {
+	d.agentVersion = agentVersion
+}
+
+// GetSessionID returns the session ID provided to Initialize.
+func (d *PluginDataChannel) GetSessionID() string {
+	return d.sessionID
+}
+
+// GetClientID returns the client ID provided to Initialize.
+func (d *PluginDataChannel) GetClientID() string {
+	return d.clientID
+}
+
+// GetTargetID returns the target ID provided to Initialize.
+func (d *PluginDataChannel) GetTargetID() string {
+	return d.targetID
+}
+
+func (d *PluginDataChannel) dispatch(payload []byte) error {
+	d.mu.Lock()
+	handlers := append([]OutputStreamDataMessageHandler(nil), d.handlers...)
+	d.mu.Unlock()
+
+	for _, h := range handlers {
+		ready, err := h(payload)
+		if err != nil {
+			return err
+		}
+		if !ready {
+			return errHandlerNotReady
+		}
+	}
+	return nil
+}
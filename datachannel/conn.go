@@ -0,0 +1,267 @@
+package datachannel
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Addr is the address of an end of a data channel.  The local address is the session ID, and the remote address is
+// the ID of the target.
+type Addr struct {
+	ID string
+}
+
+// Network returns "ssm".
+func (a *Addr) Network() string {
+	return "ssm"
+}
+
+func (a *Addr) String() string {
+	return a.ID
+}
+
+// Conn adapts a data channel to the net.Conn interface, so it can be used by code expecting a network connection
+// (TLS clients, database drivers, and so on).  Reads return the session output (in order, buffered between calls,
+// and the caller's buffer is filled like any other net.Conn), and writes send session input.  Read and write
+// deadlines are supported, and expired deadlines return os.ErrDeadlineExceeded.
+//
+// The Conn takes over reading from the data channel, so the channel must not be read by anything else once the Conn
+// is created.
+type Conn struct {
+	c       *SsmDataChannel
+	readMu  sync.Mutex
+	pending []byte
+	readErr error
+	dataCh  chan connData
+	rd      *deadline
+	wd      *deadline
+	closeCh chan struct{}
+	once    sync.Once
+}
+
+type connData struct {
+	data []byte
+	err  error
+}
+
+// NewConn creates a Conn reading and writing the data channel.  The handshake is completed as part of reading, so
+// the Conn can be created as soon as the data channel is opened.
+func NewConn(c *SsmDataChannel) *Conn {
+	conn := &Conn{
+		c:       c,
+		dataCh:  make(chan connData),
+		rd:      newDeadline(),
+		wd:      newDeadline(),
+		closeCh: make(chan struct{}),
+	}
+	go conn.receive()
+	return conn
+}
+
+// DataChannel returns the data channel of the connection.
+func (c *Conn) DataChannel() *SsmDataChannel {
+	return c.c
+}
+
+// Read reads session output into p.  Returns io.EOF once the session has ended and all output has been read.
+func (c *Conn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for len(c.pending) < 1 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+
+		select {
+		case <-c.closeCh:
+			return 0, net.ErrClosed
+		case <-c.rd.wait():
+			return 0, os.ErrDeadlineExceeded
+		case d := <-c.dataCh:
+			c.pending, c.readErr = d.data, d.err
+		}
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write sends p as session input.  The write deadline limits the time spent waiting while the agent has paused
+// publication.
+func (c *Conn) Write(p []byte) (int, error) {
+	select {
+	case <-c.closeCh:
+		return 0, net.ErrClosed
+	case <-c.wd.wait():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+
+	if err := c.waitPublication(); err != nil {
+		return 0, err
+	}
+	return c.c.Write(p)
+}
+
+// Close terminates the session, and closes the data channel.
+func (c *Conn) Close() error {
+	var err error
+	c.once.Do(func() {
+		close(c.closeCh)
+		_ = c.c.TerminateSession()
+		err = c.c.Close()
+	})
+	return err
+}
+
+// LocalAddr returns the session ID as an *Addr.
+func (c *Conn) LocalAddr() net.Addr {
+	return &Addr{ID: c.c.SessionID()}
+}
+
+// RemoteAddr returns the ID of the target as an *Addr.
+func (c *Conn) RemoteAddr() net.Addr {
+	return &Addr{ID: c.c.targetID}
+}
+
+// SetDeadline sets the read and write deadlines.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.rd.set(t)
+	c.wd.set(t)
+	return nil
+}
+
+// SetReadDeadline sets the deadline for Read calls, a zero value disables the deadline.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.rd.set(t)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for Write calls, a zero value disables the deadline.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.wd.set(t)
+	return nil
+}
+
+// receive reads and processes messages from the data channel, and delivers the session output to Read, until the
+// session ends or the Conn is closed.
+func (c *Conn) receive() {
+	buf := make([]byte, 4096)
+
+	for {
+		var d connData
+
+		msg, err := c.c.readWhole(buf)
+		if err == nil {
+			d.data, err = c.c.HandleMsg(msg)
+		}
+
+		if errors.Is(err, io.EOF) {
+			// io.Copy and friends expect io.EOF itself, not an error matching it
+			d.err = io.EOF
+		} else if err != nil {
+			d.err = err
+		} else if len(d.data) < 1 {
+			continue
+		}
+
+		select {
+		case c.dataCh <- d:
+		case <-c.closeCh:
+			return
+		}
+
+		if d.err != nil {
+			return
+		}
+	}
+}
+
+// waitPublication blocks while the agent has paused publication, until it is resumed, the write deadline expires,
+// or the Conn is closed.
+func (c *Conn) waitPublication() error {
+	c.c.pauseMu.Lock()
+	resumeCh := c.c.resumeCh
+	c.c.pauseMu.Unlock()
+
+	if resumeCh == nil {
+		return nil
+	}
+
+	select {
+	case <-resumeCh:
+		return nil
+	case <-c.c.Done():
+		return io.ErrClosedPipe
+	case <-c.closeCh:
+		return net.ErrClosed
+	case <-c.wd.wait():
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// deadline is a channel which is closed when the deadline expires, like the deadlines of net.Pipe.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{cancel: make(chan struct{})}
+}
+
+// set changes the deadline, a zero value disables it.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		// wait for the timer to close the channel
+		<-d.cancel
+	}
+	d.timer = nil
+
+	closed := isClosed(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel which is closed when the deadline expires.
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
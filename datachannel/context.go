@@ -0,0 +1,63 @@
+package datachannel
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// readResult is the result of a websocket read started by ReadContext.
+type readResult struct {
+	msg []byte
+	err error
+}
+
+// OpenContext creates the web socket connection with the AWS service and opens the data channel.  The context
+// cancels the StartSession API call (including retries, see SetStartRetry), it is not used once the data channel is
+// open.
+func (c *SsmDataChannel) OpenContext(ctx context.Context, cfg aws.Config, in *ssm.StartSessionInput) error {
+	c.awsCfg = cfg
+	c.targetID = aws.ToString(in.Target)
+	c.initialize()
+	c.setState(StateConnecting)
+	return c.startSession(ctx, cfg, in)
+}
+
+// ReadContext is Read, returning the context error if the context is done before a message arrives.  The websocket
+// read continues in the background, and the message is returned by the next call to Read or ReadContext, so no
+// message is lost.
+func (c *SsmDataChannel) ReadContext(ctx context.Context, data []byte) (int, error) {
+	if n, ok, err := c.readHeld(data); ok {
+		return n, err
+	}
+
+	ch := c.takeRead()
+	if ch == nil {
+		ch = make(chan readResult, 1)
+		go func() {
+			msg, err := c.readMsg()
+			ch <- readResult{msg: msg, err: err}
+		}()
+	}
+
+	select {
+	case r := <-ch:
+		return c.readDone(data, r.msg, r.err)
+	case <-ctx.Done():
+		c.readMu.Lock()
+		c.readCh = ch
+		c.readMu.Unlock()
+		return 0, ctx.Err()
+	}
+}
+
+// takeRead returns the channel of the read left running by a cancelled ReadContext, if any.
+func (c *SsmDataChannel) takeRead() chan readResult {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	ch := c.readCh
+	c.readCh = nil
+	return ch
+}
@@ -3,13 +3,10 @@ package datachannel
 import (
 	"bytes"
 	"context"
-	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
-	"net/http"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -17,9 +14,25 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"github.com/google/uuid"
-	"github.com/gorilla/websocket"
 )
 
+// DefaultMaxPayloadSize is the largest message payload sent to the agent, unless changed using SetMaxPayloadSize.
+// 1536 appears to be a default websocket max packet size.
+const DefaultMaxPayloadSize = 1536
+
+// DefaultBufferSize is the number of incoming messages held while waiting for a missing message, unless changed
+// using SetBufferSize.
+const DefaultBufferSize = 50
+
+// ErrPayloadTooLarge is the error returned from WriteMsg when attempting to send a message with a payload larger
+// than the maximum payload size configured for the data channel.
+var ErrPayloadTooLarge = errors.New("payload exceeds maximum message size")
+
+// ErrConnectToPort is the error returned from HandleMsg when the agent reports that it failed to connect to the
+// remote port of a port forwarding session, usually because the connection was refused.  The data channel remains
+// usable, so the connection can be retried.
+var ErrConnectToPort = errors.New("agent failed to connect to the remote port: connection refused")
+
 // DataChannel is the interface definition for handling communication with the AWS SSM messaging service.
 type DataChannel interface {
 	Open(aws.Config, *ssm.StartSessionInput) error
@@ -36,33 +49,101 @@ type DataChannel interface {
 // SsmDataChannel represents the data channel of the websocket connection used to communicate with the AWS
 // SSM service.  A new(SsmDataChannel) is ready for use, and should immediately call the Open() method.
 type SsmDataChannel struct {
+	stats       counters
 	seqNum      int64
 	inSeqNum    int64
 	mu          sync.Mutex
-	ws          *websocket.Conn
+	ws          Transport
 	synSent     bool
 	handshakeCh chan bool
-	pausePub    bool
-	outMsgBuf   MessageBuffer
+	pauseMu     sync.Mutex
+	resumeCh    chan struct{}
 	inMsgBuf    MessageBuffer
+	initOnce    sync.Once
+	recent      recentIDs
+	gapHandler  GapHandler
+	awsCfg      aws.Config
+	targetID    string
+	enc         atomic.Value
+	sessionType atomic.Value
+	clientVer   string
+	stderr      io.Writer
+	exitCode    atomic.Value
 	lastRows    uint32
 	lastCols    uint32
+	maxPayload  int
+	bpThreshold int
+	doneInit    sync.Once
+	doneOnce    sync.Once
+	doneCh      chan struct{}
+	closeReason *ChannelClosedPayload
+	closeErr    error
+	evMu        sync.Mutex
+	eventCh     chan Event
+	eventsDone  bool
+	redactor    *Redactor
+	debug       bool
+	sessionID   string
+	openedAt    time.Time
+	closedAt    time.Time
+	backoff     Backoff
+	noResume    bool
+	startRetry  *StartRetry
+	apiEndpoint string
+	wsEndpoint  string
+	resuming    int32
+	closing     int32
+	readMu      sync.Mutex
+	readCh      chan readResult
+	heldMsg     []byte
+	states      stateWatchers
+	keepalive   *Keepalive
+	idleTimeout time.Duration
+	onIdle      func()
+	wsURL       string
+	logger      Logger
+	bufSize     int
+	hooks       Hooks
+	writeMu     sync.Mutex
+	newID       func() uuid.UUID
+	clock       func() time.Time
+	deliver     func([]byte) error
+	agentSchema uint32
+	handshake   atomic.Value
+	hsResponse  atomic.Value
+	hsComplete  atomic.Value
+	hsTimeout   time.Duration
+	dialer      Dialer
+	pendMu      sync.Mutex
+	pending     map[int64]*sentMsg
+	pendOrder   []int64
+	ackCh       chan struct{}
+	rto         time.Duration
+	maxSends    int
+	srtt        time.Duration
+	rttvar      time.Duration
 }
 
-// Open creates the web socket connection with the AWS service and opens the data channel.
+// Open creates the web socket connection with the AWS service and opens the data channel.  See OpenContext.
 func (c *SsmDataChannel) Open(cfg aws.Config, in *ssm.StartSessionInput) error {
-	c.handshakeCh = make(chan bool, 1)
-	c.outMsgBuf = NewMessageBuffer(50)
-	c.inMsgBuf = NewMessageBuffer(50)
-
-	go c.processOutboundQueue()
+	return c.OpenContext(context.Background(), cfg, in)
+}
 
-	return c.startSession(cfg, in)
+// OpenWithSession opens the data channel of a session which was already started, using the session ID, stream URL
+// and token value returned by StartSession (or ECS ExecuteCommand, or a service brokering sessions).  Unlike Open, the
+// StartSession API is not called, so no AWS credentials are needed unless the session uses KMS encryption, see
+// SetEncryptionConfig.  The token is only valid for a short time after the session is started.
+func (c *SsmDataChannel) OpenWithSession(sessionID, streamURL, token string) error {
+	c.sessionID = sessionID
+	return c.StartSessionFromDataChannelURL(streamURL, token)
 }
 
 // Close shuts down the web socket connection with the AWS service. Type-specific actions (like sending
 // TerminateSession for port forwarding should be handled before calling Close().
 func (c *SsmDataChannel) Close() error {
+	// finish first, so the failed read of the closed connection isn't mistaken for a connection failure
+	c.finish(nil, nil)
+
 	var err error
 	if c.ws != nil {
 		err = c.ws.Close()
@@ -70,79 +151,213 @@ func (c *SsmDataChannel) Close() error {
 	return err
 }
 
+// Done returns a channel which is closed when the session is terminated, either by the agent sending the
+// ChannelClosed message, a failure of the websocket connection, or a call to Close().
+func (c *SsmDataChannel) Done() <-chan struct{} {
+	c.doneInit.Do(func() {
+		c.doneCh = make(chan struct{})
+	})
+	return c.doneCh
+}
+
+// Wait blocks until the session is terminated, and returns the ChannelClosed payload sent by the agent along
+// with the error which terminated the session.  The payload will be nil if the session did not end with the
+// agent sending a ChannelClosed message, and the error will be nil if the session ended cleanly.
+func (c *SsmDataChannel) Wait() (*ChannelClosedPayload, error) {
+	<-c.Done()
+	return c.closeReason, c.closeErr
+}
+
+// CloseReason returns the ChannelClosed payload sent by the agent when it closed the session, with the session ID,
+// the output describing why it was closed, and when.  Unlike Wait, it doesn't block, and returns nil while the session
+// is active, or if the session did not end with the agent sending a ChannelClosed message.  The payload is also
+// available from the *ChannelClosedError returned by HandleMsg.
+func (c *SsmDataChannel) CloseReason() *ChannelClosedPayload {
+	select {
+	case <-c.Done():
+		return c.closeReason
+	default:
+		return nil
+	}
+}
+
 // WaitForHandshakeComplete blocks further processing until the required SSM handshake sequence used for
-// port-based clients (including ssh) completes.
+// port-based clients (including ssh) completes.  The wait is limited by the handshake timeout, see
+// WaitForHandshakeCompleteContext.
 func (c *SsmDataChannel) WaitForHandshakeComplete() error {
-	buf := make([]byte, 4096)
+	return c.WaitForHandshakeCompleteContext(context.Background())
+}
 
-	for {
-		select {
-		case <-c.handshakeCh:
-			// make stream unbuffered
-			c.inMsgBuf = nil
-			c.outMsgBuf = nil
-			c.handshakeCh = nil
-			return nil
-		default:
-			n, err := c.Read(buf)
-			if err != nil {
-				return err
-			}
+// Read will get a single message from the websocket connection. The unprocessed message is copied to the
+// requested []byte (which should be sized to handle at least 1536 bytes), so it can be passed to HandleMsg.  If the
+// message doesn't fit, io.ErrShortBuffer is returned, and the message is kept for the next call to Read, so it can
+// be retried with a larger buffer.  Use NewPayloadReader for an io.Reader returning the session output, or NewConn
+// for a net.Conn.  If the websocket connection fails, the session is resumed on a new connection (see
+// SetAutoReconnect) before reading the next message.
+func (c *SsmDataChannel) Read(data []byte) (int, error) {
+	if n, ok, err := c.readHeld(data); ok {
+		return n, err
+	}
 
-			if _, err = c.HandleMsg(buf[:n]); err != nil {
-				return err
-			}
+	if ch := c.takeRead(); ch != nil {
+		// finish the read started by a cancelled ReadContext
+		r := <-ch
+		return c.readDone(data, r.msg, r.err)
+	}
+
+	msg, err := c.readMsg()
+	return c.readDone(data, msg, err)
+}
+
+// readMsg reads the next message from the websocket connection, resuming the session if the connection fails.
+func (c *SsmDataChannel) readMsg() ([]byte, error) {
+	msg, err := c.ws.ReadMessage()
+	for err != nil && !errors.Is(err, io.EOF) && c.canResume() {
+		c.logf(LevelWarn, "websocket connection failed, resuming session: %v", err)
+		if err = c.resume(); err != nil {
+			err = fmt.Errorf("error resuming session: %w", err)
+			break
 		}
+		msg, err = c.ws.ReadMessage()
 	}
+	return msg, err
 }
 
-// Read will get a single message from the websocket connection. The unprocessed message is copied to the
-// requested []byte (which should be sized to handle at least 1536 bytes).
-func (c *SsmDataChannel) Read(data []byte) (int, error) {
-	_, msg, err := c.ws.ReadMessage()
-	n := copy(data[:len(msg)], msg)
+// readHeld copies the message which didn't fit in the buffer of a previous read to data.  Returns false if no
+// message is held, and io.ErrShortBuffer if it still doesn't fit.
+func (c *SsmDataChannel) readHeld(data []byte) (int, bool, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	switch {
+	case c.heldMsg == nil:
+		return 0, false, nil
+	case len(c.heldMsg) > len(data):
+		return 0, true, io.ErrShortBuffer
+	}
 
+	n := copy(data, c.heldMsg)
+	c.heldMsg = nil
+	return n, true, nil
+}
+
+// readWhole is Read for the readers of the package, returning the message which doesn't fit in buf instead of
+// io.ErrShortBuffer.
+func (c *SsmDataChannel) readWhole(buf []byte) ([]byte, error) {
+	n, err := c.Read(buf)
+	return c.wholeMsg(buf[:n], err)
+}
+
+// readWholeContext is readWhole, using ReadContext.
+func (c *SsmDataChannel) readWholeContext(ctx context.Context, buf []byte) ([]byte, error) {
+	n, err := c.ReadContext(ctx, buf)
+	return c.wholeMsg(buf[:n], err)
+}
+
+// wholeMsg returns the message held for the next read if the read returned io.ErrShortBuffer.
+func (c *SsmDataChannel) wholeMsg(msg []byte, err error) ([]byte, error) {
+	if !errors.Is(err, io.ErrShortBuffer) {
+		return msg, err
+	}
+
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	msg, c.heldMsg = c.heldMsg, nil
+	return msg, nil
+}
+
+// readDone copies the message read from the websocket connection to data, holding it for the next read if it
+// doesn't fit, and terminates the data channel if the read failed.
+func (c *SsmDataChannel) readDone(data, msg []byte, err error) (int, error) {
 	if err != nil {
-		// gorilla code states this is uber-fatal, and we just need to bail out
-		if websocket.IsCloseError(err, 1000, 1001, 1006) {
-			err = io.EOF
+		if errors.Is(err, io.EOF) {
+			c.finish(nil, nil)
+			return 0, io.EOF
 		}
-		return n, err
+
+		err = withCause(ErrConnectionLost, "error reading websocket message", err)
+		c.finish(nil, err)
+		return 0, err
 	}
 
-	if n < agentMsgHeaderLen {
-		return n, errors.New("invalid message received, too short")
+	if len(msg) < agentMsgHeaderLen {
+		return copy(data, msg), errors.New("invalid message received, too short")
 	}
 
-	return n, nil
+	if len(msg) > len(data) {
+		c.readMu.Lock()
+		c.heldMsg = msg
+		c.readMu.Unlock()
+		return 0, io.ErrShortBuffer
+	}
+
+	return copy(data, msg), nil
+}
+
+// WriteTo uses the data channel as an io.Copy read source, writing output to the provided writer.  Output is read
+// from the agent while the writer is busy, and if the writer falls behind by more than the backpressure threshold
+// (see SetBackpressureThreshold) the agent is asked to pause publication until the writer catches up.  If writing
+// fails (like when the destination is closed), reading stops, and the write error is returned.
+func (c *SsmDataChannel) WriteTo(w io.Writer) (int64, error) {
+	return c.WriteToContext(context.Background(), w)
 }
 
-// WriteTo uses the data channel as an io.Copy read source, writing output to the provided writer.
-func (c *SsmDataChannel) WriteTo(w io.Writer) (n int64, err error) {
-	buf := make([]byte, 2048)
-	var nr, nw int
-	var payload []byte
+// WriteToContext is WriteTo, returning the context error once the context is done.
+func (c *SsmDataChannel) WriteToContext(ctx context.Context, w io.Writer) (n int64, err error) {
+	q := newOutputQueue(c.backpressureThreshold())
+
+	readCtx, stopRead := context.WithCancel(context.Background())
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		c.readOutput(readCtx, q)
+	}()
+
+	defer func() {
+		// stop reading, so output isn't read and discarded once the destination is gone
+		stopRead()
+		<-readDone
+
+		if q.unpause() {
+			// don't leave the agent paused for the next reader of the data channel
+			_ = c.sendFlowControl(StartPublication)
+		}
+	}()
+
+	if ctx.Done() != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+
+		go func() {
+			select {
+			case <-ctx.Done():
+				q.finish(ctx.Err())
+			case <-stop:
+			}
+		}()
+	}
+
+	var nw int
+	var bufs [][]byte
 
 	for {
-		nr, err = c.Read(buf)
-		if err != nil {
-			log.Printf("WriteTo read error: %v", err)
+		if bufs, err = q.pop(); err != nil {
 			return n, err
 		}
 
-		if nr > 0 {
-			payload, err = c.HandleMsg(buf[:nr])
+		for _, payload := range bufs {
+			nw, err = w.Write(payload)
+			n += int64(nw)
 			if err != nil {
-				log.Printf("WriteTo HandleMsg error: %v", err)
-				return int64(nw), err
+				// usually the destination was closed, like when the local peer of a port forward goes away
+				c.logf(LevelDebug, "WriteTo write error: %v", err)
+				return n, fmt.Errorf("error writing to destination: %w", err)
 			}
 
-			if len(payload) > 0 {
-				nw, err = w.Write(payload)
-				n += int64(nw)
-				if err != nil {
-					log.Printf("WriteTo write error: %v", err)
-					return n, err
+			if q.written(len(payload)) {
+				if err = c.sendFlowControl(StartPublication); err != nil {
+					c.logf(LevelWarn, "WriteTo start publication error: %v", err)
 				}
 			}
 		}
@@ -150,8 +365,15 @@ func (c *SsmDataChannel) WriteTo(w io.Writer) (n int64, err error) {
 }
 
 // ReadFrom uses the data channel as an io.Copy write destination, reading data from the provided reader.
-func (c *SsmDataChannel) ReadFrom(r io.Reader) (n int64, err error) {
-	buf := make([]byte, 1536) // 1536 appears to be a default websocket max packet size
+func (c *SsmDataChannel) ReadFrom(r io.Reader) (int64, error) {
+	return c.ReadFromContext(context.Background(), r)
+}
+
+// ReadFromContext is ReadFrom, returning the context error once the context is done.  A blocked read from the
+// reader is not interrupted, the context is checked before data is sent, and while waiting for the agent to resume
+// publication.
+func (c *SsmDataChannel) ReadFromContext(ctx context.Context, r io.Reader) (n int64, err error) {
+	buf := make([]byte, c.maxPayloadSize())
 	var nr int
 
 	for {
@@ -162,35 +384,85 @@ func (c *SsmDataChannel) ReadFrom(r io.Reader) (n int64, err error) {
 				// the contract of ReaderFrom states that io.EOF should not be returned, just
 				// exit the loop and return no error to indicate we are done
 				err = nil
-				log.Print("ReadFrom reader is closed")
+				c.logf(LevelDebug, "ReadFrom reader is closed")
+			} else {
+				err = fmt.Errorf("error reading from source: %w", err)
 			}
 			break
 		}
 
-		if _, err = c.Write(buf[:nr]); err != nil {
-			log.Printf("ReadFrom write error: %v", err)
+		if err = ctx.Err(); err != nil {
+			break
+		}
+
+		if _, err = c.write(ctx, buf[:nr]); err != nil {
+			c.logf(LevelError, "ReadFrom write error: %v", err)
 			break
 		}
 	}
 	return
 }
 
-// Write sends an input stream data message type with the provided payload bytes as the message payload.
+// Write sends an input stream data message type with the provided payload bytes as the message payload.  Payloads
+// larger than the configured maximum payload size are split into multiple messages, and are encrypted if the session
+// uses KMS encryption.  Write blocks while the agent has paused publication, until the agent sends StartPublication.
+// Write is safe for concurrent use, and the messages of each call are sent together, in order, so payloads written
+// by different goroutines are not interleaved.
 func (c *SsmDataChannel) Write(payload []byte) (int, error) {
-	msg := NewAgentMessage()
-	msg.MessageType = InputStreamData
-	msg.Flags = Data
-	msg.PayloadType = Output
-	msg.Payload = payload
-	msg.SequenceNumber = atomic.AddInt64(&c.seqNum, 1)
+	return c.write(context.Background(), payload)
+}
+
+// write is Write, returning the context error if the context is done while publication is paused.
+func (c *SsmDataChannel) write(ctx context.Context, payload []byte) (int, error) {
+	if c.isShutdown() {
+		return 0, ErrShutdown
+	}
 
-	return c.WriteMsg(msg)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	var n int
+
+	for {
+		if err := c.waitPublication(ctx); err != nil {
+			return n, err
+		}
+
+		chunk := payload
+		if max := c.maxPayloadSize() - c.encryptionOverhead(); len(chunk) > max {
+			chunk = chunk[:max]
+		}
+
+		data, err := c.encrypt(chunk)
+		if err != nil {
+			return n, err
+		}
+
+		if _, err = c.WriteMsg(NewInputStreamMessage(Output, data)); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+
+		payload = payload[len(chunk):]
+		if len(payload) < 1 {
+			return n, nil
+		}
+	}
 }
 
 // WriteMsg is the underlying method which marshals AgentMessage types and sends them to the AWS service.
-// This is provided as a convenience so that messages types not already handled can be sent. If the message
-// SequenceNumber field is less than 0, it will be automatically incremented using the internal counter.
+// This is provided as a convenience so that messages types not already handled can be sent, see the message
+// builders like NewInputStreamMessage. If the message SequenceNumber field is less than 0, the next sequence number
+// of the input stream is assigned.  WriteMsg is safe for concurrent use: sequence numbers are assigned and messages
+// are sent while holding the same lock, so messages are always sent in sequence number order.
 func (c *SsmDataChannel) WriteMsg(msg *AgentMessage) (int, error) {
+	if max := c.maxPayloadSize(); len(msg.Payload) > max {
+		return 0, fmt.Errorf("%w: %d bytes, maximum is %d bytes", ErrPayloadTooLarge, len(msg.Payload), max)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	if !c.synSent {
 		atomic.StoreInt64(&c.seqNum, 0)
 		msg.Flags = Syn
@@ -198,102 +470,178 @@ func (c *SsmDataChannel) WriteMsg(msg *AgentMessage) (int, error) {
 	}
 
 	if msg.SequenceNumber < 0 {
-		atomic.StoreInt64(&c.seqNum, 1)
+		msg.SequenceNumber = atomic.AddInt64(&c.seqNum, 1)
 	}
+	c.stamp(msg)
 
 	data, err := msg.MarshalBinary()
 	if err != nil {
-		return 0, err
+		return 0, fmt.Errorf("error marshaling message: %w", err)
 	}
-
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	c.logMsg("SEND", msg)
 	c.synSent = true
 
-	if c.outMsgBuf != nil && msg.MessageType != Acknowledge && msg.PayloadType != HandshakeResponse {
-		err = c.outMsgBuf.Add(msg)
+	// messages other than acknowledgements and flow control must be acknowledged by the agent, and are resent
+	// until they are
+	reliable := msg.MessageType != Acknowledge && msg.PayloadType != HandshakeResponse &&
+		msg.MessageType != PausePublication && msg.MessageType != StartPublication
+
+	if c.paused() || c.isResuming() {
+		if reliable {
+			// sent once publication resumes, or the session is resumed
+			c.track(msg, data, false)
+		}
+		return int(msg.payloadLength), nil
 	}
 
-	if !c.pausePub {
-		return int(msg.payloadLength), c.ws.WriteMessage(websocket.BinaryMessage, data)
+	if err = c.ws.WriteMessage(data); err != nil {
+		if reliable && c.canResume() {
+			// sent once the reader resumes the session on a new connection
+			c.track(msg, data, false)
+			return int(msg.payloadLength), nil
+		}
+		return 0, withCause(ErrConnectionLost, "error writing websocket message", err)
 	}
-	return int(msg.payloadLength), err
+	c.stats.sent(msg)
+
+	if reliable {
+		c.track(msg, data, true)
+	}
+	return int(msg.payloadLength), nil
 }
 
-//nolint:gocognit,gocyclo
 // HandleMsg takes the unprocessed message bytes from the websocket connection (a la Read()), unmarshals the data
 // and takes the appropriate action based on the message type.  Messages which have an actionable payload (output
 // payload types, and channel closed payloads) will have that data returned.  Errors will be returned for unknown/
-// unhandled message or payload types.  A ChannelClosed message type will return an io.EOF error to indicate that
-// this SSM data channel is shutting down and should no longer be used.
+// unhandled message or payload types (matching ErrUnknownMessageType).  A ChannelClosed message type will return a
+// *ChannelClosedError, which matches io.EOF, to indicate that this SSM data channel is shutting down and should no
+// longer be used.
 func (c *SsmDataChannel) HandleMsg(data []byte) ([]byte, error) {
 	m := new(AgentMessage)
 	if err := m.UnmarshalBinary(data); err != nil {
 		// validation error
-		return nil, err
+		return nil, fmt.Errorf("error unmarshaling message: %w", err)
+	}
+	return c.handleMessage(m)
+}
+
+// handleMessage takes the action for the unmarshaled message, see HandleMsg.
+//
+//nolint:gocognit,gocyclo
+func (c *SsmDataChannel) handleMessage(m *AgentMessage) ([]byte, error) {
+	c.logMsg("RECV", m)
+	c.stats.received(m)
+	c.recordSchemaVersion(m)
+
+	if c.hooks.OnMessage != nil {
+		c.hooks.OnMessage(m)
 	}
 
 	//nolint:exhaustive // we'll add more as we find them
 	switch m.MessageType {
 	case Acknowledge:
-		if c.outMsgBuf != nil {
-			c.outMsgBuf.Remove(m.SequenceNumber)
-		}
+		// acknowledgements are not themselves acknowledged
+		return nil, c.acknowledged(m)
 	case PausePublication:
-		c.pausePub = true
+		// flow control messages are not acknowledged
+		c.setPaused(true)
+		return nil, nil
 	case StartPublication:
-		c.pausePub = false
+		c.setPaused(false)
+		return nil, nil
 	case OutputStreamData:
-		switch m.PayloadType {
-		case Output:
-			// unbuffered - return payload directly
-			if c.inMsgBuf == nil {
-				_ = c.sendAcknowledgeMessage(m) // todo - handle error?
-				return m.Payload, nil
+		// duplicate message - acknowledge and discard
+		if dup, err := c.duplicate(m); dup {
+			if err != nil {
+				return nil, fmt.Errorf("error sending acknowledge message: %w", err)
 			}
+			return nil, nil
+		}
 
-			// duplicate message - discard
-			if m.SequenceNumber < c.inSeqNum {
-				return nil, nil
-			}
+		if err := c.checkGap(m); err != nil {
+			return nil, err
+		}
 
-			// queue everything else
-			if err := c.inMsgBuf.Add(m); err != nil {
-				return nil, err
-			}
-		case HandshakeRequest:
-			// port forwarding session setup, we'll consider a handshake failure fatal
-			if err := c.processHandshakeRequest(m); err != nil {
-				return nil, err
-			}
-		case HandshakeComplete:
-			if c.handshakeCh != nil {
-				close(c.handshakeCh)
+		if c.deliver != nil && m.SequenceNumber == c.ExpectedSequenceNumber() {
+			return c.handleInSequence(m)
+		}
+
+		// queue everything, messages are processed in sequence number order by processInboundQueue
+		if err := c.inMsgBuf.Add(m); err != nil {
+			if errors.Is(err, ErrBufferFull) {
+				// not acknowledged, so the agent will send it again
+				return nil, nil
 			}
-		default:
-			return nil, fmt.Errorf("UNKNOWN INCOMING MSG PAYLOAD: %s\n%s", m, m.Payload)
+			return nil, err
 		}
+		c.recent.add(m)
 	case ChannelClosed:
 		payload := new(ChannelClosedPayload)
 		if err := json.Unmarshal(m.Payload, payload); err != nil {
-			return nil, err
+			return nil, fmt.Errorf("error decoding channel closed payload: %w", err)
+		}
+
+		if c.hooks.OnChannelClosed != nil {
+			c.hooks.OnChannelClosed(payload)
 		}
 
+		c.finish(payload, nil)
+
 		var output []byte
 		if len(payload.Output) > 0 {
 			output = []byte(payload.Output)
 		}
-		return output, io.EOF
+		return output, &ChannelClosedError{Payload: payload}
 	default:
-		return nil, fmt.Errorf("UNKNOWN MESSAGE TYPE: %+v", m)
+		return nil, c.unknownMessage(m, fmt.Errorf("%w: %s", ErrUnknownMessageType, m))
 	}
 
 	if err := c.sendAcknowledgeMessage(m); err != nil {
 		// todo - handle this better (retry?)
-		return nil, err
+		return nil, fmt.Errorf("error sending acknowledge message: %w", err)
 	}
 
-	return c.processInboundQueue()
+	payload, err := c.processInboundQueue()
+	c.emitOutput(payload)
+	return payload, err
+}
+
+// SessionID returns the ID of the session returned by the StartSession API, or provided to OpenWithSession.  The
+// value can be used with the TerminateSession API, and to find the session in the session history.  The value is
+// empty if the session was opened with StartSessionFromDataChannelURL.
+func (c *SsmDataChannel) SessionID() string {
+	return c.sessionID
+}
+
+// StreamURL returns the websocket URL of the session, as returned by the StartSession API, or by the ResumeSession
+// API if the session was resumed.  The token used to open the data channel is not included, since it is only valid
+// once, and only for a short time.
+func (c *SsmDataChannel) StreamURL() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.wsURL
+}
+
+// SetBufferSize configures the number of incoming messages held while waiting for a missing message, which arrive
+// out of order (usually after a message was lost and is being retransmitted by the agent).  Messages which don't fit
+// are not acknowledged, so the agent sends them again later.  A size less than 1 restores the DefaultBufferSize.
+// Must be called before the data channel is opened.
+func (c *SsmDataChannel) SetBufferSize(size int) {
+	c.bufSize = size
+}
+
+func (c *SsmDataChannel) bufferSize() int {
+	if c.bufSize < 1 {
+		return DefaultBufferSize
+	}
+	return c.bufSize
+}
+
+// SetMaxPayloadSize configures the largest message payload which will be sent to the agent.  Larger payloads are
+// split into multiple messages by Write, and rejected with ErrPayloadTooLarge by WriteMsg.  A size less than 1
+// restores the DefaultMaxPayloadSize.
+func (c *SsmDataChannel) SetMaxPayloadSize(size int) {
+	c.maxPayload = size
 }
 
 // SetTerminalSize sends a message to the SSM service which indicates the size to use for the remote terminal
@@ -311,39 +659,62 @@ func (c *SsmDataChannel) SetTerminalSize(rows, cols uint32) error {
 
 	payload, err := json.Marshal(input)
 	if err != nil {
-		return err
+		return fmt.Errorf("error encoding terminal size: %w", err)
 	}
 
-	msg := NewAgentMessage()
-	msg.MessageType = InputStreamData
-	msg.Flags = Data
-	msg.SequenceNumber = atomic.AddInt64(&c.seqNum, 1)
-	msg.PayloadType = Size
-	msg.Payload = payload
-
 	// Remind our future selves what the last-set values were:
 	c.lastRows = rows
 	c.lastCols = cols
 
-	_, err = c.WriteMsg(msg)
-	return err
+	if _, err = c.WriteMsg(NewInputStreamMessage(Size, payload)); err != nil {
+		return err
+	}
+
+	c.emit(Event{Type: EventResized, Rows: rows, Cols: cols})
+	return nil
 }
 
 // TerminateSession sends the TerminateSession message to the AWS service to indicate that the port forwarding
 // session is ending, so it can clean up any connections used to communicate with the EC2 instance agent.
 func (c *SsmDataChannel) TerminateSession() error {
-	msg := NewAgentMessage()
-	msg.MessageType = InputStreamData
-	msg.SequenceNumber = atomic.AddInt64(&c.seqNum, 1)
-	msg.Flags = Fin
-	msg.PayloadType = Flag
+	return c.sendFlag(TerminateSession, Fin)
+}
 
-	buf := make([]byte, 4)
-	binary.BigEndian.PutUint32(buf, uint32(TerminateSession))
-	msg.Payload = buf
+// TerminateSessionWait sends the TerminateSession message, and then reads from the data channel (discarding any
+// output) until the agent confirms the session is closed with the ChannelClosed message, so callers know the agent
+// cleaned up the session before they exit.  Returns the result of Wait once the session ends, or an error if the
+// context is done first.  The data channel must not be read by anything else, callers with a reader running should
+// call TerminateSession and then Wait.  The data channel is not closed.
+func (c *SsmDataChannel) TerminateSessionWait(ctx context.Context) (*ChannelClosedPayload, error) {
+	if err := c.TerminateSession(); err != nil {
+		return nil, err
+	}
 
-	_, err := c.WriteMsg(msg)
-	return err
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			msg, err := c.readWhole(buf)
+			if err == nil {
+				_, err = c.HandleMsg(msg)
+			}
+
+			select {
+			case <-c.Done():
+				return
+			default:
+				if err != nil {
+					c.logf(LevelWarn, "error reading while waiting for the session to close: %v", err)
+				}
+			}
+		}
+	}()
+
+	select {
+	case <-c.Done():
+		return c.Wait()
+	case <-ctx.Done():
+		return nil, fmt.Errorf("session not closed by the agent: %w", ctx.Err())
+	}
 }
 
 // DisconnectPort sends the DisconnectToPort message to the AWS service to indicate that a non-muxing stream is
@@ -351,87 +722,168 @@ func (c *SsmDataChannel) TerminateSession() error {
 // the TerminateSession action, the websocket connection is still capable of initiating a new port forwarding
 // stream to the agent without needing to restart the program.
 func (c *SsmDataChannel) DisconnectPort() error {
-	msg := NewAgentMessage()
-	msg.MessageType = InputStreamData
-	msg.SequenceNumber = atomic.AddInt64(&c.seqNum, 1)
-	msg.Flags = Data
-	msg.PayloadType = Flag
+	return c.sendFlag(DisconnectToPort, Data)
+}
 
-	buf := make([]byte, 4)
-	binary.BigEndian.PutUint32(buf, uint32(DisconnectToPort))
-	msg.Payload = buf
+// sendFlag sends an input stream data message with a Flag payload type, and the flag value as the payload.
+func (c *SsmDataChannel) sendFlag(flag PayloadTypeFlag, msgFlag AgentMessageFlag) error {
+	msg := NewFlagMessage(flag)
+	msg.Flags = msgFlag
 
 	_, err := c.WriteMsg(msg)
 	return err
 }
 
-func (c *SsmDataChannel) processInboundQueue() ([]byte, error) {
-	if c.inMsgBuf == nil {
-		return nil, nil
+// initialize sets up the internal state used during session setup, and starts the outbound message processor.
+// Only the first call has any effect.
+func (c *SsmDataChannel) initialize() {
+	c.initOnce.Do(func() {
+		c.handshakeCh = make(chan bool, 1)
+		c.inMsgBuf = NewMessageBuffer(c.bufferSize())
+
+		go c.processOutboundQueue()
+	})
+}
+
+// finish records the reason the session terminated, and signals any goroutines waiting on Done().  Only the
+// first call has any effect.
+func (c *SsmDataChannel) finish(reason *ChannelClosedPayload, err error) {
+	_ = c.Done() // make sure the channel is initialized
+	c.doneOnce.Do(func() {
+		c.closeReason = reason
+		c.closeErr = err
+		c.closedAt = time.Now()
+		close(c.doneCh)
+		c.emit(Event{Type: EventClosed, Reason: reason, Err: err})
+
+		if err != nil {
+			c.setState(StateFailed)
+		} else {
+			c.setState(StateClosed)
+		}
+	})
+}
+
+func (c *SsmDataChannel) maxPayloadSize() int {
+	if c.maxPayload < 1 {
+		return DefaultMaxPayloadSize
 	}
+	return c.maxPayload
+}
 
-	var err error
+// processInboundQueue processes the queued output stream messages which are next in sequence, so messages which
+// arrived ahead of a missing message are held until it arrives.  The payloads of the processed Output messages are
+// returned in order.  If output is delivered to a callback (see handleInSequence) and the delivery fails, the
+// message stays queued, and the delivery is retried when the next message arrives.
+func (c *SsmDataChannel) processInboundQueue() ([]byte, error) {
 	data := new(bytes.Buffer)
 
 	for {
-		if msg := c.inMsgBuf.Get(c.inSeqNum); msg != nil {
-			atomic.AddInt64(&c.inSeqNum, 1)
+		msg := c.inMsgBuf.Get(atomic.LoadInt64(&c.inSeqNum))
+		if msg == nil {
+			break
+		}
 
-			if _, err = data.Write(msg.Payload); err != nil {
-				break
+		payload, err := c.processOutput(msg)
+		if err == nil && len(payload) > 0 && c.deliver != nil {
+			if err = c.deliver(payload); err != nil {
+				return data.Bytes(), err
 			}
+		}
 
-			c.inMsgBuf.Remove(msg.SequenceNumber)
-		} else {
-			break
+		c.inMsgBuf.Remove(msg.SequenceNumber)
+		atomic.AddInt64(&c.inSeqNum, 1)
+
+		data.Write(payload)
+		if err != nil {
+			return data.Bytes(), err
 		}
 	}
 
-	return data.Bytes(), err
+	return data.Bytes(), nil
 }
 
-func (c *SsmDataChannel) processOutboundQueue() {
-	for {
-		time.Sleep(500 * time.Millisecond)
-		if c.pausePub {
-			continue
+// handleInSequence processes the output stream message which is next in sequence when output is delivered to a
+// callback (see PluginDataChannel).  Like the session manager plugin, the message is only acknowledged once its
+// output is delivered, so if the delivery fails the agent sends the message again.
+func (c *SsmDataChannel) handleInSequence(m *AgentMessage) ([]byte, error) {
+	payload, err := c.processOutput(m)
+	if err == nil && len(payload) > 0 {
+		if e := c.deliver(payload); e != nil {
+			// not acknowledged, so the agent sends it again
+			return nil, e
 		}
+	}
 
-		if c.outMsgBuf == nil {
-			return
+	if e := c.sendAcknowledgeMessage(m); e != nil {
+		return nil, fmt.Errorf("error sending acknowledge message: %w", e)
+	}
+	atomic.AddInt64(&c.inSeqNum, 1)
+	c.recent.add(m)
+
+	if err == nil {
+		var queued []byte
+		queued, err = c.processInboundQueue()
+		payload = append(append([]byte(nil), payload...), queued...)
+	}
+
+	c.emitOutput(payload)
+	return payload, err
+}
+
+// processOutput takes the appropriate action for an output stream message based on the payload type.  The payload
+// of Output messages is returned.
+func (c *SsmDataChannel) processOutput(m *AgentMessage) ([]byte, error) {
+	//nolint:exhaustive // we'll add more as we find them
+	switch m.PayloadType {
+	case Output:
+		if c.State() == StateHandshaking {
+			// agents which don't send a handshake start with the output
+			c.setState(StateOpen)
 		}
 
-		for m := c.outMsgBuf.Next(); m != nil; m = c.outMsgBuf.Next() {
-			if _, err := c.WriteMsg(m); err != nil {
-				// todo - handle error?
-			}
+		if c.Encrypted() {
+			return c.decrypt(m.Payload)
+		}
+		return m.Payload, nil
+	case StdErr:
+		return c.processStderr(m)
+	case ExitCode:
+		return nil, c.processExitCode(m)
+	case HandshakeRequest:
+		// port forwarding session setup, we'll consider a handshake failure fatal
+		if err := c.processHandshakeRequest(m); err != nil {
+			return nil, withCause(ErrHandshakeFailed, "error processing handshake request", err)
+		}
+	case HandshakeComplete:
+		c.processHandshakeComplete(m)
+		if c.handshakeCh != nil {
+			close(c.handshakeCh)
 		}
+		c.emit(Event{Type: EventHandshakeDone})
+		c.setState(StateOpen)
+	case EncChallengeRequest:
+		if err := c.processEncryptionChallenge(m); err != nil {
+			return nil, withCause(ErrHandshakeFailed, "error processing encryption challenge", err)
+		}
+	case Flag:
+		return nil, c.processFlag(m)
+	default:
+		return nil, c.unknownMessage(m, fmt.Errorf("%w: unknown payload type in %s\n%s", ErrUnknownMessageType, m,
+			c.redact(m.Payload)))
 	}
+	return nil, nil
 }
 
 // sendAcknowledgeMessage sends the Acknowledge message type for each incoming message read from
 // the web socket connection, which is required as part of the SSM session protocol.
 func (c *SsmDataChannel) sendAcknowledgeMessage(msg *AgentMessage) error {
-	ack := map[string]interface{}{
-		"AcknowledgedMessageType":           msg.MessageType,
-		"AcknowledgedMessageId":             msg.messageID.String(),
-		"AcknowledgedMessageSequenceNumber": msg.SequenceNumber,
-		"IsSequentialMessage":               true,
-	}
-
-	payload, err := json.Marshal(ack)
+	ack, err := NewAckFor(msg)
 	if err != nil {
 		return err
 	}
 
-	agentMsg := NewAgentMessage()
-	agentMsg.MessageType = Acknowledge
-	agentMsg.SequenceNumber = msg.SequenceNumber
-	agentMsg.Flags = Ack
-	agentMsg.PayloadType = Undefined
-	agentMsg.Payload = payload
-
-	_, err = c.WriteMsg(agentMsg)
+	_, err = c.WriteMsg(ack)
 	return err
 }
 
@@ -441,81 +893,108 @@ func (c *SsmDataChannel) sendAcknowledgeMessage(msg *AgentMessage) error {
 func (c *SsmDataChannel) processHandshakeRequest(msg *AgentMessage) error {
 	req := new(HandshakeRequestPayload)
 	if err := json.Unmarshal(msg.Payload, req); err != nil {
-		return err
+		return fmt.Errorf("error decoding handshake request: %w", err)
 	}
+	c.handshake.Store(req)
 
-	payload, err := json.Marshal(buildHandshakeResponse(req.RequestedClientActions))
+	res := c.buildHandshakeResponse(req.RequestedClientActions)
+	c.hsResponse.Store(res)
+
+	payload, err := json.Marshal(res)
 	if err != nil {
-		return err
+		return fmt.Errorf("error encoding handshake response: %w", err)
 	}
 
-	out := NewAgentMessage()
-	out.MessageType = InputStreamData
+	out := NewInputStreamMessage(HandshakeResponse, payload)
 	out.SequenceNumber = msg.SequenceNumber
-	out.Flags = Data
-	out.PayloadType = HandshakeResponse
-	out.Payload = payload
 
 	_, err = c.WriteMsg(out)
 	return err
 }
 
-func (c *SsmDataChannel) startSession(cfg aws.Config, in *ssm.StartSessionInput) error {
-	out, err := ssm.NewFromConfig(cfg).StartSession(context.Background(), in)
+func (c *SsmDataChannel) startSession(ctx context.Context, cfg aws.Config, in *ssm.StartSessionInput) error {
+	out, err := c.callStartSession(ctx, cfg, in)
 	if err != nil {
-		return err
+		err = explainStartError(ctx, c.ssmClient(cfg), aws.ToString(in.Target), err)
+		return fmt.Errorf("error calling StartSession: %w", err)
 	}
+	c.sessionID = aws.ToString(out.SessionId)
 	return c.StartSessionFromDataChannelURL(*out.StreamUrl, *out.TokenValue)
 }
 
+// StartSessionFromDataChannelURL opens the data channel using the stream URL and token value of a session which was
+// already started.  OpenWithSession should be preferred, since it also records the session ID.
 func (c *SsmDataChannel) StartSessionFromDataChannelURL(url string, token string) error {
-	ws, _, err := websocket.DefaultDialer.Dial(url, http.Header{}) //nolint:bodyclose
-	if err != nil {
+	c.initialize()
+	c.setState(StateConnecting)
+
+	if err := c.dial(url); err != nil {
 		return err
 	}
-	c.ws = ws
 
-	if err = c.openDataChannel(token); err != nil {
+	if err := c.openDataChannel(token); err != nil {
 		_ = c.Close()
-		return err
+		return fmt.Errorf("error opening data channel: %w", err)
 	}
 
+	c.openedAt = time.Now()
+	c.emit(Event{Type: EventOpened})
+	c.setState(StateHandshaking)
+	c.startIdleTimer()
 	return nil
 }
 
 func (c *SsmDataChannel) openDataChannel(token string) error {
 	openDataChanInput := map[string]string{
-		"MessageSchemaVersion": "1.0",
-		"RequestId":            uuid.New().String(),
+		"MessageSchemaVersion": MessageSchemaVersion,
+		"RequestId":            c.requestID(),
 		"TokenValue":           token,
 	}
 
+	data, err := json.Marshal(openDataChanInput)
+	if err != nil {
+		return err
+	}
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	return c.ws.WriteJSON(openDataChanInput)
+	return c.ws.WriteText(data)
 }
 
 // the only requirement of the handshake response is that we include an element in ProcessedClientActions
 // for each element of RequestedClientActions (there's only 2 types, and port forwarding only uses the
 // SessionType action type, so there should only be 1 element), and the ActionStatus is Success.  Any
-// non-success is considered a failure in the receiving agent.
-func buildHandshakeResponse(actions []RequestedClientAction) *HandshakeResponsePayload {
+// non-success is considered a failure in the receiving agent.  Sessions using KMS encryption also include the
+// KMSEncryption action, which exchanges the session encryption keys.  Action types we don't know about are
+// reported as Unsupported, and the errors of all unsuccessful actions are included in the Errors field.
+func (c *SsmDataChannel) buildHandshakeResponse(actions []RequestedClientAction) *HandshakeResponsePayload {
 	res := HandshakeResponsePayload{
 		// seems this can be whatever we need it to be, however certain features may only be available at
 		// certain client versions (must report at least version 1.1.70 to do stream muxing)
-		ClientVersion:          "0.0.1",
+		ClientVersion:          c.getClientVersion(),
 		ProcessedClientActions: make([]ProcessedClientAction, len(actions)),
 	}
 
 	for i, a := range actions {
-		action := new(ProcessedClientAction)
+		var action ProcessedClientAction
 
-		if a.ActionType == SessionType {
-			action.ActionType = a.ActionType
-			action.ActionStatus = Success
+		switch a.ActionType {
+		case SessionType:
+			action = c.processSessionType(a.ActionParameters)
+		case KMSEncryption:
+			action = c.processKMSEncryption(a.ActionParameters)
+		default:
+			action = ProcessedClientAction{
+				ActionType:   a.ActionType,
+				ActionStatus: Unsupported,
+				Error:        fmt.Sprintf("unsupported action %s", a.ActionType),
+			}
 		}
 
-		res.ProcessedClientActions[i] = *action
+		if len(action.Error) > 0 {
+			res.Errors = append(res.Errors, action.Error)
+		}
+		res.ProcessedClientActions[i] = action
 	}
 
 	return &res
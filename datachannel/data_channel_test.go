@@ -0,0 +1,81 @@
+package datachannel
+
+import (
+	"sync"
+	"testing"
+)
+
+// testTransport is a Transport recording the messages written to it.
+type testTransport struct {
+	mu   sync.Mutex
+	sent [][]byte
+	done chan struct{}
+}
+
+func newTestTransport() *testTransport {
+	return &testTransport{done: make(chan struct{})}
+}
+
+func (t *testTransport) ReadMessage() ([]byte, error) {
+	<-t.done
+	return nil, ErrShutdown
+}
+
+func (t *testTransport) WriteMessage(data []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sent = append(t.sent, append([]byte(nil), data...))
+	return nil
+}
+
+func (t *testTransport) WriteText(data []byte) error {
+	return t.WriteMessage(data)
+}
+
+func (t *testTransport) Close() error {
+	return nil
+}
+
+func outputMessage(t *testing.T, seq int64, payload string) []byte {
+	t.Helper()
+
+	m := NewAgentMessage()
+	m.MessageType = OutputStreamData
+	m.SequenceNumber = seq
+	m.PayloadType = Output
+	m.Payload = []byte(payload)
+
+	data, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestOutOfOrderMessagesWithReusedBuffer(t *testing.T) {
+	c := new(SsmDataChannel)
+	c.initialize()
+	c.ws = newTestTransport()
+
+	// readers re-use the same buffer for each message, like readOutput
+	buf := make([]byte, 2048)
+
+	n := copy(buf, outputMessage(t, 1, "second"))
+	out, err := c.HandleMsg(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) > 0 {
+		t.Fatalf("message ahead of sequence was delivered: %q", out)
+	}
+
+	n = copy(buf, outputMessage(t, 0, "first!"))
+	out, err = c.HandleMsg(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(out) != "first!second" {
+		t.Errorf("got %q, want %q", out, "first!second")
+	}
+}
@@ -0,0 +1,69 @@
+package datachannel
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/uuid"
+)
+
+// recentMessages is the number of received message IDs remembered for duplicate detection.  It only needs to cover
+// the messages the agent may retransmit, which is limited by the size of the incoming message buffer.
+const recentMessages = 256
+
+// messageKey identifies a received message.  The agent uses the same message ID and sequence number when it
+// retransmits a message.
+type messageKey struct {
+	id  uuid.UUID
+	seq int64
+}
+
+// recentIDs is a fixed size set of the most recently received messages, the oldest entries are evicted first.
+// The zero value is ready to use.
+type recentIDs struct {
+	mu   sync.Mutex
+	set  map[messageKey]bool
+	ring []messageKey
+	next int
+}
+
+// contains reports if the message was already received.
+func (r *recentIDs) contains(msg *AgentMessage) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.set[messageKey{id: msg.messageID, seq: msg.SequenceNumber}]
+}
+
+// add records the message as received.
+func (r *recentIDs) add(msg *AgentMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.set == nil {
+		r.set = make(map[messageKey]bool, recentMessages)
+		r.ring = make([]messageKey, recentMessages)
+	}
+
+	k := messageKey{id: msg.messageID, seq: msg.SequenceNumber}
+	if r.set[k] {
+		return
+	}
+
+	delete(r.set, r.ring[r.next])
+	r.ring[r.next] = k
+	r.next = (r.next + 1) % len(r.ring)
+	r.set[k] = true
+}
+
+// duplicate reports if the output stream message has already been received, either because it was processed, or
+// it is waiting in the incoming message buffer.  Duplicates are acknowledged again, since the agent retransmits
+// messages when it misses our acknowledgement, and must not be processed a second time.
+func (c *SsmDataChannel) duplicate(msg *AgentMessage) (bool, error) {
+	if msg.SequenceNumber >= c.ExpectedSequenceNumber() && !c.recent.contains(msg) {
+		return false, nil
+	}
+
+	atomic.AddInt64(&c.stats.dups, 1)
+	return true, c.sendAcknowledgeMessage(msg)
+}
@@ -0,0 +1,186 @@
+package datachannel
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// kmsDataKeySize is the size of the data key generated for an encrypted session, which is split into the keys used
+// for each direction.
+const kmsDataKeySize = 64
+
+// ErrEncryptionNotReady is returned when decrypting session data from the agent before the encryption keys have
+// been exchanged in the handshake.
+var ErrEncryptionNotReady = errors.New("session encryption keys have not been exchanged")
+
+// encrypter holds the ciphers for a session using KMS encryption.  The data key is generated by the client and sent
+// to the agent encrypted with the KMS key requested by the agent.  The first half of the key is used for data sent
+// by the agent, and the second half for data sent by the client.  Payloads are the nonce followed by the AES-GCM
+// sealed data.
+// REF: https://github.com/aws/session-manager-plugin/blob/mainline/src/encryption/encrypter.go.
+type encrypter struct {
+	enc cipher.AEAD
+	dec cipher.AEAD
+}
+
+// SetEncryptionConfig provides the details required to exchange the encryption keys of a session using KMS
+// encryption.  The aws.Config parameter is used to call the KMS GenerateDataKey API, and the session and target IDs
+// are used as the encryption context.  This is set automatically by Open, and only needs to be called for sessions
+// opened using OpenWithSession.
+func (c *SsmDataChannel) SetEncryptionConfig(cfg aws.Config, sessionID, targetID string) {
+	c.awsCfg = cfg
+	c.sessionID = sessionID
+	c.targetID = targetID
+}
+
+// Encrypted reports if the session data is encrypted using the keys exchanged in the handshake.
+func (c *SsmDataChannel) Encrypted() bool {
+	return c.encrypter() != nil
+}
+
+func (c *SsmDataChannel) encrypter() *encrypter {
+	e, _ := c.enc.Load().(*encrypter)
+	return e
+}
+
+// processKMSEncryption generates the data key for the KMSEncryption handshake action, and returns the action
+// result containing the KMS encrypted copy of the key for the agent.
+func (c *SsmDataChannel) processKMSEncryption(params interface{}) ProcessedClientAction {
+	action := ProcessedClientAction{ActionType: KMSEncryption, ActionStatus: Failed}
+
+	req := new(KMSEncryptionRequest)
+	if data, err := json.Marshal(params); err == nil {
+		err = json.Unmarshal(data, req)
+	}
+
+	if len(req.KMSKeyID) < 1 {
+		action.Error = "KMS key ID not provided"
+		return action
+	}
+
+	out, err := kms.NewFromConfig(c.awsCfg).GenerateDataKey(context.Background(), &kms.GenerateDataKeyInput{
+		KeyId:         aws.String(req.KMSKeyID),
+		NumberOfBytes: aws.Int32(kmsDataKeySize),
+		EncryptionContext: map[string]string{
+			"aws:ssm:SessionId": c.sessionID,
+			"aws:ssm:TargetId":  c.targetID,
+		},
+	})
+	if err != nil {
+		action.Error = fmt.Sprintf("error generating data key: %v", err)
+		return action
+	}
+
+	half := len(out.Plaintext) / 2
+	dec, err := newSessionCipher(out.Plaintext[:half])
+	if err != nil {
+		action.Error = err.Error()
+		return action
+	}
+
+	enc, err := newSessionCipher(out.Plaintext[half:])
+	if err != nil {
+		action.Error = err.Error()
+		return action
+	}
+
+	result, err := json.Marshal(&KMSEncryptionResponse{KMSCipherTextKey: out.CiphertextBlob})
+	if err != nil {
+		action.Error = fmt.Sprintf("error encoding KMS encryption response: %v", err)
+		return action
+	}
+
+	c.enc.Store(&encrypter{enc: enc, dec: dec})
+	action.ActionStatus = Success
+	action.ActionResult = result
+	return action
+}
+
+// processEncryptionChallenge proves to the agent that the client has the session keys, by decrypting the challenge
+// sent by the agent, and sending it back encrypted with the client key.
+func (c *SsmDataChannel) processEncryptionChallenge(msg *AgentMessage) error {
+	req := new(EncryptionChallengeRequest)
+	if err := json.Unmarshal(msg.Payload, req); err != nil {
+		return fmt.Errorf("error decoding encryption challenge: %w", err)
+	}
+
+	challenge, err := c.decrypt(req.Challenge)
+	if err != nil {
+		return err
+	}
+
+	if challenge, err = c.encrypt(challenge); err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(&EncryptionChallengeResponse{Challenge: challenge})
+	if err != nil {
+		return fmt.Errorf("error encoding encryption challenge response: %w", err)
+	}
+
+	_, err = c.WriteMsg(NewInputStreamMessage(EncChallengeResponse, payload))
+	return err
+}
+
+// encrypt returns the payload encrypted with the client key, or the unmodified payload if the session is not
+// encrypted.
+func (c *SsmDataChannel) encrypt(payload []byte) ([]byte, error) {
+	e := c.encrypter()
+	if e == nil {
+		return payload, nil
+	}
+
+	nonce := make([]byte, e.enc.NonceSize(), e.enc.NonceSize()+len(payload)+e.enc.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("error generating nonce: %w", err)
+	}
+	return e.enc.Seal(nonce, nonce, payload, nil), nil
+}
+
+// decrypt returns the payload decrypted with the agent key.
+func (c *SsmDataChannel) decrypt(payload []byte) ([]byte, error) {
+	e := c.encrypter()
+	if e == nil {
+		return nil, ErrEncryptionNotReady
+	}
+
+	size := e.dec.NonceSize()
+	if len(payload) < size {
+		return nil, errors.New("error decrypting payload: too short")
+	}
+
+	data, err := e.dec.Open(nil, payload[:size], payload[size:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting payload: %w", err)
+	}
+	return data, nil
+}
+
+// encryptionOverhead returns the number of bytes encryption adds to a payload.
+func (c *SsmDataChannel) encryptionOverhead() int {
+	if e := c.encrypter(); e != nil {
+		return e.enc.NonceSize() + e.enc.Overhead()
+	}
+	return 0
+}
+
+func newSessionCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating session cipher: %w", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("error creating session cipher: %w", err)
+	}
+	return aead, nil
+}
@@ -0,0 +1,60 @@
+package datachannel
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// SetEndpoint overrides the endpoint of the SSM API used to start and resume sessions, like a VPC interface endpoint
+// (https://vpce-0123456789abcdef0-abcdefgh.ssm.us-east-1.vpce.amazonaws.com).  An empty value restores the default
+// resolution, which follows the region and partition of the aws.Config, and honors FIPS and dual-stack settings
+// loaded with the configuration (like config.WithUseFIPSEndpoint, or AWS_USE_FIPS_ENDPOINT).
+func (c *SsmDataChannel) SetEndpoint(endpoint string) {
+	c.apiEndpoint = endpoint
+}
+
+// SetStreamEndpoint overrides the scheme and host of the stream URL returned by the StartSession API, so the websocket
+// connects to a different ssmmessages endpoint (like a VPC interface endpoint without private DNS, or a proxy).  The
+// path and query of the stream URL are kept.  If the endpoint has no scheme, wss is used.  An empty value uses the
+// stream URL as returned.
+func (c *SsmDataChannel) SetStreamEndpoint(endpoint string) {
+	c.wsEndpoint = endpoint
+}
+
+// ssmClient returns an SSM API client using the configured endpoint.
+func (c *SsmDataChannel) ssmClient(cfg aws.Config) *ssm.Client {
+	return ssm.NewFromConfig(cfg, func(o *ssm.Options) {
+		if len(c.apiEndpoint) > 0 {
+			o.EndpointResolver = ssm.EndpointResolverFromURL(c.apiEndpoint)
+		}
+	})
+}
+
+// streamURL returns the stream URL to connect to, using the configured stream endpoint.
+func (c *SsmDataChannel) streamURL(stream string) (string, error) {
+	if len(c.wsEndpoint) < 1 {
+		return stream, nil
+	}
+
+	ep := c.wsEndpoint
+	if !strings.Contains(ep, "://") {
+		ep = "wss://" + ep
+	}
+
+	epURL, err := url.Parse(ep)
+	if err != nil {
+		return "", fmt.Errorf("invalid stream endpoint: %w", err)
+	}
+
+	u, err := url.Parse(stream)
+	if err != nil {
+		return "", fmt.Errorf("invalid stream URL: %w", err)
+	}
+
+	u.Scheme, u.Host = epURL.Scheme, epURL.Host
+	return u.String(), nil
+}
@@ -0,0 +1,66 @@
+package datachannel
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	// ErrChannelClosed matches the *ChannelClosedError returned from HandleMsg when the agent closes the channel.
+	ErrChannelClosed = errors.New("channel closed by the agent")
+
+	// ErrHandshakeFailed matches errors returned when the session handshake with the agent fails, or doesn't complete
+	// within the handshake timeout.  The cause is wrapped, so it can still be checked with errors.Is and errors.As.
+	ErrHandshakeFailed = errors.New("session handshake failed")
+
+	// ErrUnknownMessageType matches errors returned from HandleMsg for messages with a message type or payload type
+	// this package doesn't know how to handle.
+	ErrUnknownMessageType = errors.New("unknown message type")
+
+	// ErrConnectionLost matches errors returned when the websocket connection fails, and the session could not be
+	// resumed (see SetAutoReconnect).  The cause is wrapped.
+	ErrConnectionLost = errors.New("connection lost")
+)
+
+// ChannelClosedError is the error returned from HandleMsg when the agent closes the channel, and carries the
+// ChannelClosed message.  It matches both ErrChannelClosed and io.EOF, so callers which only check for io.EOF (with
+// errors.Is) are not affected.
+type ChannelClosedError struct {
+	Payload *ChannelClosedPayload
+}
+
+func (e *ChannelClosedError) Error() string {
+	if e.Payload != nil && len(e.Payload.Output) > 0 {
+		return ErrChannelClosed.Error() + ": " + e.Payload.Output
+	}
+	return ErrChannelClosed.Error()
+}
+
+// Is reports if the error matches target, which is true for ErrChannelClosed and io.EOF.
+func (e *ChannelClosedError) Is(target error) bool {
+	return target == ErrChannelClosed || target == io.EOF
+}
+
+// causeError is an error matching one of the exported sentinel errors, which wraps the error which caused it.
+type causeError struct {
+	kind error
+	msg  string
+	err  error
+}
+
+// withCause returns an error matching kind, with the message and the cause.
+func withCause(kind error, msg string, err error) error {
+	return &causeError{kind: kind, msg: msg, err: err}
+}
+
+func (e *causeError) Error() string {
+	return e.msg + ": " + e.err.Error()
+}
+
+func (e *causeError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *causeError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,126 @@
+package datachannel
+
+import (
+	"time"
+)
+
+// eventBufferSize is the number of events held for a slow consumer before new events are dropped.  The channel has
+// one more slot, which is reserved for EventClosed, so the final event is never dropped.
+const eventBufferSize = 64
+
+// EventType identifies the kind of change in session state described by an Event.
+type EventType int
+
+const (
+	// EventOpened is emitted once the data channel is opened with the AWS service.
+	EventOpened EventType = iota + 1
+	// EventHandshakeDone is emitted when the agent reports the session handshake is complete.
+	EventHandshakeDone
+	// EventOutput is emitted for each payload of session output received from the agent.
+	EventOutput
+	// EventResized is emitted after the remote terminal size is changed.
+	EventResized
+	// EventReconnecting is emitted when the session is being re-established after a connection failure.
+	EventReconnecting
+	// EventClosed is emitted once when the session is terminated, and is always the last event delivered.
+	EventClosed
+	// EventFlag is emitted when the agent sends a flag, like ConnectToPortError.
+	EventFlag
+	// EventIdleTimeout is emitted when the session is shut down because it was idle, see SetIdleTimeout.
+	EventIdleTimeout
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventOpened:
+		return "Opened"
+	case EventHandshakeDone:
+		return "HandshakeDone"
+	case EventOutput:
+		return "Output"
+	case EventResized:
+		return "Resized"
+	case EventReconnecting:
+		return "Reconnecting"
+	case EventClosed:
+		return "Closed"
+	case EventFlag:
+		return "Flag"
+	case EventIdleTimeout:
+		return "IdleTimeout"
+	default:
+		return "Unknown"
+	}
+}
+
+// Event describes a change in the state of the session, suitable for driving user interfaces built on top of
+// the data channel.  Only the fields relevant to the Type of the event are set.
+type Event struct {
+	Type EventType
+	Time time.Time
+	// Output is a copy of the session output for EventOutput events.
+	Output []byte
+	// Rows and Cols are the new terminal size for EventResized events.
+	Rows uint32
+	Cols uint32
+	// Reason is the ChannelClosed payload sent by the agent, and Err is the error which terminated the session,
+	// for EventClosed events.  Either may be nil.
+	Reason *ChannelClosedPayload
+	Err    error
+	// Flag is the flag sent by the agent for EventFlag events.
+	Flag PayloadTypeFlag
+}
+
+// Events returns a channel which receives the Events for this data channel.  The channel is closed after the
+// EventClosed event is delivered.  Events are never allowed to block the session, so if the consumer falls more
+// than a few dozen events behind, new events are dropped until the consumer catches up.  EventClosed is never dropped.
+func (c *SsmDataChannel) Events() <-chan Event {
+	c.evMu.Lock()
+	defer c.evMu.Unlock()
+
+	if c.eventCh == nil {
+		c.eventCh = make(chan Event, eventBufferSize+1)
+		if c.eventsDone {
+			close(c.eventCh)
+		}
+	}
+	return c.eventCh
+}
+
+// emit delivers the event to the consumer of Events(), if there is one.
+func (c *SsmDataChannel) emit(ev Event) {
+	c.evMu.Lock()
+	defer c.evMu.Unlock()
+
+	if c.eventsDone {
+		return
+	}
+
+	if ev.Type == EventClosed {
+		c.eventsDone = true
+	}
+
+	if c.eventCh == nil {
+		return
+	}
+
+	// only emit sends on the channel, and it holds the lock, so the length can only go down after the check
+	if ev.Type != EventClosed && len(c.eventCh) >= eventBufferSize {
+		return
+	}
+
+	ev.Time = time.Now()
+	c.eventCh <- ev
+
+	if c.eventsDone {
+		close(c.eventCh)
+	}
+}
+
+// emitOutput sends an EventOutput event with a copy of the payload, since the payload is usually backed by a
+// buffer which is re-used for reading the next message.
+func (c *SsmDataChannel) emitOutput(payload []byte) {
+	if len(payload) > 0 {
+		c.emit(Event{Type: EventOutput, Output: append([]byte(nil), payload...)})
+	}
+}
@@ -0,0 +1,49 @@
+package datachannel
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// UnknownFlagError is returned from HandleMsg when the agent sends a flag which the client does not handle.
+type UnknownFlagError struct {
+	Flag PayloadTypeFlag
+}
+
+func (e *UnknownFlagError) Error() string {
+	return fmt.Sprintf("unknown flag from agent: %s", e.Flag)
+}
+
+func (f PayloadTypeFlag) String() string {
+	switch f {
+	case DisconnectToPort:
+		return "DisconnectToPort"
+	case TerminateSession:
+		return "TerminateSession"
+	case ConnectToPortError:
+		return "ConnectToPortError"
+	default:
+		return fmt.Sprintf("Flag(%d)", uint32(f))
+	}
+}
+
+// processFlag handles a Flag payload sent by the agent.  An EventFlag event is emitted for every flag, and flags
+// reporting a failure are returned as errors: ErrConnectToPort when the agent could not connect to the remote port
+// (usually because the connection was refused), and an *UnknownFlagError for flags the client does not know.
+func (c *SsmDataChannel) processFlag(msg *AgentMessage) error {
+	if len(msg.Payload) != 4 {
+		return fmt.Errorf("invalid flag payload length %d", len(msg.Payload))
+	}
+
+	flag := PayloadTypeFlag(binary.BigEndian.Uint32(msg.Payload))
+	c.emit(Event{Type: EventFlag, Flag: flag})
+
+	switch flag {
+	case ConnectToPortError:
+		return ErrConnectToPort
+	case DisconnectToPort, TerminateSession:
+		return nil
+	default:
+		return &UnknownFlagError{Flag: flag}
+	}
+}
@@ -0,0 +1,201 @@
+package datachannel
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// DefaultBackpressureThreshold is the amount of session output WriteTo buffers for a slow destination before asking
+// the agent to pause publication, unless changed using SetBackpressureThreshold.
+const DefaultBackpressureThreshold = 1024 * 1024
+
+// setPaused records the publication state requested by the agent using the PausePublication and StartPublication
+// messages.  Resuming publication wakes up any writers blocked by waitPublication.
+func (c *SsmDataChannel) setPaused(paused bool) {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+
+	if paused {
+		if c.resumeCh == nil {
+			c.resumeCh = make(chan struct{})
+		}
+		return
+	}
+
+	if c.resumeCh != nil {
+		close(c.resumeCh)
+		c.resumeCh = nil
+	}
+}
+
+// paused reports if the agent has paused publication.
+func (c *SsmDataChannel) paused() bool {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+	return c.resumeCh != nil
+}
+
+// waitPublication blocks while the agent has paused publication, until it is resumed.  Returns io.ErrClosedPipe if
+// the session terminates while waiting.
+func (c *SsmDataChannel) waitPublication(ctx context.Context) error {
+	c.pauseMu.Lock()
+	resumeCh := c.resumeCh
+	c.pauseMu.Unlock()
+
+	if resumeCh == nil {
+		return nil
+	}
+
+	select {
+	case <-resumeCh:
+		return nil
+	case <-c.Done():
+		return io.ErrClosedPipe
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SetBackpressureThreshold configures the amount of session output WriteTo buffers for a slow destination before
+// asking the agent to pause publication.  Publication is resumed once the buffered output falls below half of the
+// threshold.  A size less than 1 restores the DefaultBackpressureThreshold.
+func (c *SsmDataChannel) SetBackpressureThreshold(size int) {
+	c.bpThreshold = size
+}
+
+func (c *SsmDataChannel) backpressureThreshold() int {
+	if c.bpThreshold < 1 {
+		return DefaultBackpressureThreshold
+	}
+	return c.bpThreshold
+}
+
+// sendFlowControl sends a PausePublication or StartPublication message to the agent.
+func (c *SsmDataChannel) sendFlowControl(msgType MessageType) error {
+	_, err := c.WriteMsg(NewFlowControlMessage(msgType))
+	return err
+}
+
+// readOutput reads session output from the agent into the queue for WriteTo, until the session ends, reading fails,
+// or the context is done because WriteTo stopped.  Publication is paused when the queue grows past the backpressure
+// threshold.
+func (c *SsmDataChannel) readOutput(ctx context.Context, q *outputQueue) {
+	buf := make([]byte, 2048)
+
+	for ctx.Err() == nil {
+		msg, err := c.readWholeContext(ctx, buf)
+		if ctx.Err() != nil {
+			// WriteTo stopped, a message still being read is returned by the next read of the data channel
+			return
+		}
+
+		if err != nil {
+			c.logf(LevelError, "WriteTo read error: %v", err)
+			q.finish(err)
+			return
+		}
+
+		if len(msg) > 0 {
+			payload, err := c.HandleMsg(msg)
+			if err != nil {
+				c.logf(LevelError, "WriteTo HandleMsg error: %v", err)
+				q.finish(err)
+				return
+			}
+
+			if len(payload) > 0 && q.push(payload) {
+				if err = c.sendFlowControl(PausePublication); err != nil {
+					c.logf(LevelWarn, "WriteTo pause publication error: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// outputQueue holds session output read from the agent until WriteTo has written it to the destination.
+type outputQueue struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	bufs      [][]byte
+	size      int
+	threshold int
+	paused    bool
+	err       error
+	done      bool
+}
+
+func newOutputQueue(threshold int) *outputQueue {
+	q := &outputQueue{threshold: threshold}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// push adds a payload to the queue, and reports if publication should be paused.
+func (q *outputQueue) push(p []byte) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.bufs = append(q.bufs, append([]byte(nil), p...))
+	q.size += len(p)
+	q.cond.Signal()
+
+	if !q.paused && q.size >= q.threshold {
+		q.paused = true
+		return true
+	}
+	return false
+}
+
+// finish records the error which ended reading, WriteTo returns it after writing the queued output.
+func (q *outputQueue) finish(err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.err = err
+	q.done = true
+	q.cond.Signal()
+}
+
+// pop blocks until output is queued, and returns all of it.  Once reading has ended and the queue is empty, the
+// error which ended reading is returned.  The returned output remains counted towards the threshold until it is
+// reported by written.
+func (q *outputQueue) pop() ([][]byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.bufs) < 1 && !q.done {
+		q.cond.Wait()
+	}
+
+	if len(q.bufs) < 1 {
+		return nil, q.err
+	}
+
+	bufs := q.bufs
+	q.bufs = nil
+	return bufs, nil
+}
+
+// written records output written to the destination, and reports if publication should be resumed.
+func (q *outputQueue) written(n int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.size -= n
+	if q.paused && q.size <= q.threshold/2 {
+		q.paused = false
+		return true
+	}
+	return false
+}
+
+// unpause reports if publication was paused, and forgets it, for resuming publication once WriteTo is done.
+func (q *outputQueue) unpause() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	paused := q.paused
+	q.paused = false
+	return paused
+}
@@ -0,0 +1,110 @@
+package datachannel
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// DefaultHandshakeTimeout is the longest time to wait for the session handshake to complete, unless changed using
+// SetHandshakeTimeout.
+const DefaultHandshakeTimeout = time.Minute
+
+// HandshakeInfo contains the messages exchanged in the session handshake.  Request is the handshake request sent by
+// the agent, Response is the response sent by the client, and Complete is the payload of the message sent by the
+// agent when the handshake is done.  Fields are nil until the relevant message is exchanged.
+type HandshakeInfo struct {
+	Request  *HandshakeRequestPayload
+	Response *HandshakeResponsePayload
+	Complete *HandshakeCompletePayload
+}
+
+// AgentVersion returns the version of the agent reported in the handshake request.  The value is empty until the
+// handshake request is received.
+func (c *SsmDataChannel) AgentVersion() string {
+	if req, ok := c.handshake.Load().(*HandshakeRequestPayload); ok {
+		return req.AgentVersion
+	}
+	return ""
+}
+
+// HandshakeInfo returns the messages exchanged in the session handshake so far, so clients can make feature
+// decisions at runtime.  The result is complete once WaitForHandshakeComplete returns.
+func (c *SsmDataChannel) HandshakeInfo() HandshakeInfo {
+	var info HandshakeInfo
+	info.Request, _ = c.handshake.Load().(*HandshakeRequestPayload)
+	info.Response, _ = c.hsResponse.Load().(*HandshakeResponsePayload)
+	info.Complete, _ = c.hsComplete.Load().(*HandshakeCompletePayload)
+	return info
+}
+
+// processHandshakeComplete records the payload of the HandshakeComplete message.  The payload is informational,
+// so it is not an error if it can't be decoded.
+func (c *SsmDataChannel) processHandshakeComplete(msg *AgentMessage) {
+	payload := new(HandshakeCompletePayload)
+	if err := json.Unmarshal(msg.Payload, payload); err == nil {
+		c.hsComplete.Store(payload)
+	}
+
+	if c.hooks.OnHandshake != nil {
+		c.hooks.OnHandshake(payload)
+	}
+}
+
+// SetHandshakeTimeout configures the longest time WaitForHandshakeComplete waits for the agent to complete the
+// session handshake.  A timeout less than 1 restores the DefaultHandshakeTimeout.
+func (c *SsmDataChannel) SetHandshakeTimeout(timeout time.Duration) {
+	c.hsTimeout = timeout
+}
+
+func (c *SsmDataChannel) handshakeTimeout() time.Duration {
+	if c.hsTimeout < 1 {
+		return DefaultHandshakeTimeout
+	}
+	return c.hsTimeout
+}
+
+// WaitForHandshakeCompleteContext is WaitForHandshakeComplete with a context, which limits the wait along with
+// the handshake timeout.  If the context is done or the timeout expires before the handshake completes, the data
+// channel is terminated, since the agent is not responding, and an error wrapping the context error is returned.
+func (c *SsmDataChannel) WaitForHandshakeCompleteContext(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, c.handshakeTimeout())
+	defer cancel()
+
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+
+	go func() {
+		select {
+		case <-doneCh:
+		case <-ctx.Done():
+			// unblock the read of the next message
+			c.finish(nil, withCause(ErrHandshakeFailed, "handshake not completed", ctx.Err()))
+			if c.ws != nil {
+				_ = c.ws.Close()
+			}
+		}
+	}()
+
+	buf := make([]byte, 4096)
+
+	for {
+		select {
+		case <-c.handshakeCh:
+			c.handshakeCh = nil
+			return nil
+		default:
+			msg, err := c.readWhole(buf)
+			if err != nil {
+				if ctx.Err() != nil {
+					return withCause(ErrHandshakeFailed, "handshake not completed", ctx.Err())
+				}
+				return err
+			}
+
+			if _, err = c.HandleMsg(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package datachannel
+
+// Hooks are optional callbacks fired for protocol events of the data channel, for building metrics, auditing, or
+// handling messages this package doesn't know about.  The callbacks are called from the goroutine processing the
+// messages (the caller of HandleMsg), so they should return quickly, and must not modify the messages.
+// OnMessage is called for every message received, before it is processed.
+// OnAck is called when the agent acknowledges a message sent on the data channel.
+// OnHandshake is called when the agent reports the session handshake is complete.
+// OnChannelClosed is called when the agent closes the channel, before the data channel is done.
+// OnUnknown is called for messages with a message type or payload type the data channel doesn't handle, and the
+// error it returns is returned from HandleMsg (nil ignores the message).  If not set, HandleMsg returns an error
+// matching ErrUnknownMessageType.
+type Hooks struct {
+	OnMessage       func(msg *AgentMessage)
+	OnAck           func(ack *AcknowledgeContent)
+	OnHandshake     func(payload *HandshakeCompletePayload)
+	OnChannelClosed func(payload *ChannelClosedPayload)
+	OnUnknown       func(msg *AgentMessage) error
+}
+
+// SetHooks configures the callbacks fired for protocol events.  Must be called before the data channel is opened.
+func (c *SsmDataChannel) SetHooks(h Hooks) {
+	c.hooks = h
+}
+
+// unknownMessage passes a message the data channel doesn't handle to the OnUnknown hook, or returns err if the hook
+// is not set.
+func (c *SsmDataChannel) unknownMessage(msg *AgentMessage, err error) error {
+	if c.hooks.OnUnknown != nil {
+		return c.hooks.OnUnknown(msg)
+	}
+	return err
+}
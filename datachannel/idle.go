@@ -0,0 +1,76 @@
+package datachannel
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// idleDrainTimeout limits the time spent waiting for acknowledgements when an idle session is shut down.
+const idleDrainTimeout = 5 * time.Second
+
+// DefaultIdleTimeout is the idle timeout of data channels where SetIdleTimeout was not called.  It is zero by default,
+// so idle sessions are not terminated.  Programs using the ssmclient session helpers, which create the data channel
+// internally, can set it to limit all sessions (like port forwarding sessions which were left running).
+var DefaultIdleTimeout time.Duration
+
+// SetIdleTimeout terminates the session after no session data has been sent or received for the timeout.  Only the
+// payload of session data counts as activity, so keepalive pings and acknowledgements don't keep the session open.
+// If onIdle is not nil, it is called before the session is shut down (see Shutdown), and an EventIdleTimeout is
+// emitted.  A zero timeout uses the DefaultIdleTimeout, and a negative timeout disables it.  Must be called before
+// the data channel is opened.
+func (c *SsmDataChannel) SetIdleTimeout(timeout time.Duration, onIdle func()) {
+	c.idleTimeout = timeout
+	c.onIdle = onIdle
+}
+
+// lastActive returns the time session data was last sent or received, or when the data channel was opened.
+func (c *SsmDataChannel) lastActive() time.Time {
+	if t := atomic.LoadInt64(&c.stats.lastData); t > 0 {
+		return time.Unix(0, t)
+	}
+	return c.openedAt
+}
+
+// startIdleTimer starts the goroutine which shuts down the session once it is idle, if an idle timeout is configured.
+func (c *SsmDataChannel) startIdleTimer() {
+	timeout := c.idleTimeout
+	if timeout == 0 {
+		timeout = DefaultIdleTimeout
+	}
+
+	if timeout > 0 {
+		go c.watchIdle(timeout)
+	}
+}
+
+// watchIdle waits until the session has been idle for the timeout, or is closed.
+func (c *SsmDataChannel) watchIdle(timeout time.Duration) {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.Done():
+			return
+		case <-t.C:
+		}
+
+		if idle := time.Since(c.lastActive()); idle < timeout {
+			t.Reset(timeout - idle)
+			continue
+		}
+
+		if c.onIdle != nil {
+			c.onIdle()
+		}
+		c.emit(Event{Type: EventIdleTimeout})
+
+		ctx, cancel := context.WithTimeout(context.Background(), idleDrainTimeout)
+		if err := c.Shutdown(ctx); err != nil {
+			c.logf(LevelWarn, "error shutting down idle session: %v", err)
+		}
+		cancel()
+		return
+	}
+}
@@ -0,0 +1,48 @@
+package datachannel
+
+import (
+	"time"
+)
+
+// DefaultKeepaliveInterval is the Interval of the DefaultKeepalive.
+const DefaultKeepaliveInterval = time.Minute
+
+// DefaultKeepalive is the Keepalive used for the websocket connection, unless changed using SetKeepalive.  It sends
+// pings, but doesn't wait for the replies.  Programs using the ssmclient session helpers, which create the data
+// channel internally, can change it to apply to all sessions.
+var DefaultKeepalive = &Keepalive{Interval: DefaultKeepaliveInterval}
+
+// Keepalive configures websocket pings, which keep quiet connections (like an idle port forwarding session) from
+// being dropped by proxies, load balancers and NAT gateways.
+// Interval is the time between pings, and a zero value disables the pings.
+// PongTimeout is how long to wait for the reply to a ping (on top of the Interval) before the connection is considered
+// dead, which fails the read, and resumes the session if possible.  A zero value doesn't check for replies.  Replies
+// are only seen while the data channel is being read, so a timeout should only be set if the application keeps
+// reading from the data channel.
+type Keepalive struct {
+	Interval    time.Duration
+	PongTimeout time.Duration
+}
+
+// pinger is implemented by transports which support keepalive pings.  The pings stop when the transport is closed.
+type pinger interface {
+	keepalive(interval, pongTimeout time.Duration)
+}
+
+// SetKeepalive configures the websocket keepalive pings.  A nil value restores the DefaultKeepalive.  Pings are not
+// supported by the browser WebSocket API, so the setting is ignored when built for js/wasm.
+func (c *SsmDataChannel) SetKeepalive(k *Keepalive) {
+	c.keepalive = k
+}
+
+// startKeepalive starts the configured keepalive pings on the transport, if it supports them.
+func (c *SsmDataChannel) startKeepalive(t Transport) {
+	k := c.keepalive
+	if k == nil {
+		k = DefaultKeepalive
+	}
+
+	if p, ok := t.(pinger); ok && k != nil && k.Interval > 0 {
+		p.keepalive(k.Interval, k.PongTimeout)
+	}
+}
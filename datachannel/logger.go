@@ -0,0 +1,102 @@
+package datachannel
+
+import (
+	"log"
+)
+
+// Level is the severity of a logged message.
+type Level int
+
+// Levels of logged messages, from the least to the most severe.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// Logger is the destination of the messages logged by the data channel.  *log.Logger satisfies the interface.  A
+// Logger which is not a LevelLogger receives every message, without the level.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// LevelLogger is a Logger which is given the level of each message, so it can filter messages, or pass the level on
+// to a structured logging library.
+type LevelLogger interface {
+	Logger
+	Logf(level Level, format string, v ...interface{})
+}
+
+// StdLogger is a Logger writing to the standard logger of the log package.
+var StdLogger Logger = stdLogger{}
+
+// DefaultLogger is the Logger used by data channels where SetLogger was not called.  It is nil by default, so
+// nothing is logged, which keeps the terminal of programs attached to a session clean.  Set it to a Logger (like
+// NewLevelLogger(StdLogger, LevelWarn)) to log the messages of all data channels.
+var DefaultLogger Logger
+
+// stdLogger is the Logger writing to the standard logger of the log package.
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+// levelLogger is the LevelLogger returned by NewLevelLogger.
+type levelLogger struct {
+	Logger
+	min Level
+}
+
+// NewLevelLogger returns a LevelLogger which writes the messages of at least the min level to the Logger, prefixed
+// with the level.
+func NewLevelLogger(l Logger, min Level) LevelLogger {
+	return &levelLogger{Logger: l, min: min}
+}
+
+func (l *levelLogger) Logf(level Level, format string, v ...interface{}) {
+	if level >= l.min {
+		l.Printf(level.String()+" "+format, v...)
+	}
+}
+
+// SetLogger configures the Logger used by the data channel.  A nil value restores the DefaultLogger.
+func (c *SsmDataChannel) SetLogger(l Logger) {
+	c.logger = l
+}
+
+// logf writes a message to the configured Logger.
+func (c *SsmDataChannel) logf(level Level, format string, v ...interface{}) {
+	l := c.logger
+	if l == nil {
+		l = DefaultLogger
+	}
+	Logf(l, level, format, v...)
+}
+
+// Logf writes a message to the Logger, with the level if it is a LevelLogger.  A nil Logger discards the message.
+func Logf(l Logger, level Level, format string, v ...interface{}) {
+	switch l := l.(type) {
+	case nil:
+	case LevelLogger:
+		l.Logf(level, format, v...)
+	default:
+		l.Printf(format, v...)
+	}
+}
@@ -0,0 +1,112 @@
+package datachannel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+const (
+	// activationTierSetting is the service setting holding the instance tier of on-premises managed instances.
+	activationTierSetting = "/ssm/managed-instance/activation-tier"
+	standardTier          = "standard"
+)
+
+// TargetUnavailableError is returned when StartSession fails for an instance which is not online, or for an
+// on-premises managed instance (mi-*) when the advanced-instances tier, which Session Manager requires for them, is
+// not enabled in the account and region.  PingStatus is the status reported for the instance, if known.  The error
+// returned by StartSession is wrapped.
+type TargetUnavailableError struct {
+	Target               string
+	PingStatus           string
+	AdvancedTierRequired bool
+	Err                  error
+}
+
+func (e *TargetUnavailableError) Error() string {
+	if e.AdvancedTierRequired {
+		return fmt.Sprintf("sessions with managed instance %s require the advanced-instances tier: %v", e.Target, e.Err)
+	}
+
+	if len(e.PingStatus) < 1 {
+		return fmt.Sprintf("%s is not a managed instance: %v", e.Target, e.Err)
+	}
+	return fmt.Sprintf("%s is not online (ping status %s): %v", e.Target, e.PingStatus, e.Err)
+}
+
+func (e *TargetUnavailableError) Unwrap() error {
+	return e.Err
+}
+
+// isInstanceTarget reports if the target is an EC2 instance or on-premises managed instance ID.
+func isInstanceTarget(target string) bool {
+	return strings.HasPrefix(target, "i-") || strings.HasPrefix(target, "mi-")
+}
+
+// explainStartError checks why StartSession failed for an instance target, and returns a *TargetUnavailableError if
+// the instance is not online, or needs the advanced-instances tier.  Otherwise (including when the checks fail), the
+// original error is returned.
+func explainStartError(ctx context.Context, client *ssm.Client, target string, err error) error {
+	if !isInstanceTarget(target) || ctx.Err() != nil {
+		return err
+	}
+
+	if strings.HasPrefix(target, "mi-") && tierRestricted(err) {
+		out, e := client.GetServiceSetting(ctx, &ssm.GetServiceSettingInput{
+			SettingId: aws.String(activationTierSetting),
+		})
+		if e == nil && out.ServiceSetting != nil && aws.ToString(out.ServiceSetting.SettingValue) == standardTier {
+			return &TargetUnavailableError{Target: target, AdvancedTierRequired: true, Err: err}
+		}
+	}
+
+	status, found, e := pingStatus(ctx, client, target)
+	switch {
+	case e != nil:
+		return err
+	case !found:
+		return &TargetUnavailableError{Target: target, Err: err}
+	case status != types.PingStatusOnline:
+		return &TargetUnavailableError{Target: target, PingStatus: string(status), Err: err}
+	}
+	return err
+}
+
+// tierRestricted reports whether the StartSession error could be caused by the instance tier restriction for
+// on-premises managed instances, which the API reports as an InvalidParameters or TargetNotConnected error, or with a
+// message mentioning the advanced tier.
+func tierRestricted(err error) bool {
+	var ae interface {
+		ErrorCode() string
+		ErrorMessage() string
+	}
+	if !errors.As(err, &ae) {
+		return false
+	}
+
+	switch ae.ErrorCode() {
+	case "InvalidParameters", "TargetNotConnected":
+		return true
+	}
+	return strings.Contains(strings.ToLower(ae.ErrorMessage()), "advanced")
+}
+
+// pingStatus returns the ping status of the managed instance, and false if the instance is not registered with SSM.
+func pingStatus(ctx context.Context, client *ssm.Client, target string) (types.PingStatus, bool, error) {
+	out, err := client.DescribeInstanceInformation(ctx, &ssm.DescribeInstanceInformationInput{
+		Filters: []types.InstanceInformationStringFilter{{Key: aws.String("InstanceIds"), Values: []string{target}}},
+	})
+	if err != nil {
+		return "", false, fmt.Errorf("error calling DescribeInstanceInformation: %w", err)
+	}
+
+	if len(out.InstanceInformationList) < 1 {
+		return "", false, nil
+	}
+	return out.InstanceInformationList[0].PingStatus, true, nil
+}
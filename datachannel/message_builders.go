@@ -0,0 +1,68 @@
+package datachannel
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+)
+
+// NewInputStreamMessage returns an input stream data message with the payload type and payload, ready to send with
+// WriteMsg.  The sequence number is assigned by WriteMsg.  Output payloads are sent as is, so they must already be
+// encrypted if the session uses KMS encryption (Write takes care of this).
+func NewInputStreamMessage(payloadType PayloadType, payload []byte) *AgentMessage {
+	msg := NewAgentMessage()
+	msg.MessageType = InputStreamData
+	msg.SequenceNumber = -1
+	msg.Flags = Data
+	msg.PayloadType = payloadType
+	msg.Payload = payload
+	return msg
+}
+
+// NewFlagMessage returns an input stream data message sending the flag to the agent, ready to send with WriteMsg.  The
+// TerminateSession flag is marked as the end of the stream (the Fin message flag).  The sequence number is assigned
+// by WriteMsg.
+func NewFlagMessage(flag PayloadTypeFlag) *AgentMessage {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, uint32(flag))
+
+	msg := NewInputStreamMessage(Flag, buf)
+	if flag == TerminateSession {
+		msg.Flags = Fin
+	}
+	return msg
+}
+
+// NewAckFor returns the Acknowledge message for a message received from the agent, ready to send with WriteMsg.
+func NewAckFor(msg *AgentMessage) (*AgentMessage, error) {
+	ack := AcknowledgeContent{
+		AcknowledgedMessageType:           msg.MessageType,
+		AcknowledgedMessageId:             msg.messageID.String(),
+		AcknowledgedMessageSequenceNumber: msg.SequenceNumber,
+		IsSequentialMessage:               true,
+	}
+
+	payload, err := json.Marshal(ack)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding acknowledge payload: %w", err)
+	}
+
+	out := NewAgentMessage()
+	out.MessageType = Acknowledge
+	out.SequenceNumber = msg.SequenceNumber
+	out.Flags = Ack
+	out.PayloadType = Undefined
+	out.Payload = payload
+	return out, nil
+}
+
+// NewFlowControlMessage returns a PausePublication or StartPublication message, ready to send with WriteMsg.  Flow
+// control messages are not part of the input stream, so they don't use a sequence number.
+func NewFlowControlMessage(msgType MessageType) *AgentMessage {
+	msg := NewAgentMessage()
+	msg.MessageType = msgType
+	msg.SequenceNumber = 0
+	msg.Flags = Data
+	msg.PayloadType = Undefined
+	return msg
+}
@@ -0,0 +1,68 @@
+package datachannel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Message is a message received from the agent, delivered by Messages after it has been processed like HandleMsg
+// does.  AgentMessage is nil if the message could not be read or decoded.  Output is the session output returned for
+// the message (see HandleMsg), and Err is the error, if any.
+type Message struct {
+	*AgentMessage
+	Output []byte
+	Err    error
+}
+
+// Messages starts reading from the data channel in a goroutine, and returns a channel delivering each message
+// received, so callers can select on session data along with timers and cancellation.  Errors processing a message
+// (like ErrConnectToPort) are delivered with the message, and reading continues.  If reading or decoding a message
+// fails, or the agent closes the channel, the error is delivered (matching io.EOF if the session ended cleanly) and
+// the channel is closed.  The channel is also closed once the context is done, and a message still being read is
+// then returned by the next read of the data channel.  The data channel must not be read by anything else while the
+// channel is open.
+func (c *SsmDataChannel) Messages(ctx context.Context) <-chan Message {
+	ch := make(chan Message)
+
+	go func() {
+		defer close(ch)
+		buf := make([]byte, 4096)
+
+		for {
+			m := c.nextMessage(ctx, buf)
+			if ctx.Err() != nil {
+				return
+			}
+
+			select {
+			case ch <- m:
+			case <-ctx.Done():
+				return
+			}
+
+			if m.Err != nil && (m.AgentMessage == nil || errors.Is(m.Err, io.EOF)) {
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// nextMessage reads, decodes and processes the next message.
+func (c *SsmDataChannel) nextMessage(ctx context.Context, buf []byte) Message {
+	msg, err := c.readWholeContext(ctx, buf)
+	if err != nil {
+		return Message{Err: err}
+	}
+
+	// the message is handed to the caller, so it must not share the read buffer
+	m := new(AgentMessage)
+	if err = m.UnmarshalBinary(append([]byte(nil), msg...)); err != nil {
+		return Message{Err: fmt.Errorf("error unmarshaling message: %w", err)}
+	}
+
+	out, err := c.handleMessage(m)
+	return Message{AgentMessage: m, Output: out, Err: err}
+}
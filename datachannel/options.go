@@ -0,0 +1,79 @@
+package datachannel
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Option configures a data channel created with NewDataChannel.  Each option has the same effect as the matching
+// Set method of SsmDataChannel.
+type Option func(c *SsmDataChannel)
+
+// NewDataChannel returns a data channel configured with the options.  A zero value SsmDataChannel (like
+// new(SsmDataChannel)) is also ready to use, with the default settings.
+func NewDataChannel(opts ...Option) *SsmDataChannel {
+	c := new(SsmDataChannel)
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// WithLogger configures the Logger used by the data channel, see SetLogger.
+func WithLogger(l Logger) Option {
+	return func(c *SsmDataChannel) {
+		c.SetLogger(l)
+	}
+}
+
+// WithDialer configures the Dialer used to connect the data channel, see SetDialer.
+func WithDialer(d Dialer) Option {
+	return func(c *SsmDataChannel) {
+		c.SetDialer(d)
+	}
+}
+
+// WithBufferSize configures the number of incoming messages held while waiting for missing messages, see
+// SetBufferSize.
+func WithBufferSize(size int) Option {
+	return func(c *SsmDataChannel) {
+		c.SetBufferSize(size)
+	}
+}
+
+// WithHandshakeTimeout configures the longest time to wait for the session handshake, see SetHandshakeTimeout.
+func WithHandshakeTimeout(timeout time.Duration) Option {
+	return func(c *SsmDataChannel) {
+		c.SetHandshakeTimeout(timeout)
+	}
+}
+
+// WithRetransmission configures the retransmission of messages which are not acknowledged, see
+// SetRetransmitTimeout.
+func WithRetransmission(rto time.Duration, maxTransmissions int) Option {
+	return func(c *SsmDataChannel) {
+		c.SetRetransmitTimeout(rto, maxTransmissions)
+	}
+}
+
+// WithHooks configures the callbacks fired for protocol events, see SetHooks.
+func WithHooks(h Hooks) Option {
+	return func(c *SsmDataChannel) {
+		c.SetHooks(h)
+	}
+}
+
+// WithIDGenerator configures the function providing message IDs, see SetIDGenerator.
+func WithIDGenerator(fn func() uuid.UUID) Option {
+	return func(c *SsmDataChannel) {
+		c.SetIDGenerator(fn)
+	}
+}
+
+// WithClock configures the function providing message timestamps, see SetClock.
+func WithClock(fn func() time.Time) Option {
+	return func(c *SsmDataChannel) {
+		c.SetClock(fn)
+	}
+}
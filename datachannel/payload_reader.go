@@ -0,0 +1,48 @@
+package datachannel
+
+import (
+	"errors"
+	"io"
+)
+
+// PayloadReader is an io.Reader returning the session output of a data channel, so it can be used with io.Copy,
+// bufio, and other readers.  Each message is read and processed like HandleMsg does (so acknowledgements and control
+// messages are handled), and the output is buffered, so reads of any size return the output in order without the
+// message framing.  Unlike Conn, no goroutine is started, and messages are only read while Read is called.  The data
+// channel must not be read by anything else.
+type PayloadReader struct {
+	c       *SsmDataChannel
+	buf     []byte
+	pending []byte
+}
+
+// NewPayloadReader returns a PayloadReader reading the session output of the data channel.
+func NewPayloadReader(c *SsmDataChannel) *PayloadReader {
+	return &PayloadReader{c: c, buf: make([]byte, 4096)}
+}
+
+// Read reads session output into p.  Returns io.EOF once the session has ended and all output has been read.  Errors
+// processing a message (like ErrConnectToPort) are returned, and reading can continue.
+func (r *PayloadReader) Read(p []byte) (int, error) {
+	if len(p) < 1 {
+		return 0, nil
+	}
+
+	for len(r.pending) < 1 {
+		msg, err := r.c.readWhole(r.buf)
+		if err == nil {
+			r.pending, err = r.c.HandleMsg(msg)
+		}
+
+		if errors.Is(err, io.EOF) {
+			// io.Copy and friends expect io.EOF itself, not an error matching it
+			return 0, io.EOF
+		} else if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
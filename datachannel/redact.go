@@ -0,0 +1,141 @@
+package datachannel
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const redactedText = "[REDACTED]"
+
+// InputMask selects the sessions where the payload of input_stream_data messages (the input sent to the agent) is
+// masked entirely, instead of being redacted with the Patterns of a Redactor.  Shells send typed input one keystroke
+// per message, so patterns can't match a secret typed in to them.
+type InputMask int
+
+const (
+	// MaskTerminalInput masks the input of sessions with a terminal (Standard_Stream and InteractiveCommands), and
+	// of sessions whose type is not known.  This is the default.
+	MaskTerminalInput InputMask = iota
+	// MaskAllInput masks the input of all sessions.
+	MaskAllInput
+	// MaskNoInput redacts input with the Patterns, like any other payload.
+	MaskNoInput
+)
+
+// DefaultRedactor is the Redactor used by a data channel when one has not been configured with SetRedactor.  It
+// masks AWS access key IDs and common "password=value" style secrets, and truncates payloads to 512 bytes.
+var DefaultRedactor = &Redactor{
+	Patterns: []*regexp.Regexp{
+		regexp.MustCompile(`\b(AKIA|ASIA|AIDA|AROA)[A-Z0-9]{16}\b`),
+		regexp.MustCompile(`(?i)(password|passwd|secret|token|api[_-]?key)(\s*[=:]\s*)\S+`),
+	},
+	MaxBytes: 512,
+}
+
+// Redactor scrubs sensitive content from message payloads before they are written to logs or error messages, so
+// that debug output can be shared without leaking credentials typed in to a session.
+// Patterns is a list of regular expressions whose matches are replaced with Replacement.  If a pattern contains
+// capture groups, only the text after the first 2 groups is replaced, allowing "key=value" patterns to keep the key.
+// MaxBytes is the maximum number of payload bytes to include, anything beyond that is truncated.  A value less
+// than 1 means no truncation.
+// Replacement is the text used in place of redacted content, if not set "[REDACTED]" is used.
+// InputMask selects the sessions where input sent to the agent is replaced with Replacement and its length, instead
+// of being redacted with the Patterns.  The zero value masks the input of shell and interactive command sessions.
+type Redactor struct {
+	Patterns    []*regexp.Regexp
+	MaxBytes    int
+	Replacement string
+	InputMask   InputMask
+}
+
+// Redact returns the printable form of the payload with all sensitive content removed.
+func (r *Redactor) Redact(payload []byte) string {
+	if r == nil {
+		return string(payload)
+	}
+
+	var truncated int
+	if r.MaxBytes > 0 && len(payload) > r.MaxBytes {
+		truncated = len(payload) - r.MaxBytes
+		payload = payload[:r.MaxBytes]
+	}
+
+	repl := r.replacement()
+	out := append([]byte(nil), payload...)
+	for _, re := range r.Patterns {
+		if re.NumSubexp() >= 2 {
+			out = re.ReplaceAll(out, []byte("${1}${2}"+strings.ReplaceAll(repl, "$", "$$")))
+			continue
+		}
+		out = re.ReplaceAllLiteral(out, []byte(repl))
+	}
+
+	if truncated > 0 {
+		return fmt.Sprintf("%s... (%d bytes truncated)", out, truncated)
+	}
+	return string(out)
+}
+
+func (r *Redactor) replacement() string {
+	if len(r.Replacement) < 1 {
+		return redactedText
+	}
+	return r.Replacement
+}
+
+// masksInput reports if input sent in a session of the type is masked entirely.
+func (r *Redactor) masksInput(sessionType string) bool {
+	switch r.InputMask {
+	case MaskAllInput:
+		return true
+	case MaskNoInput:
+		return false
+	}
+
+	switch sessionType {
+	case "", SessionTypeShell, SessionTypeInteractiveCommands:
+		return true
+	}
+	return false
+}
+
+// SetRedactor configures the Redactor used when payload content is included in debug logs or error messages.
+// A nil value restores the DefaultRedactor.
+func (c *SsmDataChannel) SetRedactor(r *Redactor) {
+	c.redactor = r
+}
+
+// SetDebug enables logging of the (redacted) payload of every message sent and received on the data channel.  The
+// messages are logged at LevelDebug, so a Logger must be configured (see SetLogger) to see them.
+func (c *SsmDataChannel) SetDebug(enabled bool) {
+	c.debug = enabled
+}
+
+// logMsg writes the message, and its redacted payload, to the log if debug logging is enabled.
+func (c *SsmDataChannel) logMsg(direction string, msg *AgentMessage) {
+	if c.debug {
+		c.logf(LevelDebug, "%s %s PAYLOAD: %s", direction, strings.TrimSpace(msg.String()), c.redactMsg(msg))
+	}
+}
+
+// redactMsg returns the redacted payload of the message, masking input sent to the agent entirely if the Redactor
+// masks the input of the session.
+func (c *SsmDataChannel) redactMsg(msg *AgentMessage) string {
+	r := c.redactor
+	if r == nil {
+		r = DefaultRedactor
+	}
+
+	if r != nil && msg.MessageType == InputStreamData && msg.PayloadType == Output && r.masksInput(c.SessionType()) {
+		return fmt.Sprintf("%s (%d bytes)", r.replacement(), len(msg.Payload))
+	}
+	return r.Redact(msg.Payload)
+}
+
+func (c *SsmDataChannel) redact(payload []byte) string {
+	if c.redactor == nil {
+		return DefaultRedactor.Redact(payload)
+	}
+	return c.redactor.Redact(payload)
+}
@@ -0,0 +1,93 @@
+package datachannel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// SetAutoReconnect enables or disables resuming the session when the websocket connection fails.  When enabled (the
+// default), the ResumeSession API is called for a new token, and the data channel is re-opened on a new connection
+// using the reconnect Backoff (see SetReconnectBackoff).  Sequence numbering continues where it left off, and
+// messages not yet acknowledged by the agent are sent again, so readers and writers of the data channel only see a
+// delay.  Sessions can only be resumed if the AWS configuration is known, which is the case for sessions started
+// with Open, or where SetEncryptionConfig was called.
+func (c *SsmDataChannel) SetAutoReconnect(enabled bool) {
+	c.noResume = !enabled
+}
+
+// canResume reports if a failure of the websocket connection should be handled by resuming the session.
+func (c *SsmDataChannel) canResume() bool {
+	if c.noResume || len(c.sessionID) < 1 || c.awsCfg.Credentials == nil {
+		return false
+	}
+
+	select {
+	case <-c.Done():
+		// closed, or failed for some other reason
+		return false
+	default:
+		return true
+	}
+}
+
+// isResuming reports if the session is being resumed, during which messages are queued instead of being sent.
+func (c *SsmDataChannel) isResuming() bool {
+	return atomic.LoadInt32(&c.resuming) == 1
+}
+
+// resume calls the ResumeSession API, and re-opens the data channel using the returned stream URL and token.  Failed
+// attempts (like while the network is still down) are retried according to the reconnect Backoff, with a new token
+// for each attempt.  Errors returned by the ResumeSession API, other than throttling, are not retried, since the
+// session can't be resumed.
+func (c *SsmDataChannel) resume() error {
+	atomic.StoreInt32(&c.resuming, 1)
+	defer atomic.StoreInt32(&c.resuming, 0)
+
+	prev := c.State()
+	c.setState(StateConnecting)
+
+	b := c.reconnectBackoff()
+
+	for attempt := 1; ; attempt++ {
+		err := c.resumeOnce()
+		if err == nil {
+			c.setState(prev)
+			return nil
+		}
+
+		d, ok := b.Next(attempt)
+		if !ok || !retryableResumeError(err) || !c.canResume() {
+			return err
+		}
+		c.logf(LevelWarn, "error resuming session, retrying in %s: %v", d.Round(time.Millisecond), err)
+		time.Sleep(d)
+	}
+}
+
+// resumeOnce calls the ResumeSession API, and re-opens the data channel once.
+func (c *SsmDataChannel) resumeOnce() error {
+	out, err := c.ssmClient(c.awsCfg).ResumeSession(context.Background(), &ssm.ResumeSessionInput{
+		SessionId: aws.String(c.sessionID),
+	})
+	if err != nil {
+		return fmt.Errorf("error calling ResumeSession: %w", err)
+	}
+
+	return c.reconnectOnce(aws.ToString(out.StreamUrl), aws.ToString(out.TokenValue))
+}
+
+// retryableResumeError reports if a failed attempt to resume the session should be retried.  Failures to reach the
+// service are retried, while errors returned by the API are only retried if they would be retried for StartSession.
+func retryableResumeError(err error) bool {
+	var ae interface{ ErrorCode() string }
+	if !errors.As(err, &ae) {
+		return true
+	}
+	return retryableStartError(err)
+}
@@ -0,0 +1,230 @@
+package datachannel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultRetransmitTimeout is the time to wait for the agent to acknowledge a message before sending it again,
+	// until the round trip time has been measured.  This is the initial TCP retransmission timeout from RFC 6298.
+	DefaultRetransmitTimeout = time.Second
+	// DefaultMaxTransmissions is the number of times a message is sent without being acknowledged before the data
+	// channel fails, unless changed using SetRetransmitTimeout.
+	DefaultMaxTransmissions = 300
+
+	// resendInterval is how often the unacknowledged messages are checked.
+	resendInterval = 100 * time.Millisecond
+)
+
+// ErrAckTimeout is the error which terminates the data channel when the agent does not acknowledge a message after
+// it has been sent the maximum number of times.
+var ErrAckTimeout = errors.New("message was not acknowledged by the agent")
+
+// sentMsg is a message waiting for an acknowledgement from the agent.  A zero sentAt means the message has not
+// been sent yet.
+type sentMsg struct {
+	seq       int64
+	data      []byte
+	sentAt    time.Time
+	transmits int
+}
+
+// AcknowledgeContent is the payload of an Acknowledge message.
+type AcknowledgeContent struct {
+	AcknowledgedMessageType           MessageType
+	AcknowledgedMessageId             string //nolint:revive,stylecheck // field name used on the wire
+	AcknowledgedMessageSequenceNumber int64
+	IsSequentialMessage               bool
+}
+
+// SetRetransmitTimeout configures a fixed time to wait for the agent to acknowledge a message before it is sent
+// again, and the number of times a message is sent before the data channel fails with ErrAckTimeout.  A timeout
+// less than 1 restores the adaptive timeout based on the measured round trip time, and a number of transmissions
+// less than 1 restores the DefaultMaxTransmissions.
+func (c *SsmDataChannel) SetRetransmitTimeout(rto time.Duration, maxTransmissions int) {
+	c.pendMu.Lock()
+	defer c.pendMu.Unlock()
+
+	c.rto = rto
+	c.maxSends = maxTransmissions
+}
+
+// track records a message which must be acknowledged by the agent, must be called in sequence number order.
+func (c *SsmDataChannel) track(msg *AgentMessage, data []byte, sent bool) {
+	m := &sentMsg{seq: msg.SequenceNumber, data: data}
+	if sent {
+		m.sentAt = time.Now()
+		m.transmits = 1
+	}
+
+	c.pendMu.Lock()
+	defer c.pendMu.Unlock()
+
+	if c.pending == nil {
+		c.pending = make(map[int64]*sentMsg)
+	}
+	c.pending[m.seq] = m
+	c.pendOrder = append(c.pendOrder, m.seq)
+}
+
+// acknowledged removes the message acknowledged by the agent from the messages waiting for acknowledgement.
+func (c *SsmDataChannel) acknowledged(msg *AgentMessage) error {
+	ack := new(AcknowledgeContent)
+	if err := json.Unmarshal(msg.Payload, ack); err != nil {
+		return fmt.Errorf("error decoding acknowledge payload: %w", err)
+	}
+
+	if c.hooks.OnAck != nil {
+		c.hooks.OnAck(ack)
+	}
+
+	c.pendMu.Lock()
+	defer c.pendMu.Unlock()
+
+	if m, ok := c.pending[ack.AcknowledgedMessageSequenceNumber]; ok && m.transmits == 1 {
+		c.updateRTT(time.Since(m.sentAt))
+	}
+
+	delete(c.pending, ack.AcknowledgedMessageSequenceNumber)
+	if c.ackCh != nil {
+		// wake up callers of Drain
+		close(c.ackCh)
+		c.ackCh = nil
+	}
+	return nil
+}
+
+// Pending returns the number of messages written to the data channel which have not been acknowledged by the agent.
+func (c *SsmDataChannel) Pending() int {
+	c.pendMu.Lock()
+	defer c.pendMu.Unlock()
+	return len(c.pending)
+}
+
+// Drain blocks until the agent has acknowledged every message written to the data channel, so the channel can be
+// closed without losing the tail of the data, like the end of a file transfer.  The context error is returned if
+// the context is done first.  If the session terminates first, the error which terminated the session is returned,
+// or io.ErrClosedPipe if it ended cleanly.
+func (c *SsmDataChannel) Drain(ctx context.Context) error {
+	for {
+		c.pendMu.Lock()
+		if len(c.pending) < 1 {
+			c.pendMu.Unlock()
+			return nil
+		}
+
+		if c.ackCh == nil {
+			c.ackCh = make(chan struct{})
+		}
+		ackCh := c.ackCh
+		c.pendMu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.Done():
+			if _, err := c.Wait(); err != nil {
+				return err
+			}
+			return io.ErrClosedPipe
+		case <-ackCh:
+		}
+	}
+}
+
+// processOutboundQueue sends messages which were not sent because publication was paused, and resends messages
+// which were not acknowledged within the retransmission timeout.  The data channel is terminated if a message is
+// not acknowledged after the maximum number of transmissions.
+func (c *SsmDataChannel) processOutboundQueue() {
+	t := time.NewTicker(resendInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.Done():
+			return
+		case <-t.C:
+		}
+
+		if c.paused() || c.isResuming() || c.ws == nil {
+			continue
+		}
+
+		if err := c.resend(); err != nil {
+			if !errors.Is(err, ErrAckTimeout) && c.canResume() {
+				// the reader resumes the session when it sees the connection failure
+				continue
+			}
+			c.finish(nil, err)
+			_ = c.ws.Close()
+			return
+		}
+	}
+}
+
+// resend sends the messages which are due, in sequence number order.
+func (c *SsmDataChannel) resend() error {
+	due, err := c.dueMessages()
+	if err != nil {
+		return err
+	}
+
+	for _, data := range due {
+		c.mu.Lock()
+		err = c.ws.WriteMessage(data)
+		c.mu.Unlock()
+
+		if err != nil {
+			return withCause(ErrConnectionLost, "error writing websocket message", err)
+		}
+	}
+	return nil
+}
+
+// dueMessages returns the messages which have not been sent, or were not acknowledged within the retransmission
+// timeout, and records them as sent.  The lock for the websocket is not held, so it is safe to call while the
+// data channel is being written to.
+func (c *SsmDataChannel) dueMessages() ([][]byte, error) {
+	c.pendMu.Lock()
+	defer c.pendMu.Unlock()
+
+	rto, maxSends := c.retransmitTimeout(), c.maxSends
+	if maxSends < 1 {
+		maxSends = DefaultMaxTransmissions
+	}
+
+	// drop acknowledged messages from the ordering
+	order := c.pendOrder[:0]
+	for _, seq := range c.pendOrder {
+		if _, ok := c.pending[seq]; ok {
+			order = append(order, seq)
+		}
+	}
+	c.pendOrder = order
+
+	var due [][]byte
+	for _, seq := range c.pendOrder {
+		m := c.pending[seq]
+		if !m.sentAt.IsZero() && time.Since(m.sentAt) < rto {
+			continue
+		}
+
+		if m.transmits >= maxSends {
+			return nil, fmt.Errorf("%w: sequence number %d sent %d times", ErrAckTimeout, seq, m.transmits)
+		}
+
+		if m.transmits > 0 {
+			atomic.AddInt64(&c.stats.resent, 1)
+		}
+		m.sentAt = time.Now()
+		m.transmits++
+		due = append(due, m.data)
+	}
+	return due, nil
+}
@@ -0,0 +1,71 @@
+package datachannel
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Limits of the adaptive retransmission timeout.
+const (
+	MinRetransmitTimeout = 200 * time.Millisecond
+	MaxRetransmitTimeout = 60 * time.Second
+
+	// rttGranularity is the clock granularity term of the RFC 6298 timeout calculation.
+	rttGranularity = 10 * time.Millisecond
+)
+
+// RetransmitTimeout returns the current time to wait for the agent to acknowledge a message before it is sent
+// again.  Unless a fixed timeout was configured using SetRetransmitTimeout, this adapts to the measured round trip
+// time.
+func (c *SsmDataChannel) RetransmitTimeout() time.Duration {
+	c.pendMu.Lock()
+	defer c.pendMu.Unlock()
+	return c.retransmitTimeout()
+}
+
+// retransmitTimeout calculates the retransmission timeout from the smoothed round trip time and its variation as
+// described in RFC 6298, must be called with pendMu held.
+func (c *SsmDataChannel) retransmitTimeout() time.Duration {
+	if c.rto > 0 {
+		return c.rto
+	}
+
+	if c.srtt == 0 {
+		// no measurements yet
+		return DefaultRetransmitTimeout
+	}
+
+	v := 4 * c.rttvar
+	if v < rttGranularity {
+		v = rttGranularity
+	}
+
+	rto := c.srtt + v
+	switch {
+	case rto < MinRetransmitTimeout:
+		return MinRetransmitTimeout
+	case rto > MaxRetransmitTimeout:
+		return MaxRetransmitTimeout
+	default:
+		return rto
+	}
+}
+
+// updateRTT adds a round trip time measurement to the smoothed round trip time and variation, must be called with
+// pendMu held.  Only messages which were sent once are measured, since the acknowledgement of a retransmitted message
+// can't be matched to a transmission (Karn's algorithm).
+func (c *SsmDataChannel) updateRTT(sample time.Duration) {
+	if c.srtt == 0 {
+		c.srtt = sample
+		c.rttvar = sample / 2
+	} else {
+		delta := c.srtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttvar = (3*c.rttvar + delta) / 4
+		c.srtt = (7*c.srtt + sample) / 8
+	}
+
+	atomic.StoreInt64(&c.stats.srtt, int64(c.srtt))
+}
@@ -0,0 +1,56 @@
+package datachannel
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// SequenceGapError describes output stream messages missing from the incoming message sequence.  Expected is the
+// sequence number of the next message to be processed, and Received is the sequence number of a message which
+// arrived ahead of it, so the messages from Expected up to Received are missing.
+type SequenceGapError struct {
+	Expected int64
+	Received int64
+}
+
+func (e *SequenceGapError) Error() string {
+	return fmt.Sprintf("missing %d messages: expected sequence number %d, received %d", e.Missing(), e.Expected,
+		e.Received)
+}
+
+// Missing returns the number of messages missing before the received message.
+func (e *SequenceGapError) Missing() int64 {
+	return e.Received - e.Expected
+}
+
+// GapHandler decides how a gap in the incoming message sequence is handled.  Returning nil tolerates the gap, the
+// message is held until the agent retransmits the missing messages.  Returning an error aborts processing, and
+// the error is returned from HandleMsg without acknowledging the message.
+type GapHandler func(gap *SequenceGapError) error
+
+// AbortOnGap is a GapHandler for consumers which can't tolerate missing stream data, it fails on any gap.  The
+// *SequenceGapError is returned from HandleMsg, and can be inspected using errors.As.
+func AbortOnGap(gap *SequenceGapError) error {
+	return gap
+}
+
+// SetGapHandler configures the GapHandler called when an output stream message arrives ahead of the expected
+// sequence number.  By default (or if h is nil) gaps are tolerated.
+func (c *SsmDataChannel) SetGapHandler(h GapHandler) {
+	c.gapHandler = h
+}
+
+// ExpectedSequenceNumber returns the sequence number of the next output stream message to be processed.  Messages
+// with lower sequence numbers have been received and processed in order.
+func (c *SsmDataChannel) ExpectedSequenceNumber() int64 {
+	return atomic.LoadInt64(&c.inSeqNum)
+}
+
+// checkGap calls the GapHandler if the output stream message is not the next in sequence.
+func (c *SsmDataChannel) checkGap(msg *AgentMessage) error {
+	expected := c.ExpectedSequenceNumber()
+	if c.gapHandler == nil || msg.SequenceNumber <= expected {
+		return nil
+	}
+	return c.gapHandler(&SequenceGapError{Expected: expected, Received: msg.SequenceNumber})
+}
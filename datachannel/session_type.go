@@ -0,0 +1,55 @@
+package datachannel
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Session types requested by the agent in the handshake, which identify the agent plugin handling the session.
+const (
+	SessionTypeShell                  = "Standard_Stream"
+	SessionTypeInteractiveCommands    = "InteractiveCommands"
+	SessionTypeNonInteractiveCommands = "NonInteractiveCommands"
+	SessionTypePort                   = "Port"
+)
+
+// SessionType returns the type of session negotiated in the handshake (one of the SessionType constants), so higher
+// layers can adjust their behavior, for example a shell or command session, or a basic or multiplexed port session.
+// The value is empty until the handshake request is received, or if the agent did not perform a handshake.
+func (c *SsmDataChannel) SessionType() string {
+	if req, ok := c.sessionType.Load().(*SessionTypeRequest); ok {
+		return req.SessionType
+	}
+	return ""
+}
+
+// SessionProperties returns the properties of the session type negotiated in the handshake, like the port number
+// and port forwarding type of a Port session.  The value is nil if the agent did not send any properties.
+func (c *SsmDataChannel) SessionProperties() map[string]interface{} {
+	if req, ok := c.sessionType.Load().(*SessionTypeRequest); ok {
+		if props, ok := req.Properties.(map[string]interface{}); ok {
+			return props
+		}
+	}
+	return nil
+}
+
+// processSessionType records the session type requested by the agent in the handshake, and returns the result of
+// the SessionType action.  Session types the client doesn't know how to handle are reported as unsupported.
+func (c *SsmDataChannel) processSessionType(params interface{}) ProcessedClientAction {
+	action := ProcessedClientAction{ActionType: SessionType, ActionStatus: Success}
+
+	req := new(SessionTypeRequest)
+	if data, err := json.Marshal(params); err == nil {
+		_ = json.Unmarshal(data, req)
+	}
+	c.sessionType.Store(req)
+
+	switch req.SessionType {
+	case SessionTypeShell, SessionTypeInteractiveCommands, SessionTypeNonInteractiveCommands, SessionTypePort:
+	default:
+		action.ActionStatus = Unsupported
+		action.Error = fmt.Sprintf("unsupported session type %q", req.SessionType)
+	}
+	return action
+}
@@ -0,0 +1,62 @@
+package datachannel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+// ErrShutdown is the error returned from Write after Shutdown is called.
+var ErrShutdown = errors.New("data channel is shutting down")
+
+// gracefulCloser is implemented by Transports which can tell the other end the connection is closing normally,
+// like the close frame of a websocket.
+type gracefulCloser interface {
+	CloseGracefully() error
+}
+
+// Shutdown gracefully ends the session.  New writes are rejected with ErrShutdown, and Shutdown waits (like Drain)
+// until the agent has acknowledged all messages already written, before sending the TerminateSession message and
+// closing the connection with a normal websocket close.  Acknowledgements are processed as messages are read, so
+// the data channel must still be read while Shutdown waits.  If the context is done before everything is
+// acknowledged, the session is still terminated and closed, and the context error is returned.
+func (c *SsmDataChannel) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&c.closing, 1)
+	c.setState(StateDraining)
+
+	err := c.Drain(ctx)
+	if errors.Is(err, io.ErrClosedPipe) {
+		// the session already ended cleanly
+		err = nil
+	}
+
+	select {
+	case <-c.Done():
+	default:
+		if e := c.TerminateSession(); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	c.finish(nil, nil)
+
+	if c.ws != nil {
+		var e error
+		if gc, ok := c.ws.(gracefulCloser); ok {
+			e = gc.CloseGracefully()
+		} else {
+			e = c.ws.Close()
+		}
+
+		if err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// isShutdown reports if Shutdown has been called.
+func (c *SsmDataChannel) isShutdown() bool {
+	return atomic.LoadInt32(&c.closing) == 1
+}
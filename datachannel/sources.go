@@ -0,0 +1,42 @@
+package datachannel
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SetIDGenerator configures the function providing the message ID of every message sent by the data channel (and
+// the request ID used to open it), replacing the random UUID set by NewAgentMessage.  Along with SetClock, this makes
+// the messages sent deterministic, for unit tests and golden file comparisons.  The function may be called
+// concurrently.  A nil value restores random UUIDs.
+func (c *SsmDataChannel) SetIDGenerator(fn func() uuid.UUID) {
+	c.newID = fn
+}
+
+// SetClock configures the function providing the created date of every message sent by the data channel, replacing
+// the current time set by NewAgentMessage.  Only the message timestamps use the clock, timers (like retransmission
+// and the idle timeout) use the real time.  The function may be called concurrently.  A nil value restores the
+// current time.
+func (c *SsmDataChannel) SetClock(fn func() time.Time) {
+	c.clock = fn
+}
+
+// stamp sets the message ID and created date of the message using the configured sources, if any.
+func (c *SsmDataChannel) stamp(msg *AgentMessage) {
+	if c.newID != nil {
+		msg.messageID = c.newID()
+	}
+
+	if c.clock != nil {
+		msg.createdDate = c.clock()
+	}
+}
+
+// requestID returns a new request ID, using the configured ID generator.
+func (c *SsmDataChannel) requestID() string {
+	if c.newID != nil {
+		return c.newID().String()
+	}
+	return uuid.New().String()
+}
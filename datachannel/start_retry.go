@@ -0,0 +1,149 @@
+package datachannel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+const (
+	// DefaultMaxWaitOnline is how long to wait for the target to come online, if StartRetry.MaxElapsed is not set.
+	DefaultMaxWaitOnline = 5 * time.Minute
+
+	// onlinePollInterval is the delay between checks of the target status while waiting for it to come online.
+	onlinePollInterval = 5 * time.Second
+)
+
+// DefaultStartRetry is the StartRetry used when starting sessions, unless changed using SetStartRetry.  It is nil by
+// default, so failed StartSession calls are not retried.  Programs using the ssmclient session helpers, which create
+// the data channel internally, can set it to retry all sessions.
+var DefaultStartRetry *StartRetry
+
+// StartRetry configures retrying the StartSession API when it fails because of throttling, or because the target is
+// not connected (like right after an instance boots, before the agent has connected to the service).
+// Backoff provides the delay between attempts, and the number of attempts.  If nil, DefaultBackoff is used.
+// MaxElapsed limits the total time spent retrying (and waiting for the target to come online).  If not provided,
+// retries are only limited by the Backoff, and the wait for the target is limited to DefaultMaxWaitOnline.
+// WaitOnline waits for the target to report as Online (using the DescribeInstanceInformation API) before starting the
+// session, which suits targets which are still booting.  Only applies to instance and managed instance targets.
+type StartRetry struct {
+	Backoff    Backoff
+	MaxElapsed time.Duration
+	WaitOnline bool
+}
+
+// SetStartRetry configures retrying the StartSession API call made by Open.  A nil value restores the
+// DefaultStartRetry.
+func (c *SsmDataChannel) SetStartRetry(r *StartRetry) {
+	c.startRetry = r
+}
+
+// callStartSession calls the StartSession API, retrying failed calls according to the configured StartRetry.
+func (c *SsmDataChannel) callStartSession(ctx context.Context, cfg aws.Config,
+	in *ssm.StartSessionInput) (*ssm.StartSessionOutput, error) {
+	client := c.ssmClient(cfg)
+
+	r := c.startRetry
+	if r == nil {
+		r = DefaultStartRetry
+	}
+
+	if r == nil {
+		return client.StartSession(ctx, in)
+	}
+
+	var deadline time.Time
+	if r.MaxElapsed > 0 {
+		deadline = time.Now().Add(r.MaxElapsed)
+	}
+
+	if r.WaitOnline {
+		if err := waitOnline(ctx, client, aws.ToString(in.Target), deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	b := r.Backoff
+	if b == nil {
+		b = DefaultBackoff
+	}
+
+	for attempt := 1; ; attempt++ {
+		out, err := client.StartSession(ctx, in)
+		if err == nil || !retryableStartError(err) {
+			return out, err
+		}
+
+		d, ok := b.Next(attempt)
+		if !ok || (!deadline.IsZero() && time.Now().Add(d).After(deadline)) {
+			return nil, err
+		}
+		if err = sleepContext(ctx, d); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// retryableStartError reports if a failed StartSession call should be retried.
+func retryableStartError(err error) bool {
+	if errors.As(err, new(*types.TargetNotConnected)) {
+		return true
+	}
+
+	var ae interface{ ErrorCode() string }
+	if errors.As(err, &ae) {
+		switch ae.ErrorCode() {
+		case "ThrottlingException", "Throttling", "TooManyRequestsException":
+			return true
+		}
+	}
+	return false
+}
+
+// waitOnline polls the instance information until the agent on the target reports as Online, or the deadline
+// passes.  Targets which are not instances are assumed to be online.
+func waitOnline(ctx context.Context, client *ssm.Client, target string, deadline time.Time) error {
+	if !isInstanceTarget(target) {
+		return nil
+	}
+
+	if deadline.IsZero() {
+		deadline = time.Now().Add(DefaultMaxWaitOnline)
+	}
+
+	for {
+		status, _, err := pingStatus(ctx, client, target)
+		if err != nil {
+			return err
+		}
+
+		if status == types.PingStatusOnline {
+			return nil
+		}
+
+		if time.Now().Add(onlinePollInterval).After(deadline) {
+			return fmt.Errorf("target %s is not online", target)
+		}
+		if err = sleepContext(ctx, onlinePollInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// sleepContext waits for the duration, or until the context is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,105 @@
+package datachannel
+
+import (
+	"sync"
+)
+
+// State is the connection state of a data channel.
+type State int32
+
+const (
+	// StateNew is the state of a data channel which has not been opened.
+	StateNew State = iota
+	// StateConnecting is the state while the session is started, and the websocket connection is established (or
+	// re-established, when the session is resumed).
+	StateConnecting
+	// StateHandshaking is the state while waiting for the agent to complete the session handshake.
+	StateHandshaking
+	// StateOpen is the state once the session is established.
+	StateOpen
+	// StateDraining is the state while Shutdown waits for outstanding messages to be acknowledged.
+	StateDraining
+	// StateClosed is the final state of a session which ended cleanly.
+	StateClosed
+	// StateFailed is the final state of a session which ended with an error.
+	StateFailed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateNew:
+		return "New"
+	case StateConnecting:
+		return "Connecting"
+	case StateHandshaking:
+		return "Handshaking"
+	case StateOpen:
+		return "Open"
+	case StateDraining:
+		return "Draining"
+	case StateClosed:
+		return "Closed"
+	case StateFailed:
+		return "Failed"
+	default:
+		return "Unknown"
+	}
+}
+
+// stateWatchers holds the current state and the callbacks registered with OnStateChange.
+type stateWatchers struct {
+	mu    sync.Mutex
+	state State
+	next  int
+	funcs map[int]func(from, to State)
+}
+
+// State returns the current connection state of the data channel.
+func (c *SsmDataChannel) State() State {
+	c.states.mu.Lock()
+	defer c.states.mu.Unlock()
+	return c.states.state
+}
+
+// OnStateChange registers a function which is called with the previous and new state after each state change, and
+// returns a function which removes it.  The function is called from the goroutine causing the change (like the
+// reader of the data channel), so it should return quickly.  Closed and Failed are final states, no changes follow.
+func (c *SsmDataChannel) OnStateChange(fn func(from, to State)) (remove func()) {
+	c.states.mu.Lock()
+	defer c.states.mu.Unlock()
+
+	if c.states.funcs == nil {
+		c.states.funcs = make(map[int]func(from, to State))
+	}
+
+	id := c.states.next
+	c.states.next++
+	c.states.funcs[id] = fn
+
+	return func() {
+		c.states.mu.Lock()
+		defer c.states.mu.Unlock()
+		delete(c.states.funcs, id)
+	}
+}
+
+// setState changes the state, and calls the registered functions if it changed.  Final states are never left.
+func (c *SsmDataChannel) setState(to State) {
+	c.states.mu.Lock()
+	from := c.states.state
+	if from == to || from == StateClosed || from == StateFailed {
+		c.states.mu.Unlock()
+		return
+	}
+	c.states.state = to
+
+	funcs := make([]func(from, to State), 0, len(c.states.funcs))
+	for _, fn := range c.states.funcs {
+		funcs = append(funcs, fn)
+	}
+	c.states.mu.Unlock()
+
+	for _, fn := range funcs {
+		fn(from, to)
+	}
+}
@@ -0,0 +1,67 @@
+package datachannel
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats contains counters describing the traffic on the data channel.  The byte counts only include the payload
+// of session data messages, not protocol overhead or control messages.  Retransmits is the number of messages
+// re-sent because they were not acknowledged, and Reconnects is the number of times the websocket connection was
+// re-established.  Duplicates is the number of messages retransmitted by the agent which had already been received,
+// and were discarded.  SmoothedRTT is the estimated round trip time between sending a message and receiving its
+// acknowledgement from the agent, which is zero until the first acknowledgement is received.
+type Stats struct {
+	BytesSent        int64
+	BytesReceived    int64
+	MessagesSent     int64
+	MessagesReceived int64
+	Retransmits      int64
+	Reconnects       int64
+	Duplicates       int64
+	SmoothedRTT      time.Duration
+}
+
+// counters holds the values reported by Stats.  Must be the first field(s) in the containing struct so the
+// values are 64-bit aligned for atomic operations on 32-bit platforms.
+type counters struct {
+	bytesSent int64
+	bytesRecv int64
+	msgsSent  int64
+	msgsRecv  int64
+	resent    int64
+	reconnect int64
+	dups      int64
+	srtt      int64
+	lastData  int64
+}
+
+// Stats returns a snapshot of the traffic counters for the data channel.
+func (c *SsmDataChannel) Stats() Stats {
+	return Stats{
+		BytesSent:        atomic.LoadInt64(&c.stats.bytesSent),
+		BytesReceived:    atomic.LoadInt64(&c.stats.bytesRecv),
+		MessagesSent:     atomic.LoadInt64(&c.stats.msgsSent),
+		MessagesReceived: atomic.LoadInt64(&c.stats.msgsRecv),
+		Retransmits:      atomic.LoadInt64(&c.stats.resent),
+		Reconnects:       atomic.LoadInt64(&c.stats.reconnect),
+		Duplicates:       atomic.LoadInt64(&c.stats.dups),
+		SmoothedRTT:      time.Duration(atomic.LoadInt64(&c.stats.srtt)),
+	}
+}
+
+func (s *counters) sent(msg *AgentMessage) {
+	atomic.AddInt64(&s.msgsSent, 1)
+	if msg.MessageType == InputStreamData && msg.PayloadType == Output {
+		atomic.AddInt64(&s.bytesSent, int64(len(msg.Payload)))
+		atomic.StoreInt64(&s.lastData, time.Now().UnixNano())
+	}
+}
+
+func (s *counters) received(msg *AgentMessage) {
+	atomic.AddInt64(&s.msgsRecv, 1)
+	if msg.MessageType == OutputStreamData && msg.PayloadType == Output {
+		atomic.AddInt64(&s.bytesRecv, int64(len(msg.Payload)))
+		atomic.StoreInt64(&s.lastData, time.Now().UnixNano())
+	}
+}
@@ -0,0 +1,66 @@
+package datachannel
+
+import (
+	"fmt"
+	"time"
+)
+
+// Summary describes a data channel session, and is useful context when troubleshooting a session or judging the
+// quality of the connection.  Start is the time the data channel was opened, and Duration is the length of the
+// session, or the time elapsed so far if the session is still active.  Reason describes how the session terminated,
+// and is empty if the session is still active.
+type Summary struct {
+	Stats
+	SessionID string
+	Start     time.Time
+	Duration  time.Duration
+	Reason    string
+}
+
+// String formats the summary as a single line.
+func (s Summary) String() string {
+	reason := s.Reason
+	if len(reason) < 1 {
+		reason = "active"
+	}
+
+	return fmt.Sprintf("session %s: duration %s, sent %d bytes (%d messages), received %d bytes (%d messages), "+
+		"%d retransmits, %d reconnects, %s", s.SessionID, s.Duration.Round(time.Millisecond), s.BytesSent,
+		s.MessagesSent, s.BytesReceived, s.MessagesReceived, s.Retransmits, s.Reconnects, reason)
+}
+
+// Summary returns a summary of the session, including the traffic counters reported by Stats.
+func (c *SsmDataChannel) Summary() Summary {
+	s := Summary{
+		Stats:     c.Stats(),
+		SessionID: c.sessionID,
+		Start:     c.openedAt,
+	}
+
+	end := time.Now()
+	select {
+	case <-c.Done():
+		end = c.closedAt
+		s.Reason = closeReason(c.closeReason, c.closeErr)
+	default:
+	}
+
+	if !s.Start.IsZero() {
+		s.Duration = end.Sub(s.Start)
+	}
+	return s
+}
+
+// closeReason describes why the session terminated.
+func closeReason(reason *ChannelClosedPayload, err error) string {
+	switch {
+	case err != nil:
+		return fmt.Sprintf("terminated by error: %v", err)
+	case reason != nil && len(reason.Output) > 0:
+		return fmt.Sprintf("closed by agent: %s", reason.Output)
+	case reason != nil:
+		return "closed by agent"
+	default:
+		return "closed by client"
+	}
+}
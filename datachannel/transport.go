@@ -0,0 +1,50 @@
+package datachannel
+
+import (
+	"fmt"
+)
+
+// Transport is the message oriented connection which carries the data channel messages to and from the AWS service,
+// normally a websocket.  Implementations must allow a single reader concurrently with a single writer.
+type Transport interface {
+	// ReadMessage returns the next message received, or io.EOF once the connection has been closed normally.
+	ReadMessage() ([]byte, error)
+	// WriteMessage sends data as a binary message.
+	WriteMessage(data []byte) error
+	// WriteText sends data as a text message.
+	WriteText(data []byte) error
+	Close() error
+}
+
+// Dialer connects a Transport to the stream URL returned by the StartSession API.
+type Dialer func(url string) (Transport, error)
+
+// SetDialer configures the Dialer used to connect the data channel.  A nil value restores the DefaultDialer, which
+// uses a gorilla websocket, or the browser WebSocket API when built for js/wasm.
+func (c *SsmDataChannel) SetDialer(d Dialer) {
+	c.dialer = d
+}
+
+func (c *SsmDataChannel) dial(url string) error {
+	d := c.dialer
+	if d == nil {
+		d = DefaultDialer
+	}
+
+	u, err := c.streamURL(url)
+	if err != nil {
+		return err
+	}
+
+	ws, err := d(u)
+	if err != nil {
+		return fmt.Errorf("error dialing websocket: %w", err)
+	}
+	c.startKeepalive(ws)
+
+	c.mu.Lock()
+	c.ws = ws
+	c.wsURL = url
+	c.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,173 @@
+//go:build js && wasm
+// +build js,wasm
+
+package datachannel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"syscall/js"
+)
+
+// DefaultDialer connects the data channel using the browser WebSocket API, so the data channel can be used from
+// web based terminals.  The StartSession API should be called by a backend which holds the AWS credentials, and the
+// session ID, stream URL and token passed to OpenWithSession.
+func DefaultDialer(url string) (Transport, error) {
+	t := &browserTransport{
+		ws:     js.Global().Get("WebSocket").New(url),
+		notify: make(chan struct{}, 1),
+		openCh: make(chan struct{}),
+	}
+	t.ws.Set("binaryType", "arraybuffer")
+
+	t.on("open", func(js.Value) {
+		close(t.openCh)
+	})
+	t.on("message", t.receive)
+	t.on("close", func(ev js.Value) {
+		code := ev.Get("code").Int()
+		if code == 1000 || code == 1001 || code == 1006 {
+			t.fail(io.EOF)
+			return
+		}
+		t.fail(fmt.Errorf("websocket closed with code %d: %s", code, ev.Get("reason").String()))
+	})
+
+	select {
+	case <-t.openCh:
+		return t, nil
+	case <-t.notify:
+		t.mu.Lock()
+		err := t.err
+		t.mu.Unlock()
+
+		_ = t.Close()
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("websocket connection failed")
+		}
+		return nil, err
+	}
+}
+
+// browserTransport adapts the callbacks of the browser WebSocket API to the blocking Transport interface.  Callbacks
+// must not block the JavaScript event loop, so received messages are queued without limit.
+type browserTransport struct {
+	ws     js.Value
+	mu     sync.Mutex
+	queue  [][]byte
+	err    error
+	notify chan struct{}
+	openCh chan struct{}
+	funcs  []js.Func
+	once   sync.Once
+}
+
+func (t *browserTransport) ReadMessage() ([]byte, error) {
+	for {
+		t.mu.Lock()
+		if len(t.queue) > 0 {
+			msg := t.queue[0]
+			t.queue = t.queue[1:]
+			t.mu.Unlock()
+			return msg, nil
+		}
+
+		if t.err != nil {
+			err := t.err
+			t.mu.Unlock()
+			return nil, err
+		}
+		t.mu.Unlock()
+
+		<-t.notify
+	}
+}
+
+func (t *browserTransport) WriteMessage(data []byte) error {
+	arr := js.Global().Get("Uint8Array").New(len(data))
+	js.CopyBytesToJS(arr, data)
+	return t.send(arr)
+}
+
+func (t *browserTransport) WriteText(data []byte) error {
+	return t.send(js.ValueOf(string(data)))
+}
+
+func (t *browserTransport) Close() error {
+	t.once.Do(func() {
+		t.ws.Call("close")
+		t.fail(io.EOF)
+		for _, f := range t.funcs {
+			f.Release()
+		}
+	})
+	return nil
+}
+
+// send writes the value to the websocket, converting a JavaScript exception to an error.
+func (t *browserTransport) send(v js.Value) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("error sending websocket message: %v", r)
+		}
+	}()
+
+	t.mu.Lock()
+	closed := t.err
+	t.mu.Unlock()
+
+	if closed != nil {
+		return errors.New("websocket is closed")
+	}
+
+	t.ws.Call("send", v)
+	return nil
+}
+
+// on registers the handler for the websocket event.
+func (t *browserTransport) on(event string, handler func(ev js.Value)) {
+	f := js.FuncOf(func(_ js.Value, args []js.Value) interface{} {
+		handler(args[0])
+		return nil
+	})
+	t.funcs = append(t.funcs, f)
+	t.ws.Call("addEventListener", event, f)
+}
+
+// receive queues the data of a message event, which is an ArrayBuffer for binary messages, or a string.
+func (t *browserTransport) receive(ev js.Value) {
+	data := ev.Get("data")
+
+	var msg []byte
+	if data.Type() == js.TypeString {
+		msg = []byte(data.String())
+	} else {
+		arr := js.Global().Get("Uint8Array").New(data)
+		msg = make([]byte, arr.Get("length").Int())
+		js.CopyBytesToGo(msg, arr)
+	}
+
+	t.mu.Lock()
+	t.queue = append(t.queue, msg)
+	t.mu.Unlock()
+	t.wake()
+}
+
+// fail records the error which ends the connection, only the first error is kept.
+func (t *browserTransport) fail(err error) {
+	t.mu.Lock()
+	if t.err == nil {
+		t.err = err
+	}
+	t.mu.Unlock()
+	t.wake()
+}
+
+func (t *browserTransport) wake() {
+	select {
+	case t.notify <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,94 @@
+//go:build !js
+// +build !js
+
+package datachannel
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// closeFrameTimeout limits the time spent sending the close frame when the connection is closed gracefully.
+const closeFrameTimeout = time.Second
+
+// pingWriteTimeout limits the time spent sending a keepalive ping.
+const pingWriteTimeout = 10 * time.Second
+
+// DefaultDialer connects the data channel using a gorilla websocket.
+func DefaultDialer(url string) (Transport, error) {
+	ws, _, err := websocket.DefaultDialer.Dial(url, http.Header{}) //nolint:bodyclose
+	if err != nil {
+		return nil, err
+	}
+	return &websocketTransport{Conn: ws, done: make(chan struct{})}, nil
+}
+
+type websocketTransport struct {
+	*websocket.Conn
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+func (t *websocketTransport) ReadMessage() ([]byte, error) {
+	_, msg, err := t.Conn.ReadMessage()
+	if err != nil && websocket.IsCloseError(err, 1000, 1001, 1006) {
+		// gorilla code states this is uber-fatal, and we just need to bail out
+		return msg, io.EOF
+	}
+	return msg, err
+}
+
+func (t *websocketTransport) WriteMessage(data []byte) error {
+	return t.Conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+func (t *websocketTransport) WriteText(data []byte) error {
+	return t.Conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func (t *websocketTransport) Close() error {
+	t.doneOnce.Do(func() { close(t.done) })
+	return t.Conn.Close()
+}
+
+// CloseGracefully sends a normal closure close frame before closing the connection.
+func (t *websocketTransport) CloseGracefully() error {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	err := t.Conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(closeFrameTimeout))
+	if e := t.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// keepalive sends a ping every interval until the connection is closed.  If pongTimeout is set, the read deadline is
+// extended each time a pong is received, so reads fail if the pongs stop.
+func (t *websocketTransport) keepalive(interval, pongTimeout time.Duration) {
+	if pongTimeout > 0 {
+		_ = t.Conn.SetReadDeadline(time.Now().Add(interval + pongTimeout))
+		t.Conn.SetPongHandler(func(string) error {
+			return t.Conn.SetReadDeadline(time.Now().Add(interval + pongTimeout))
+		})
+	}
+
+	go func() {
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+
+		for {
+			select {
+			case <-t.done:
+				return
+			case <-tick.C:
+				err := t.Conn.WriteControl(websocket.PingMessage, []byte("keepalive"), time.Now().Add(pingWriteTimeout))
+				if err != nil {
+					return
+				}
+			}
+		}
+	}()
+}
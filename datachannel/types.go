@@ -47,6 +47,8 @@ const (
 	EncChallengeRequest  PayloadType = iota
 	EncChallengeResponse PayloadType = iota
 	Flag                 PayloadType = iota
+	StdErr               PayloadType = iota
+	ExitCode             PayloadType = iota
 )
 
 // PayloadTypeFlag is the value set in the Payload of certain messages to indicate certain control operations.
@@ -93,6 +95,27 @@ type SessionTypeRequest struct {
 	Properties  interface{}
 }
 
+// KMSEncryptionRequest is the ActionParameters of a KMSEncryption action requested in the handshake.
+type KMSEncryptionRequest struct {
+	KMSKeyID string `json:"KMSKeyId"`
+}
+
+// KMSEncryptionResponse is the ActionResult of a processed KMSEncryption action, containing the session data key
+// encrypted with the KMS key.
+type KMSEncryptionResponse struct {
+	KMSCipherTextKey []byte
+}
+
+// EncryptionChallengeRequest is the payload sent by the agent to verify the client has the session encryption keys.
+type EncryptionChallengeRequest struct {
+	Challenge []byte
+}
+
+// EncryptionChallengeResponse is the client response to an EncryptionChallengeRequest.
+type EncryptionChallengeResponse struct {
+	Challenge []byte
+}
+
 // HandshakeResponsePayload is the local client response to the offered handshake request.  The ProcessedClientActions
 // field should have an entry for each RequestedClientActions in the handshake request.
 type HandshakeResponsePayload struct {
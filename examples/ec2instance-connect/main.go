@@ -76,11 +76,11 @@ func main() {
 		log.Fatal(err)
 	}
 
-	in := ssmclient.PortForwardingInput{
+	in := ssmclient.SSHInput{
 		Target:     tgt,
 		RemotePort: port,
 	}
 
-	// Alternatively, can be called as ssmclient.SSHPluginSession(cfg, tgt) to use the AWS-managed SSM session client code
+	// Alternatively, can be called as ssmclient.SSHPluginSession(cfg, &in) to use the AWS-managed SSM session client code
 	log.Fatal(ssmclient.SSHSession(cfg, &in))
 }
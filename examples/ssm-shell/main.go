@@ -40,7 +40,11 @@ func main() {
 		log.Fatal(err)
 	}
 
+	in := ssmclient.ShellInput{
+		Target: tgt,
+	}
+
 	// A 3rd argument can be passed to specify a command to run before turning the shell over to the user
-	// Alternatively, can be called as ssmclient.ShellPluginSession(cfg, tgt) to use the AWS-managed SSM session client code
-	log.Fatal(ssmclient.ShellSession(cfg, tgt))
+	// Alternatively, can be called as ssmclient.ShellPluginSession(cfg, &in) to use the AWS-managed SSM session client code
+	log.Fatal(ssmclient.ShellSession(cfg, &in))
 }
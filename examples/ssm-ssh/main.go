@@ -53,11 +53,14 @@ func main() {
 		log.Fatal(err)
 	}
 
-	in := ssmclient.PortForwardingInput{
+	in := ssmclient.SSHInput{
 		Target:     tgt,
 		RemotePort: port,
 	}
 
-	// Alternatively, can be called as ssmclient.SSHPluginSession(cfg, tgt) to use the AWS-managed SSM session client code
-	log.Fatal(ssmclient.SSHSession(cfg, &in))
+	// Alternatively, can be called as ssmclient.SSHPluginSession(cfg, &in) to use the AWS-managed SSM session client code
+	// Only exit with a non-zero status on failure, ssh reports the exit status of the ProxyCommand
+	if err = ssmclient.SSHSession(cfg, &in); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,120 @@
+// Package httpproxy provides an HTTP proxy which forwards CONNECT requests through AWS SSM sessions, for tools which
+// support HTTP proxies (using the HTTPS_PROXY environment variable, for example) but not SOCKS.  Each CONNECT
+// request starts a port forwarding session with the instance, using the AWS-StartPortForwardingSessionToRemoteHost
+// document, to the requested host and port.
+package httpproxy
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/dweidenfeld/ssm-session-client/datachannel"
+	"github.com/dweidenfeld/ssm-session-client/ssmclient"
+)
+
+// Handler is an http.Handler which forwards CONNECT requests through SSM sessions with a single instance.  Other
+// request methods are rejected, since plain HTTP requests are not proxied.  Clients are not authenticated, so the
+// server should listen on a loopback address.
+type Handler struct {
+	m      *ssmclient.SessionManager
+	target string
+	logger datachannel.Logger
+}
+
+// NewHandler creates a Handler which starts sessions with the target instance using the SessionManager.  The target
+// can be anything accepted by ssmclient.ResolveTarget.  Sessions are terminated when the forwarded connection ends,
+// and Shutdown of the SessionManager terminates any which are still running.
+func NewHandler(m *ssmclient.SessionManager, target string) *Handler {
+	return &Handler{m: m, target: target}
+}
+
+// SetLogger configures the Logger used for failed requests and connections.  A nil value restores the default,
+// which is ssmclient.Logger.
+func (h *Handler) SetLogger(l datachannel.Logger) {
+	h.logger = l
+}
+
+// logf writes a message to the configured Logger.
+func (h *Handler) logf(level datachannel.Level, format string, v ...interface{}) {
+	l := h.logger
+	if l == nil {
+		l = ssmclient.Logger
+	}
+	datachannel.Logf(l, level, format, v...)
+}
+
+// ServeHTTP forwards the connection of a CONNECT request to the requested host and port.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		w.Header().Set("Allow", http.MethodConnect)
+		http.Error(w, "only CONNECT requests are supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	host, portStr, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		http.Error(w, "invalid CONNECT address", http.StatusBadRequest)
+		return
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		http.Error(w, "invalid CONNECT port", http.StatusBadRequest)
+		return
+	}
+
+	in := &ssmclient.PortForwardingInput{Target: h.target, RemoteHost: host, RemotePort: port}
+	if err = in.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection can not be hijacked", http.StatusInternalServerError)
+		return
+	}
+
+	c, err := h.m.Open(in.StartSessionInput())
+	if err != nil {
+		h.logf(datachannel.LevelError, "error starting session for %s: %v", r.Host, err)
+		http.Error(w, "error starting session", http.StatusBadGateway)
+		return
+	}
+	defer h.m.Terminate(c)
+
+	if err = c.WaitForHandshakeComplete(); err != nil {
+		h.logf(datachannel.LevelError, "error starting session for %s: %v", r.Host, err)
+		http.Error(w, "error starting session", http.StatusBadGateway)
+		return
+	}
+
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		h.logf(datachannel.LevelError, "error hijacking connection for %s: %v", r.Host, err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err = rw.WriteString("HTTP/1.1 200 Connection established\r\n\r\n"); err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		h.logf(datachannel.LevelWarn, "error writing CONNECT response for %s: %v", r.Host, err)
+		return
+	}
+
+	// the client may have sent data along with the request, which was read into the buffer
+	if n := rw.Reader.Buffered(); n > 0 {
+		data, _ := rw.Reader.Peek(n)
+		if _, err = c.Write(data); err != nil {
+			h.logf(datachannel.LevelWarn, "error forwarding data for %s: %v", r.Host, err)
+			return
+		}
+	}
+
+	if err = c.Bridge(conn); err != nil {
+		h.logf(datachannel.LevelWarn, "connection to %s ended with error: %v", r.Host, err)
+	}
+}
@@ -0,0 +1,433 @@
+// Package socks provides a SOCKS5 server which forwards connections through AWS SSM sessions, so programs which
+// support a SOCKS proxy (like browsers, or tools using the ALL_PROXY environment variable) can reach hosts in the
+// network of an instance.  Each CONNECT request starts a port forwarding session with the instance, using the
+// AWS-StartPortForwardingSessionToRemoteHost document, to the requested host and port.
+//
+// REF: https://www.rfc-editor.org/rfc/rfc1928
+package socks
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dweidenfeld/ssm-session-client/datachannel"
+	"github.com/dweidenfeld/ssm-session-client/ssmclient"
+)
+
+const (
+	socksVersion = 5
+
+	// authentication methods
+	methodNoAuth       = 0x00
+	methodUserPass     = 0x02
+	methodNoAcceptable = 0xff
+
+	// username/password authentication (RFC 1929)
+	userPassVersion = 0x01
+	authSucceeded   = 0x00
+	authFailed      = 0x01
+
+	// commands
+	cmdConnect = 0x01
+
+	// address types
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+
+	// reply codes
+	repSucceeded        = 0x00
+	repGeneralFailure   = 0x01
+	repNotAllowed       = 0x02
+	repCmdNotSupported  = 0x07
+	repAddrNotSupported = 0x08
+)
+
+// requestTimeout is how long a client has to complete the SOCKS negotiation after connecting.
+const requestTimeout = 30 * time.Second
+
+// ErrServerClosed is returned by Serve after the server is closed.
+var ErrServerClosed = errors.New("socks server closed")
+
+// ErrNotAllowed is returned when the destination of a request is not in the allowed networks.
+var ErrNotAllowed = errors.New("destination not allowed")
+
+// Server is a SOCKS5 server which forwards connections through SSM sessions with a single instance.  Only the
+// CONNECT command is supported.  Clients are not authenticated unless SetCredentials is called, so the server should
+// listen on a loopback address otherwise.
+type Server struct {
+	m       *ssmclient.SessionManager
+	target  string
+	user    []byte
+	pass    []byte
+	allowed []*net.IPNet
+	mu      sync.Mutex
+	lsnrs   map[net.Listener]bool
+	closed  bool
+	logger  datachannel.Logger
+}
+
+// NewServer creates a Server which starts sessions with the target instance using the SessionManager.  The target
+// can be anything accepted by ssmclient.ResolveTarget.  Sessions are terminated when the forwarded connection ends,
+// and Shutdown of the SessionManager terminates any which are still running.
+func NewServer(m *ssmclient.SessionManager, target string) *Server {
+	return &Server{m: m, target: target, lsnrs: make(map[net.Listener]bool)}
+}
+
+// SetCredentials requires clients to authenticate with the username and password (RFC 1929).  An empty username
+// disables authentication.  Must be called before Serve.
+func (s *Server) SetCredentials(username, password string) {
+	if len(username) < 1 {
+		s.user, s.pass = nil, nil
+		return
+	}
+	s.user, s.pass = []byte(username), []byte(password)
+}
+
+// SetLogger configures the Logger used for failed requests and connections.  A nil value restores the default,
+// which is ssmclient.Logger.
+func (s *Server) SetLogger(l datachannel.Logger) {
+	s.logger = l
+}
+
+// logf writes a message to the configured Logger.
+func (s *Server) logf(level datachannel.Level, format string, v ...interface{}) {
+	l := s.logger
+	if l == nil {
+		l = ssmclient.Logger
+	}
+	datachannel.Logf(l, level, format, v...)
+}
+
+// SetAllowedNetworks restricts the destinations of forwarded connections to a list of CIDR blocks (or single IP
+// addresses).  Requests for a domain name are resolved locally, and only allowed if all of the resolved addresses are
+// in the allowed networks, so names which only resolve in the network of the instance are rejected.  An empty list
+// allows all destinations.  Must be called before Serve.
+func (s *Server) SetAllowedNetworks(cidrs []string) error {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+
+		if ip := net.ParseIP(c); ip != nil {
+			bits := 8 * net.IPv6len
+			if v4 := ip.To4(); v4 != nil {
+				ip = v4
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return fmt.Errorf("invalid allowed network %s", c)
+		}
+		nets = append(nets, n)
+	}
+
+	s.allowed = nets
+	return nil
+}
+
+// ListenAndServe listens on the TCP address, and calls Serve to handle connections.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("error creating listener: %w", err)
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts SOCKS client connections on the listener, handling each of them in a separate goroutine, until the
+// listener fails or the server is closed.  The listener is closed when Serve returns, and ErrServerClosed is
+// returned after Close.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = l.Close()
+		return ErrServerClosed
+	}
+	s.lsnrs[l] = true
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.lsnrs, l)
+		s.mu.Unlock()
+		_ = l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// Close stops the listeners, connections which are already forwarded are left running.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for l := range s.lsnrs {
+		_ = l.Close()
+	}
+	return nil
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// handle negotiates the SOCKS request, and forwards the connection through an SSM session with the requested host.
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(requestTimeout))
+	host, port, err := s.negotiate(conn)
+	if err != nil {
+		s.logf(datachannel.LevelWarn, "socks request from %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	if err = s.checkDestination(host); err != nil {
+		s.logf(datachannel.LevelWarn, "socks request from %s failed: %v", conn.RemoteAddr(), err)
+		_ = reply(conn, repNotAllowed)
+		return
+	}
+
+	dest := net.JoinHostPort(host, strconv.Itoa(port))
+	in := &ssmclient.PortForwardingInput{Target: s.target, RemoteHost: host, RemotePort: port}
+	if err = in.Validate(); err != nil {
+		s.logf(datachannel.LevelWarn, "socks request from %s failed: %v", conn.RemoteAddr(), err)
+		_ = reply(conn, repGeneralFailure)
+		return
+	}
+
+	c, err := s.m.Open(in.StartSessionInput())
+	if err != nil {
+		s.logf(datachannel.LevelError, "error starting session for %s: %v", dest, err)
+		_ = reply(conn, repGeneralFailure)
+		return
+	}
+	defer s.m.Terminate(c)
+
+	if err = c.WaitForHandshakeComplete(); err != nil {
+		s.logf(datachannel.LevelError, "error starting session for %s: %v", dest, err)
+		_ = reply(conn, repGeneralFailure)
+		return
+	}
+
+	if err = reply(conn, repSucceeded); err != nil {
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	if err = c.Bridge(conn); err != nil {
+		s.logf(datachannel.LevelWarn, "socks connection to %s ended with error: %v", dest, err)
+	}
+}
+
+// negotiate reads the method selection and the request from the client, authenticating the client if credentials
+// are configured, and returns the requested host and port.  Failures which can be reported to the client are replied
+// to before returning the error.
+func (s *Server) negotiate(conn net.Conn) (string, int, error) {
+	// method selection: VER NMETHODS METHODS...
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return "", 0, fmt.Errorf("error reading method selection: %w", err)
+	}
+
+	if hdr[0] != socksVersion {
+		return "", 0, fmt.Errorf("unsupported socks version %d", hdr[0])
+	}
+
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", 0, fmt.Errorf("error reading method selection: %w", err)
+	}
+
+	want := byte(methodNoAuth)
+	if s.user != nil {
+		want = methodUserPass
+	}
+
+	method := byte(methodNoAcceptable)
+	for _, m := range methods {
+		if m == want {
+			method = want
+		}
+	}
+
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return "", 0, fmt.Errorf("error writing method selection: %w", err)
+	}
+
+	if method == methodNoAcceptable {
+		return "", 0, errors.New("no acceptable authentication method")
+	}
+
+	if method == methodUserPass {
+		if err := s.authenticate(conn); err != nil {
+			return "", 0, err
+		}
+	}
+
+	// request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return "", 0, fmt.Errorf("error reading request: %w", err)
+	}
+
+	if req[1] != cmdConnect {
+		_ = reply(conn, repCmdNotSupported)
+		return "", 0, fmt.Errorf("unsupported command %d", req[1])
+	}
+
+	host, err := readAddress(conn, req[3])
+	if err != nil {
+		return "", 0, err
+	}
+
+	port := make([]byte, 2)
+	if _, err = io.ReadFull(conn, port); err != nil {
+		return "", 0, fmt.Errorf("error reading request: %w", err)
+	}
+	return host, int(binary.BigEndian.Uint16(port)), nil
+}
+
+// authenticate reads the username and password sent by the client, and replies with the result.
+func (s *Server) authenticate(conn net.Conn) error {
+	// VER ULEN UNAME PLEN PASSWD
+	ver := make([]byte, 1)
+	if _, err := io.ReadFull(conn, ver); err != nil {
+		return fmt.Errorf("error reading authentication request: %w", err)
+	}
+
+	if ver[0] != userPassVersion {
+		return fmt.Errorf("unsupported authentication version %d", ver[0])
+	}
+
+	user, err := readField(conn)
+	if err != nil {
+		return err
+	}
+
+	pass, err := readField(conn)
+	if err != nil {
+		return err
+	}
+
+	// compare both, so the time taken doesn't reveal which one is wrong
+	ok := subtle.ConstantTimeCompare(user, s.user) & subtle.ConstantTimeCompare(pass, s.pass)
+	if ok != 1 {
+		_, _ = conn.Write([]byte{userPassVersion, authFailed})
+		return fmt.Errorf("invalid credentials for user %q", user)
+	}
+
+	if _, err = conn.Write([]byte{userPassVersion, authSucceeded}); err != nil {
+		return fmt.Errorf("error writing authentication reply: %w", err)
+	}
+	return nil
+}
+
+// readField reads a field of the authentication request, prefixed with its length.
+func readField(conn net.Conn) ([]byte, error) {
+	l := make([]byte, 1)
+	if _, err := io.ReadFull(conn, l); err != nil {
+		return nil, fmt.Errorf("error reading authentication request: %w", err)
+	}
+
+	field := make([]byte, l[0])
+	if _, err := io.ReadFull(conn, field); err != nil {
+		return nil, fmt.Errorf("error reading authentication request: %w", err)
+	}
+	return field, nil
+}
+
+// checkDestination returns ErrNotAllowed if allowed networks are configured, and the host (or any of the addresses
+// it resolves to) is not in one of them.
+func (s *Server) checkDestination(host string) error {
+	if len(s.allowed) < 1 {
+		return nil
+	}
+
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		if ips, err = net.LookupIP(host); err != nil {
+			return fmt.Errorf("%w: error resolving %s: %v", ErrNotAllowed, host, err)
+		}
+	}
+
+	for _, ip := range ips {
+		if !s.isAllowed(ip) {
+			return fmt.Errorf("%w: %s", ErrNotAllowed, host)
+		}
+	}
+	return nil
+}
+
+func (s *Server) isAllowed(ip net.IP) bool {
+	for _, n := range s.allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// readAddress reads the destination address of the request.
+func readAddress(conn net.Conn, atyp byte) (string, error) {
+	var addr []byte
+
+	switch atyp {
+	case atypIPv4:
+		addr = make([]byte, net.IPv4len)
+	case atypIPv6:
+		addr = make([]byte, net.IPv6len)
+	case atypDomain:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return "", fmt.Errorf("error reading request: %w", err)
+		}
+		addr = make([]byte, l[0])
+	default:
+		_ = reply(conn, repAddrNotSupported)
+		return "", fmt.Errorf("unsupported address type %d", atyp)
+	}
+
+	if _, err := io.ReadFull(conn, addr); err != nil {
+		return "", fmt.Errorf("error reading request: %w", err)
+	}
+
+	if atyp == atypDomain {
+		return string(addr), nil
+	}
+	return net.IP(addr).String(), nil
+}
+
+// reply sends the reply to the request.  The bound address is not meaningful for forwarded connections, so it is
+// always reported as 0.0.0.0:0.
+func reply(conn net.Conn, rep byte) error {
+	_, err := conn.Write([]byte{socksVersion, rep, 0, atypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,58 @@
+package ssmclient
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/aws-sdk-go-v2/service/sts/types"
+)
+
+// defaultRoleSessionName is the role session name used if AssumeRoleInput.SessionName is not provided.
+const defaultRoleSessionName = "ssm-session-client"
+
+// AssumeRoleInput configures the role assumed for sessions with targets in another account.
+// RoleARN is the ARN of the role to assume in the target account.
+// ExternalID is the external ID required by the trust policy of the role, if any.
+// SessionName is the role session name, which appears in CloudTrail and the session history.  If not provided,
+// ssm-session-client is used.
+// Tags are session tags passed when assuming the role, for use in attribute based access control.
+// Duration is how long the role credentials are valid for.  If not provided, the STS default (1 hour) is used.
+// Credentials are refreshed automatically before they expire.
+type AssumeRoleInput struct {
+	RoleARN     string
+	ExternalID  string
+	SessionName string
+	Tags        map[string]string
+	Duration    time.Duration
+}
+
+// AssumeRole returns a copy of the aws.Config which uses the credentials of the role described by the AssumeRoleInput,
+// obtained by calling the STS AssumeRole API with the original credentials.  The returned configuration can be passed
+// to any of the session functions (or NewSessionManager) to start sessions with targets in the account of the role.
+// The role is assumed when the credentials are first needed, so errors are returned by the first API call.
+func AssumeRole(cfg aws.Config, opts *AssumeRoleInput) aws.Config {
+	p := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), opts.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = opts.SessionName
+		if len(o.RoleSessionName) < 1 {
+			o.RoleSessionName = defaultRoleSessionName
+		}
+
+		if len(opts.ExternalID) > 0 {
+			o.ExternalID = aws.String(opts.ExternalID)
+		}
+
+		if opts.Duration > 0 {
+			o.Duration = opts.Duration
+		}
+
+		for k, v := range opts.Tags {
+			o.Tags = append(o.Tags, types.Tag{Key: aws.String(k), Value: aws.String(v)})
+		}
+	})
+
+	out := cfg.Copy()
+	out.Credentials = aws.NewCredentialsCache(p)
+	return out
+}
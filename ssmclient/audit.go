@@ -0,0 +1,225 @@
+package ssmclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/dweidenfeld/ssm-session-client/datachannel"
+)
+
+// Audit event names used in the AuditRecord Event field.
+const (
+	AuditSessionStart = "session_start"
+	AuditSessionStop  = "session_stop"
+	AuditForward      = "forward"
+)
+
+// auditLog is the process-wide audit log used by the session helpers, configured with SetAuditLog.
+var auditLog *AuditLog
+
+// SetAuditLog configures the AuditLog used to record the activity of sessions started with the helpers in this
+// package.  A nil value (the default) disables audit logging.
+func SetAuditLog(a *AuditLog) {
+	auditLog = a
+}
+
+// AuditRecord is a single entry in the audit log.  Only the fields relevant to the Event are set.
+type AuditRecord struct {
+	Time          time.Time `json:"time"`
+	Event         string    `json:"event"`
+	SessionID     string    `json:"session_id,omitempty"`
+	Target        string    `json:"target,omitempty"`
+	DocumentName  string    `json:"document_name,omitempty"`
+	UserARN       string    `json:"user_arn,omitempty"`
+	Client        string    `json:"client,omitempty"`
+	Destination   string    `json:"destination,omitempty"`
+	BytesSent     int64     `json:"bytes_sent,omitempty"`
+	BytesReceived int64     `json:"bytes_received,omitempty"`
+	Duration      string    `json:"duration,omitempty"`
+}
+
+// AuditLog writes an append-only JSON lines record of session activity (session start and stop, the identity
+// used to start the session, bytes transferred, and forwarded connections).  The audit log is independent of
+// any debug logging, and is meant to provide client-side evidence of access.
+type AuditLog struct {
+	mu       sync.Mutex
+	w        io.Writer
+	closer   io.Closer
+	sessions map[datachannel.DataChannel]*AuditRecord
+	arns     map[string]string
+}
+
+// NewAuditLog opens (or creates) the file at path for appending audit records.
+func NewAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening audit log: %w", err)
+	}
+
+	a := NewAuditLogWriter(f)
+	a.closer = f
+	return a, nil
+}
+
+// NewAuditLogWriter creates an AuditLog which writes records to w.
+func NewAuditLogWriter(w io.Writer) *AuditLog {
+	return &AuditLog{
+		w:        w,
+		sessions: make(map[datachannel.DataChannel]*AuditRecord),
+		arns:     make(map[string]string),
+	}
+}
+
+// Write appends the record to the audit log.  If the record Time is not set, the current time is used.
+func (a *AuditLog) Write(rec *AuditRecord) error {
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("error encoding audit record: %w", err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, err = a.w.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("error writing audit record: %w", err)
+	}
+	return nil
+}
+
+// Close closes the audit log file, if it was opened with NewAuditLog.
+func (a *AuditLog) Close() error {
+	if a.closer != nil {
+		return a.closer.Close()
+	}
+	return nil
+}
+
+// start records the start of a session.  Safe to call on a nil AuditLog.
+func (a *AuditLog) start(cfg aws.Config, in *ssm.StartSessionInput, c *datachannel.SsmDataChannel) {
+	if a == nil {
+		return
+	}
+
+	rec := &AuditRecord{
+		Time:         time.Now(),
+		Event:        AuditSessionStart,
+		SessionID:    c.SessionID(),
+		Target:       aws.ToString(in.Target),
+		DocumentName: aws.ToString(in.DocumentName),
+		UserARN:      a.callerARN(cfg),
+	}
+
+	a.mu.Lock()
+	a.sessions[c] = rec
+	a.mu.Unlock()
+
+	a.write(rec)
+}
+
+// stop records the end of a session, only the first call for a session has any effect.  Safe to call on a nil
+// AuditLog.
+func (a *AuditLog) stop(c datachannel.DataChannel) {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	start, ok := a.sessions[c]
+	delete(a.sessions, c)
+	a.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	rec := *start
+	rec.Time = time.Now()
+	rec.Event = AuditSessionStop
+	rec.Duration = rec.Time.Sub(start.Time).String()
+
+	if sc, ok := c.(interface{ Stats() datachannel.Stats }); ok {
+		s := sc.Stats()
+		rec.BytesSent = s.BytesSent
+		rec.BytesReceived = s.BytesReceived
+	}
+
+	a.write(&rec)
+}
+
+// forward records a local connection forwarded over the session.  Safe to call on a nil AuditLog.
+func (a *AuditLog) forward(c datachannel.DataChannel, client net.Addr, destination string) {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	start, ok := a.sessions[c]
+	a.mu.Unlock()
+
+	rec := &AuditRecord{Event: AuditForward, Destination: destination}
+	if client != nil {
+		// unix socket clients may not have an address
+		rec.Client = client.String()
+	}
+	if ok {
+		rec.SessionID = start.SessionID
+		rec.Target = start.Target
+		rec.UserARN = start.UserARN
+	}
+
+	a.write(rec)
+}
+
+// write logs, but otherwise ignores, audit log failures so they don't interrupt the session.
+func (a *AuditLog) write(rec *AuditRecord) {
+	if err := a.Write(rec); err != nil {
+		logf(datachannel.LevelWarn, "%v", err)
+	}
+}
+
+// callerARN looks up the ARN of the identity used by the session.  Sessions can use different identities (like
+// assumed roles, or other profiles), so the ARN is cached by the access key ID of the credentials.
+func (a *AuditLog) callerARN(cfg aws.Config) string {
+	if cfg.Credentials == nil {
+		return ""
+	}
+
+	creds, err := cfg.Credentials.Retrieve(context.Background())
+	if err != nil {
+		logf(datachannel.LevelWarn, "error retrieving credentials for audit log: %v", err)
+		return ""
+	}
+
+	a.mu.Lock()
+	arn, ok := a.arns[creds.AccessKeyID]
+	a.mu.Unlock()
+
+	if ok {
+		return arn
+	}
+
+	out, err := sts.NewFromConfig(cfg).GetCallerIdentity(context.Background(), new(sts.GetCallerIdentityInput))
+	if err != nil {
+		logf(datachannel.LevelWarn, "error looking up caller identity for audit log: %v", err)
+		return ""
+	}
+	arn = aws.ToString(out.Arn)
+
+	a.mu.Lock()
+	a.arns[creds.AccessKeyID] = arn
+	a.mu.Unlock()
+	return arn
+}
@@ -0,0 +1,253 @@
+package ssmclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/dweidenfeld/ssm-session-client/datachannel"
+)
+
+// CloudWatch Logs PutLogEvents limits, each event is counted as the size of the message plus 26 bytes.
+const (
+	cwEventOverhead    = 26
+	cwMaxEventSize     = 256*1024 - cwEventOverhead
+	cwMaxBatchBytes    = 1024 * 1024
+	cwMaxBatchEvents   = 10000
+	cwDefaultBatchSize = 500
+	cwDefaultInterval  = 5 * time.Second
+	cwDefaultRetries   = 3
+	cwRetryDelay       = 500 * time.Millisecond
+)
+
+// ErrExporterClosed is returned when writing to a CloudWatchExporter which has been closed.
+var ErrExporterClosed = errors.New("exporter is closed")
+
+// CloudWatchExporterInput configures the CloudWatch Logs destination of a CloudWatchExporter.
+// LogGroupName is the name of the (existing) log group to send events to.
+// LogStreamName is the name of the log stream in the log group to send events to.
+// CreateLogStream creates the log stream if it does not already exist.
+// BatchSize is the number of events buffered before they are sent.  If not provided, 500 events are buffered.
+// FlushInterval is the longest time an event is buffered before it is sent.  If not provided, 5 seconds is used.
+// MaxRetries is the number of times sending a batch of events is retried before the batch is dropped.  If not
+// provided, 3 retries are attempted, and a negative value disables retries.
+type CloudWatchExporterInput struct {
+	LogGroupName    string
+	LogStreamName   string
+	CreateLogStream bool
+	BatchSize       int
+	FlushInterval   time.Duration
+	MaxRetries      int
+}
+
+// CloudWatchExporter ships lines of text to a CloudWatch Logs log stream from the client, for accounts which have not
+// configured server-side session logging.  It is an io.Writer, where each line written becomes a log event, so it
+// can be used as the destination of an AuditLog (see NewAuditLogWriter), or the Transcript of a shell or command
+// session.  Events are sent in batches, and failed batches are retried with an increasing delay.  Close must be
+// called to send any buffered events.
+type CloudWatchExporter struct {
+	client   *cloudwatchlogs.Client
+	in       CloudWatchExporterInput
+	mu       sync.Mutex
+	partial  []byte
+	events   []types.InputLogEvent
+	seqToken *string
+	flushCh  chan struct{}
+	doneCh   chan struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// NewCloudWatchExporter creates a CloudWatchExporter which sends events to the log stream configured in opts, using
+// the aws.Config parameter to call the CloudWatch Logs API.
+func NewCloudWatchExporter(cfg aws.Config, opts *CloudWatchExporterInput) (*CloudWatchExporter, error) {
+	e := &CloudWatchExporter{
+		client:  cloudwatchlogs.NewFromConfig(cfg),
+		in:      *opts,
+		flushCh: make(chan struct{}, 1),
+		doneCh:  make(chan struct{}),
+	}
+
+	if e.in.BatchSize < 1 || e.in.BatchSize > cwMaxBatchEvents {
+		e.in.BatchSize = cwDefaultBatchSize
+	}
+
+	if e.in.FlushInterval <= 0 {
+		e.in.FlushInterval = cwDefaultInterval
+	}
+
+	if e.in.MaxRetries == 0 {
+		e.in.MaxRetries = cwDefaultRetries
+	}
+
+	if e.in.CreateLogStream {
+		_, err := e.client.CreateLogStream(context.Background(), &cloudwatchlogs.CreateLogStreamInput{
+			LogGroupName:  aws.String(e.in.LogGroupName),
+			LogStreamName: aws.String(e.in.LogStreamName),
+		})
+
+		var exists *types.ResourceAlreadyExistsException
+		if err != nil && !errors.As(err, &exists) {
+			return nil, fmt.Errorf("error creating log stream: %w", err)
+		}
+	}
+
+	e.wg.Add(1)
+	go e.run()
+
+	return e, nil
+}
+
+// Write buffers each complete line in p as a log event, the trailing newline is not included in the event.  An
+// incomplete line is held until the rest of the line is written, or the exporter is closed.
+func (e *CloudWatchExporter) Write(p []byte) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		return 0, ErrExporterClosed
+	}
+
+	e.partial = append(e.partial, p...)
+	for {
+		i := bytes.IndexByte(e.partial, '\n')
+		if i < 0 {
+			break
+		}
+		e.add(e.partial[:i])
+		e.partial = e.partial[i+1:]
+	}
+
+	// don't let a stream without newlines grow without bound
+	for len(e.partial) >= cwMaxEventSize {
+		e.add(e.partial[:cwMaxEventSize])
+		e.partial = e.partial[cwMaxEventSize:]
+	}
+
+	if len(e.events) >= e.in.BatchSize {
+		select {
+		case e.flushCh <- struct{}{}:
+		default:
+		}
+	}
+
+	return len(p), nil
+}
+
+// Close sends any buffered events, including an incomplete line, and stops the exporter.
+func (e *CloudWatchExporter) Close() error {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return nil
+	}
+	e.closed = true
+
+	if len(e.partial) > 0 {
+		e.add(e.partial)
+		e.partial = nil
+	}
+	e.mu.Unlock()
+
+	close(e.doneCh)
+	e.wg.Wait()
+	return nil
+}
+
+// add appends a log event for the message, must be called with the lock held.  Empty lines are skipped, since
+// CloudWatch Logs rejects empty events.
+func (e *CloudWatchExporter) add(msg []byte) {
+	msg = bytes.TrimSuffix(msg, []byte("\r"))
+	if len(msg) < 1 {
+		return
+	}
+
+	e.events = append(e.events, types.InputLogEvent{
+		Message:   aws.String(string(msg)),
+		Timestamp: aws.Int64(time.Now().UnixNano() / int64(time.Millisecond)),
+	})
+}
+
+// run sends the buffered events when the batch is full, the flush interval expires, or the exporter is closed.
+func (e *CloudWatchExporter) run() {
+	defer e.wg.Done()
+
+	t := time.NewTicker(e.in.FlushInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			e.flush()
+		case <-e.flushCh:
+			e.flush()
+		case <-e.doneCh:
+			e.flush()
+			return
+		}
+	}
+}
+
+// flush sends the buffered events in batches which fit the PutLogEvents limits.
+func (e *CloudWatchExporter) flush() {
+	e.mu.Lock()
+	events := e.events
+	e.events = nil
+	e.mu.Unlock()
+
+	for len(events) > 0 {
+		var n, size int
+		for n < len(events) && n < cwMaxBatchEvents {
+			sz := len(*events[n].Message) + cwEventOverhead
+			if size+sz > cwMaxBatchBytes {
+				break
+			}
+			size += sz
+			n++
+		}
+
+		if err := e.send(events[:n]); err != nil {
+			logf(datachannel.LevelWarn, "dropping %d log events: %v", n, err)
+		}
+		events = events[n:]
+	}
+}
+
+// send calls PutLogEvents with the batch of events, retrying failed calls with an increasing delay.
+func (e *CloudWatchExporter) send(events []types.InputLogEvent) error {
+	var err error
+
+	delay := cwRetryDelay
+	for i := 0; i <= e.in.MaxRetries || i == 0; i++ {
+		if i > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+
+		var out *cloudwatchlogs.PutLogEventsOutput
+		out, err = e.client.PutLogEvents(context.Background(), &cloudwatchlogs.PutLogEventsInput{
+			LogEvents:     events,
+			LogGroupName:  aws.String(e.in.LogGroupName),
+			LogStreamName: aws.String(e.in.LogStreamName),
+			SequenceToken: e.seqToken,
+		})
+		if err == nil {
+			e.seqToken = out.NextSequenceToken
+			return nil
+		}
+
+		// another writer to the log stream may have sent events, use the token the service expects
+		var seqErr *types.InvalidSequenceTokenException
+		if errors.As(err, &seqErr) {
+			e.seqToken = seqErr.ExpectedSequenceToken
+		}
+	}
+
+	return fmt.Errorf("error sending log events: %w", err)
+}
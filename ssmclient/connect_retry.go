@@ -0,0 +1,86 @@
+package ssmclient
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dweidenfeld/ssm-session-client/datachannel"
+)
+
+// maxReplaySize is the most data sent from a local connection, before the remote port responds, which is kept so it
+// can be sent again if the connection to the remote port is retried.
+const maxReplaySize = 64 * 1024
+
+// streamWriter sends data from a local connection to the data channel, keeping a copy of the data sent until the
+// remote port responds, so the data can be sent again if the agent fails to connect to the remote port.
+type streamWriter struct {
+	mu       sync.Mutex
+	c        datachannel.DataChannel
+	sent     []byte
+	overflow bool
+	answer   bool
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.answer && !w.overflow {
+		if len(w.sent)+len(p) > maxReplaySize {
+			w.overflow = true
+			w.sent = nil
+		} else {
+			w.sent = append(w.sent, p...)
+		}
+	}
+	return w.c.Write(p)
+}
+
+// answered records that the remote port responded, so the connection was established and the copy of the sent
+// data is no longer required.
+func (w *streamWriter) answered() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.answer = true
+	w.sent = nil
+}
+
+// replay asks the agent to connect to the remote port again, by sending DisconnectPort, and re-sends the data sent
+// so far.  Returns false if the connection can't be retried.
+func (w *streamWriter) replay() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.answer || w.overflow {
+		return false
+	}
+
+	if err := w.c.DisconnectPort(); err != nil {
+		logf(datachannel.LevelWarn, "%v", err)
+		return false
+	}
+
+	if _, err := w.c.Write(w.sent); err != nil {
+		logf(datachannel.LevelWarn, "%v", err)
+		return false
+	}
+	return true
+}
+
+// retryDelay returns the delay provided by the Backoff before the next retry of the connection to the remote port.
+// Returns false if the connection should not be retried.
+func retryDelay(b datachannel.Backoff, attempt *int) (time.Duration, bool) {
+	if b == nil {
+		return 0, false
+	}
+
+	*attempt++
+	d, ok := b.Next(*attempt)
+	if !ok {
+		return 0, false
+	}
+
+	logf(datachannel.LevelInfo, "%v, retrying in %s", datachannel.ErrConnectToPort, d)
+	return d, true
+}
@@ -0,0 +1,156 @@
+package ssmclient
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/dweidenfeld/ssm-session-client/datachannel"
+)
+
+// TunnelDaemon runs a set of named port forwarding tunnels in the background of a SessionManager, and changes them
+// while it runs.  Each call to Reload starts the tunnels which are new, or whose definition changed, and stops the
+// tunnels which were removed or changed.  A tunnel is stopped by closing its listener, and its session is terminated
+// once the connections already established through it are done, so reloading never drops an established connection.
+// Tunnels with an unchanged definition are left alone.
+//
+// Stopping the SessionManager with Shutdown terminates all tunnels, including the ones waiting for their connections
+// to finish.
+type TunnelDaemon struct {
+	m       *SessionManager
+	mu      sync.Mutex
+	tunnels map[string]*tunnel
+}
+
+// tunnel is a port forwarding session run by a TunnelDaemon.  f is nil until the session is started, and stopped is
+// set once the tunnel is removed from the daemon.  The released channel is closed once the listener is closed (or
+// was never created), so a tunnel replacing it can use the same local address.
+type tunnel struct {
+	opts     PortForwardingInput
+	f        *PortForwarder
+	stopped  bool
+	released chan struct{}
+	once     sync.Once
+}
+
+// NewTunnelDaemon creates a TunnelDaemon running its tunnels with the SessionManager.  No tunnels are started until
+// Reload is called.
+func NewTunnelDaemon(m *SessionManager) *TunnelDaemon {
+	return &TunnelDaemon{m: m, tunnels: make(map[string]*tunnel)}
+}
+
+// Reload replaces the tunnel definitions of the daemon, the map key is the name of the tunnel, which identifies it
+// in log messages.  All definitions are validated first, and if any of them is invalid, the error is returned and
+// the running tunnels are not changed.  Tunnels which ended on their own (for example when the agent closed the
+// session) are started again.  The tunnels replacing stopped tunnels only start once the listeners of the stopped
+// tunnels are closed, including tunnels which were still starting, so they can listen on the same local address.
+func (d *TunnelDaemon) Reload(tunnels map[string]*PortForwardingInput) error {
+	for name, opts := range tunnels {
+		if err := opts.Validate(); err != nil {
+			return fmt.Errorf("tunnel %s: %w", name, err)
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var stopped []*tunnel
+	for name, t := range d.tunnels {
+		if opts, ok := tunnels[name]; ok && reflect.DeepEqual(*opts, t.opts) {
+			continue
+		}
+
+		logf(datachannel.LevelInfo, "%s: stopping tunnel", name)
+		t.stop()
+		stopped = append(stopped, t)
+		delete(d.tunnels, name)
+	}
+
+	for name, opts := range tunnels {
+		if _, ok := d.tunnels[name]; ok {
+			continue
+		}
+
+		t := &tunnel{opts: *opts, released: make(chan struct{})}
+		d.tunnels[name] = t
+		d.start(name, t, stopped)
+	}
+	return nil
+}
+
+// start runs the tunnel in the background, like the sessions started with SessionManager.StartPortForwarding, once
+// the tunnels in wait have released their listener.  Must be called with the lock held.
+func (d *TunnelDaemon) start(name string, t *tunnel, wait []*tunnel) {
+	d.m.wg.Add(1)
+	go func() {
+		defer d.m.wg.Done()
+		defer d.ended(name, t)
+		defer t.release()
+
+		for _, w := range wait {
+			<-w.released
+		}
+
+		if err := d.serve(name, t); err != nil {
+			logf(datachannel.LevelError, "%s: tunnel ended with error: %v", name, err)
+			return
+		}
+		logf(datachannel.LevelInfo, "%s: tunnel ended", name)
+	}()
+}
+
+// serve starts the port forwarding session of the tunnel, and forwards connections until the tunnel is stopped, or
+// the session ends.
+func (d *TunnelDaemon) serve(name string, t *tunnel) error {
+	inst, err := d.m.ResolveTarget(t.opts.Target)
+	if err != nil {
+		return err
+	}
+	logf(datachannel.LevelInfo, "%s: starting tunnel to %s", name, inst)
+
+	o := t.opts
+	o.Target = inst
+
+	f, err := newPortForwarder(d.m, d.m.cfg, &o)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	d.mu.Lock()
+	t.f = f
+	stopped := t.stopped
+	d.mu.Unlock()
+
+	if stopped {
+		// removed while the session was starting, closing the listener lets its replacement start
+		return nil
+	}
+	return f.Serve()
+}
+
+// ended removes a tunnel which is done from the daemon, unless it was already replaced, so the next Reload starts
+// it again.
+func (d *TunnelDaemon) ended(name string, t *tunnel) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.tunnels[name] == t {
+		delete(d.tunnels, name)
+	}
+}
+
+// stop stops accepting connections for the tunnel, its session ends once the established connections are done.  Must
+// be called with the lock of the daemon held.
+func (t *tunnel) stop() {
+	t.stopped = true
+	if t.f != nil {
+		t.f.drain()
+		t.release()
+	}
+}
+
+// release signals that the tunnel no longer uses its local address.
+func (t *tunnel) release() {
+	t.once.Do(func() { close(t.released) })
+}
@@ -0,0 +1,71 @@
+package ssmclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+const (
+	// rdsAuthTokenExpiry is how long an RDS IAM authentication token is valid, it's only checked when connecting.
+	rdsAuthTokenExpiry = 15 * time.Minute
+	// emptyPayloadHash is the SHA-256 hash of an empty request body.
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// DialTimeout connects to the address, limiting the time spent waiting for the session handshake.  With Dial and
+// DialContext, this satisfies the pq.Dialer and pq.DialerContext interfaces of github.com/lib/pq, which can be used
+// with a pq.Connector to tunnel database connections.
+func (d *Dialer) DialTimeout(network, addr string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return d.DialContext(ctx, network, addr)
+}
+
+// DialTCPContext connects to the TCP address, it has the signature of the dial functions used by
+// github.com/go-sql-driver/mysql (see mysql.RegisterDialContext) and similar drivers, and of the gRPC dialer option
+// (grpc.WithContextDialer).  gRPC clients should use the passthrough resolver (for example
+// "passthrough:///i-0123456789abcdef0:50051"), so the address is passed to the dialer unchanged.
+func (d *Dialer) DialTCPContext(ctx context.Context, addr string) (net.Conn, error) {
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// RDSAuthToken generates an IAM authentication token, used as the password of the database user, for connecting to
+// an RDS database with IAM authentication enabled.  The endpoint is the host and port of the database (for example
+// mydb.123456789012.us-east-1.rds.amazonaws.com:5432), and the token is signed using the credentials and region of
+// the aws.Config.  The token is valid for 15 minutes.
+func RDSAuthToken(ctx context.Context, cfg aws.Config, endpoint, user string) (string, error) {
+	if cfg.Credentials == nil {
+		return "", errors.New("error generating RDS auth token: no credentials configured")
+	}
+
+	creds, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return "", fmt.Errorf("error retrieving credentials: %w", err)
+	}
+
+	q := url.Values{}
+	q.Set("Action", "connect")
+	q.Set("DBUser", user)
+	q.Set("X-Amz-Expires", strconv.Itoa(int(rdsAuthTokenExpiry.Seconds())))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+endpoint+"/?"+q.Encode(), nil)
+	if err != nil {
+		return "", fmt.Errorf("error generating RDS auth token: %w", err)
+	}
+
+	uri, _, err := v4.NewSigner().PresignHTTP(ctx, creds, req, emptyPayloadHash, "rds-db", cfg.Region, time.Now())
+	if err != nil {
+		return "", fmt.Errorf("error signing RDS auth token: %w", err)
+	}
+	return strings.TrimPrefix(uri, "https://"), nil
+}
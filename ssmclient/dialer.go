@@ -0,0 +1,115 @@
+package ssmclient
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/dweidenfeld/ssm-session-client/datachannel"
+	"golang.org/x/net/proxy"
+)
+
+// Dialer opens connections through SSM port forwarding sessions, and implements the proxy.Dialer and
+// proxy.ContextDialer interfaces of golang.org/x/net/proxy, so it can be used by any library accepting a custom
+// dialer.  Each connection uses its own session, which is terminated when the connection is closed.
+//
+// The host of the dialed address is the target instance (anything accepted by ResolveTarget), and the port is the
+// remote port on the instance.  If Gateway is set, the host of the address is instead a remote host which is reached
+// through the Gateway instance, using the AWS-StartPortForwardingSessionToRemoteHost document.
+type Dialer struct {
+	m       *SessionManager
+	Gateway string
+}
+
+var _ proxy.ContextDialer = (*Dialer)(nil)
+
+// NewDialer creates a Dialer which starts sessions using the SessionManager.
+func NewDialer(m *SessionManager) *Dialer {
+	return &Dialer{m: m}
+}
+
+// Dial connects to the address, see DialContext.
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to the address on the named network, which must be "tcp", "tcp4", or "tcp6".  The context
+// limits the time spent waiting for the session handshake.  The method has the signature of the Dial field of the
+// client-go rest.Config, so Kubernetes clients can reach a private cluster endpoint through the Gateway instance.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	in := &PortForwardingInput{Target: host, RemotePort: port}
+	if len(d.Gateway) > 0 {
+		in.Target = d.Gateway
+		in.RemoteHost = host
+	}
+
+	if err = in.Validate(); err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	return dialSession(ctx, d.m, in)
+}
+
+// Transport returns an *http.Transport which connects through the Dialer, so a plain http.Client can call HTTP
+// APIs on private instances (for example http://i-0123456789abcdef0:9100/metrics, or an internal host name when
+// Gateway is set).  The transport is a copy of http.DefaultTransport, without the proxy configuration from the
+// environment.  Idle connections are kept open for re-use, along with their sessions, so call CloseIdleConnections
+// when done.
+func (d *Dialer) Transport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DialContext = d.DialContext
+	return t
+}
+
+// dialSession starts a port forwarding session, and returns a connection to the remote port once the handshake is
+// complete.
+func dialSession(ctx context.Context, m *SessionManager, in *PortForwardingInput) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	c, err := m.OpenContext(ctx, in.StartSessionInput())
+	if err != nil {
+		return nil, err
+	}
+
+	if err = c.WaitForHandshakeCompleteContext(ctx); err != nil {
+		m.Terminate(c)
+		return nil, err
+	}
+	return &sessionConn{Conn: datachannel.NewConn(c), m: m}, nil
+}
+
+// sessionConn is a connection over its own session, closing it terminates the session.
+type sessionConn struct {
+	*datachannel.Conn
+	m    *SessionManager
+	once sync.Once
+}
+
+func (s *sessionConn) Close() error {
+	err := s.Conn.Close()
+	s.once.Do(func() {
+		s.m.untrack(s.DataChannel())
+		shutdown(s.DataChannel(), false)
+	})
+	return err
+}
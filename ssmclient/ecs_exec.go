@@ -0,0 +1,135 @@
+package ssmclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/dweidenfeld/ssm-session-client/datachannel"
+)
+
+// ECSExecInput configures the parameters of an ECS Exec session, which runs a command in a container of an ECS task.
+// Cluster is the name or ARN of the cluster running the task.  If not provided, the default cluster is used.
+// Task is the ID or ARN of the task.
+// Container is the name of the container to run the command in, only required if the task has more than one
+// container.
+// Command is the command line to execute in the container, like /bin/sh for a shell.
+// Transcript is an optional writer which receives a copy of the command output (for example a CloudWatchExporter).
+// Stderr is an optional writer which receives the stderr output of the command, if the agent sends it separately
+// from the output.  If not provided, stderr output is written with the standard output.
+type ECSExecInput struct {
+	Cluster    string
+	Task       string
+	Container  string
+	Command    string
+	Transcript io.Writer
+	Stderr     io.Writer
+}
+
+// ExecuteCommandInput returns the input used to call the AWS ECS ExecuteCommand API.  ECS Exec only supports
+// interactive commands.
+func (in *ECSExecInput) ExecuteCommandInput() *ecs.ExecuteCommandInput {
+	out := &ecs.ExecuteCommandInput{
+		Task:        aws.String(in.Task),
+		Command:     aws.String(in.Command),
+		Interactive: true,
+	}
+
+	if len(in.Cluster) > 0 {
+		out.Cluster = aws.String(in.Cluster)
+	}
+
+	if len(in.Container) > 0 {
+		out.Container = aws.String(in.Container)
+	}
+	return out
+}
+
+// ECSExecSession runs the command specified in the ECSExecInput parameter in the container, and wires the local
+// terminal to it like ShellSession.  The aws.Config parameter will be used to call the AWS ECS ExecuteCommand and
+// DescribeTasks APIs.  If the agent reports the exit status of the command, a non-zero status is returned as an
+// *ExitError.
+func ECSExecSession(cfg aws.Config, opts *ECSExecInput) error {
+	c, err := openECSDataChannel(cfg, opts)
+	if err != nil {
+		return err
+	}
+	return runTerminal(nil, c, opts.Transcript, opts.Stderr)
+}
+
+// StreamECSExecCommand runs the command specified in the ECSExecInput parameter in the container, writing the output
+// to out as it arrives, and returns the exit status of the command once the session ends.  See StreamCommand for
+// details.
+func StreamECSExecCommand(cfg aws.Config, opts *ECSExecInput, out io.Writer) (int, error) {
+	c, err := openECSDataChannel(cfg, opts)
+	if err != nil {
+		return -1, err
+	}
+	return streamOutput(c, out, opts.Transcript, opts.Stderr)
+}
+
+// openECSDataChannel calls the ExecuteCommand API, and opens the data channel of the returned session.  The target
+// of the session (used as the KMS encryption context) is ecs:<cluster>_<task>_<container runtime ID>, the same as
+// the session manager plugin uses, which requires looking up the runtime ID of the container.
+func openECSDataChannel(cfg aws.Config, opts *ECSExecInput) (*datachannel.SsmDataChannel, error) {
+	client := ecs.NewFromConfig(cfg)
+
+	out, err := client.ExecuteCommand(context.Background(), opts.ExecuteCommandInput())
+	if err != nil {
+		return nil, fmt.Errorf("error calling ExecuteCommand: %w", err)
+	}
+
+	if out.Session == nil {
+		return nil, errors.New("error calling ExecuteCommand: no session returned")
+	}
+
+	runtimeID, err := containerRuntimeID(client, out)
+	if err != nil {
+		return nil, err
+	}
+
+	target := fmt.Sprintf("ecs:%s_%s_%s", arnResource(aws.ToString(out.ClusterArn)),
+		arnResource(aws.ToString(out.TaskArn)), runtimeID)
+	sessionID := aws.ToString(out.Session.SessionId)
+
+	c := datachannel.NewDataChannel(datachannel.WithLogger(Logger))
+	c.SetEncryptionConfig(cfg, sessionID, target)
+	if err = c.OpenWithSession(sessionID, aws.ToString(out.Session.StreamUrl),
+		aws.ToString(out.Session.TokenValue)); err != nil {
+		return nil, err
+	}
+	auditLog.start(cfg, &ssm.StartSessionInput{Target: aws.String(target)}, c)
+	return c, nil
+}
+
+// containerRuntimeID returns the runtime ID of the container the command was executed in.
+func containerRuntimeID(client *ecs.Client, out *ecs.ExecuteCommandOutput) (string, error) {
+	tasks, err := client.DescribeTasks(context.Background(), &ecs.DescribeTasksInput{
+		Cluster: out.ClusterArn,
+		Tasks:   []string{aws.ToString(out.TaskArn)},
+	})
+	if err != nil {
+		return "", fmt.Errorf("error calling DescribeTasks: %w", err)
+	}
+
+	for _, t := range tasks.Tasks {
+		for _, ctr := range t.Containers {
+			if aws.ToString(ctr.ContainerArn) == aws.ToString(out.ContainerArn) {
+				return aws.ToString(ctr.RuntimeId), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("container %s not found in task %s", aws.ToString(out.ContainerName),
+		aws.ToString(out.TaskArn))
+}
+
+// arnResource returns the last part of the resource in an ECS ARN, which is the cluster name of a cluster ARN, and
+// the task ID of a task ARN.
+func arnResource(arn string) string {
+	return arn[strings.LastIndex(arn, "/")+1:]
+}
@@ -0,0 +1,277 @@
+package ssmclient
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/dweidenfeld/ssm-session-client/datachannel"
+)
+
+const (
+	defaultSSHPort           = 22
+	portForwardingDocument   = "AWS-StartPortForwardingSession"
+	remoteHostDocument       = "AWS-StartPortForwardingSessionToRemoteHost"
+	sshDocument              = "AWS-StartSSHSession"
+	interactiveCmdDocument   = "AWS-StartInteractiveCommand"
+	nonInteractiveCmdDoc     = "AWS-StartNonInteractiveCommand"
+	portNumberParameter      = "portNumber"
+	localPortNumberParameter = "localPortNumber"
+	hostParameter            = "host"
+	maxPort                  = 65535
+	maxHostLen               = 253
+	commandParameter         = "command"
+)
+
+// ShellInput configures the shell session parameters.
+// Target is the EC2 instance ID to establish the session with.
+// DocumentName is the SSM document used to start the session.  If not provided, the default shell document is used.
+// Parameters are any additional parameters to pass to the SSM document.
+// Reason is an optional description of the purpose of the session, which is recorded by the SSM service.
+// Transcript is an optional writer which receives a copy of the session output (for example a CloudWatchExporter).
+// Stderr is an optional writer which receives stderr output, if the agent sends it separately from the output.
+type ShellInput struct {
+	Target       string
+	DocumentName string
+	Parameters   map[string][]string
+	Reason       string
+	Transcript   io.Writer
+	Stderr       io.Writer
+}
+
+// StartSessionInput returns the input used to call the AWS SSM StartSession API for the shell session.
+func (in *ShellInput) StartSessionInput() *ssm.StartSessionInput {
+	out := newStartSessionInput(in.Target, in.DocumentName, in.Reason, in.Parameters)
+	if len(out.Parameters) < 1 {
+		// the default shell document takes no parameters, don't send an empty map
+		out.Parameters = nil
+	}
+	return out
+}
+
+// PortForwardingInput configures the port forwarding session parameters.
+// Target is the EC2 instance ID to establish the session with.
+// RemotePort is the port on the EC2 instance (or the RemoteHost) to connect to.
+// RemoteHost is the host name or IP address of a remote host to connect to from the instance, like a database
+// endpoint in the network of the instance.  If provided, the session uses the
+// AWS-StartPortForwardingSessionToRemoteHost document by default.  If not provided, the connection is made to
+// RemotePort on the instance itself.
+// LocalPort is the port on the local host to listen to.  If not provided, a random port will be used.
+// LocalAddress is the address on the local host to listen on.  If not provided, all local addresses are used.
+// IPv6 addresses may be provided with or without brackets (ex. ::1 or [::1]).
+// LocalNetwork restricts the address family of the local listener, and is one of "tcp" (the default), "tcp4", or
+// "tcp6".  Using "tcp" with an unspecified address (empty, "::", or "0.0.0.0") creates a dual-stack listener.  Use
+// "unix" to listen on a unix socket instead, LocalAddress is then the path of the socket, and LocalPort is ignored.
+// On Windows, a LocalAddress like npipe:////./pipe/name listens on the named pipe instead.
+// KeepAlive is the TCP keepalive period of accepted local connections.  If not provided, the Go default (15s) is
+// used, and a negative value disables keepalives.
+// DisableNoDelay enables Nagle's algorithm (turns off TCP_NODELAY) on accepted local connections.
+// MaxConnections is the maximum number of concurrently open local connections.  If not provided, a single connection
+// is allowed, which is all a non-multiplexed session can handle.  Additional connections wait to be accepted.
+// IdleTimeout closes a local connection after no data is sent or received for that long.  If not provided, idle
+// connections are not closed.
+// AllowedNetworks is a list of CIDR blocks (or single IP addresses) of the clients allowed to connect to the local
+// listener, useful when LocalAddress is not a loopback address.  If not provided, all clients are allowed.
+// AuthToken is a pre-shared token which local clients must send, followed by a newline, as the first data on the
+// connection before it is forwarded.  The token itself is not forwarded.  If not provided, no token is required.
+// TLSConfig enables TLS on the local listener.  Setting ClientAuth and ClientCAs in the configuration requires
+// clients to present a trusted certificate.  If not provided, the local listener does not use TLS.
+// ReadinessProbe is how long to wait, after the handshake, for the agent to report that a probe connection to the
+// remote port failed before creating the local listener.  If not provided, or if the session multiplexes streams, the
+// remote port is not probed.
+// ConnectRetry is the Backoff used to retry the connection to the remote port when the agent reports it failed (for
+// example while the remote service restarts), instead of closing the local connection.  Only connections where the
+// remote port has not yet responded, and less than 64KiB has been sent, can be retried.  If not provided, failed
+// connections are not retried.
+// Multiplex reports a client version to the agent which enables stream multiplexing, so local connections share the
+// session concurrently instead of being forwarded one at a time.  Agents which don't support multiplexing (see
+// datachannel.Capabilities) forward connections one at a time as usual.  When streams are multiplexed and
+// MaxConnections is not provided, the number of local connections is not limited.
+// DocumentName is the SSM document used to start the session.  If not provided, AWS-StartPortForwardingSession (or
+// AWS-StartPortForwardingSessionToRemoteHost, if RemoteHost is provided) is used.
+// Parameters are any additional parameters to pass to the SSM document.
+// Reason is an optional description of the purpose of the session, which is recorded by the SSM service.
+type PortForwardingInput struct {
+	Target          string
+	RemotePort      int
+	RemoteHost      string
+	LocalPort       int
+	LocalAddress    string
+	LocalNetwork    string
+	KeepAlive       time.Duration
+	DisableNoDelay  bool
+	MaxConnections  int
+	IdleTimeout     time.Duration
+	AllowedNetworks []string
+	AuthToken       string
+	TLSConfig       *tls.Config
+	ReadinessProbe  time.Duration
+	ConnectRetry    datachannel.Backoff
+	Multiplex       bool
+	DocumentName    string
+	Parameters      map[string][]string
+	Reason          string
+}
+
+// StartSessionInput returns the input used to call the AWS SSM StartSession API for the port forwarding session.
+func (in *PortForwardingInput) StartSessionInput() *ssm.StartSessionInput {
+	doc := in.DocumentName
+	switch {
+	case len(doc) > 0:
+	case len(in.RemoteHost) > 0:
+		doc = remoteHostDocument
+	default:
+		doc = portForwardingDocument
+	}
+
+	out := newStartSessionInput(in.Target, doc, in.Reason, in.Parameters)
+	out.Parameters[localPortNumberParameter] = []string{strconv.Itoa(in.LocalPort)}
+	out.Parameters[portNumberParameter] = []string{strconv.Itoa(in.RemotePort)}
+	if len(in.RemoteHost) > 0 {
+		out.Parameters[hostParameter] = []string{in.RemoteHost}
+	}
+	return out
+}
+
+// Validate checks the RemoteHost, RemotePort, and LocalPort parameters, which are otherwise only rejected by the SSM
+// service (or the agent) once the session is started.  The errors wrap ErrInvalidRemoteAddress or
+// ErrInvalidLocalAddress.
+func (in *PortForwardingInput) Validate() error {
+	if in.RemotePort < 1 || in.RemotePort > maxPort {
+		return fmt.Errorf("%w: invalid port %d", ErrInvalidRemoteAddress, in.RemotePort)
+	}
+
+	if in.LocalPort < 0 || in.LocalPort > maxPort {
+		return fmt.Errorf("%w: invalid port %d", ErrInvalidLocalAddress, in.LocalPort)
+	}
+
+	if len(in.RemoteHost) > 0 && !validHost(in.RemoteHost) {
+		return fmt.Errorf("%w: invalid host %s", ErrInvalidRemoteAddress, in.RemoteHost)
+	}
+	return nil
+}
+
+// remoteAddress returns the host and port connected to by the agent, for log messages.
+func (in *PortForwardingInput) remoteAddress() string {
+	host := in.RemoteHost
+	if len(host) < 1 {
+		host = in.Target
+	}
+	return net.JoinHostPort(host, strconv.Itoa(in.RemotePort))
+}
+
+// validHost reports if the host is an IP address, or a valid DNS name.  Underscores are allowed in DNS names, since
+// they're common in internal names.
+func validHost(host string) bool {
+	if net.ParseIP(host) != nil {
+		return true
+	}
+
+	if len(host) > maxHostLen {
+		return false
+	}
+
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) < 1 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// SSHInput configures the SSH session parameters.
+// Target is the EC2 instance ID to establish the session with.
+// RemotePort is the SSH port on the EC2 instance to connect to.  If not provided, the default SSH port (22) is used.
+// DocumentName is the SSM document used to start the session.  If not provided, AWS-StartSSHSession is used.
+// Parameters are any additional parameters to pass to the SSM document.
+// Reason is an optional description of the purpose of the session, which is recorded by the SSM service.
+type SSHInput struct {
+	Target       string
+	RemotePort   int
+	DocumentName string
+	Parameters   map[string][]string
+	Reason       string
+}
+
+// StartSessionInput returns the input used to call the AWS SSM StartSession API for the SSH session.
+func (in *SSHInput) StartSessionInput() *ssm.StartSessionInput {
+	doc := in.DocumentName
+	if len(doc) < 1 {
+		doc = sshDocument
+	}
+
+	port := defaultSSHPort
+	if in.RemotePort > 0 {
+		port = in.RemotePort
+	}
+
+	out := newStartSessionInput(in.Target, doc, in.Reason, in.Parameters)
+	out.Parameters[portNumberParameter] = []string{strconv.Itoa(port)}
+	return out
+}
+
+// CommandInput configures the parameters of a session which runs a single command on the target.
+// Target is the EC2 instance ID to establish the session with.
+// Command is the command line to execute on the instance.
+// DocumentName is the SSM document used to start the session.  If not provided, AWS-StartInteractiveCommand is used.
+// Parameters are any additional parameters to pass to the SSM document.
+// Reason is an optional description of the purpose of the session, which is recorded by the SSM service.
+// Transcript is an optional writer which receives a copy of the command output (for example a CloudWatchExporter).
+// Stderr is an optional writer which receives the stderr output of the command, if the agent sends it separately
+// from the output.  If not provided, stderr output is written with the standard output.
+type CommandInput struct {
+	Target       string
+	Command      string
+	DocumentName string
+	Parameters   map[string][]string
+	Reason       string
+	Transcript   io.Writer
+	Stderr       io.Writer
+}
+
+// StartSessionInput returns the input used to call the AWS SSM StartSession API for the command session.
+func (in *CommandInput) StartSessionInput() *ssm.StartSessionInput {
+	doc := in.DocumentName
+	if len(doc) < 1 {
+		doc = interactiveCmdDocument
+	}
+
+	out := newStartSessionInput(in.Target, doc, in.Reason, in.Parameters)
+	out.Parameters[commandParameter] = []string{in.Command}
+	return out
+}
+
+// newStartSessionInput builds the StartSession API input common to all session types.  The returned Parameters
+// field is never nil, and is a copy of params so that session-specific parameters can be safely added.
+func newStartSessionInput(target, document, reason string, params map[string][]string) *ssm.StartSessionInput {
+	in := &ssm.StartSessionInput{
+		Target:     aws.String(target),
+		Parameters: make(map[string][]string, len(params)),
+	}
+
+	if len(document) > 0 {
+		in.DocumentName = aws.String(document)
+	}
+
+	if len(reason) > 0 {
+		in.Reason = aws.String(reason)
+	}
+
+	for k, v := range params {
+		in.Parameters[k] = v
+	}
+
+	return in
+}
@@ -0,0 +1,110 @@
+package ssmclient
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/dweidenfeld/ssm-session-client/datachannel"
+)
+
+// InteractiveShell is a shell session attached to the local terminal.  It does the same plumbing as ShellSession
+// (putting the terminal in raw mode, wiring stdin and stdout to the session, and keeping the remote terminal size in
+// sync), but leaves the lifecycle to the caller, so it can be embedded in larger programs.  No signal handlers are
+// installed, the terminal settings are restored when Run returns, and Close terminates the session.
+type InteractiveShell struct {
+	c   *datachannel.SsmDataChannel
+	out io.Writer
+}
+
+// NewInteractiveShell starts a shell session with the instance specified in the ShellInput parameter.  The
+// aws.Config parameter will be used to call the AWS SSM StartSession API.  The local terminal is not modified until
+// Run is called.
+func NewInteractiveShell(cfg aws.Config, opts *ShellInput) (*InteractiveShell, error) {
+	c, err := openDataChannel(cfg, opts.StartSessionInput())
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Stderr != nil {
+		c.SetStderr(opts.Stderr)
+	}
+
+	var out io.Writer = os.Stdout
+	if opts.Transcript != nil {
+		out = io.MultiWriter(os.Stdout, opts.Transcript)
+	}
+
+	return &InteractiveShell{c: c, out: out}, nil
+}
+
+// DataChannel returns the data channel of the session.
+func (s *InteractiveShell) DataChannel() *datachannel.SsmDataChannel {
+	return s.c
+}
+
+// Run attaches the local terminal to the session until the session ends.  The terminal is put in raw mode, the
+// remote terminal size is set and kept up to date, and the initCmd readers are sent to the instance before stdin.
+// The terminal settings are restored before Run returns.
+func (s *InteractiveShell) Run(initCmd ...io.Reader) error {
+	if err := configureStdin(); err != nil {
+		return err
+	}
+	defer cleanup() //nolint:errcheck // best effort restore of the terminal settings
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go s.watchSize(stopCh)
+
+	for _, cmd := range initCmd {
+		if _, err := io.Copy(s.c, cmd); err != nil {
+			return err
+		}
+	}
+
+	go func() {
+		// ends with a write error once the session is closed
+		_, _ = io.Copy(s.c, os.Stdin)
+	}()
+
+	if _, err := io.Copy(s.out, s.c); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	if code, ok := s.c.ExitCode(); ok && code != 0 {
+		return &ExitError{Code: code}
+	}
+	return nil
+}
+
+// Close terminates the session, which makes Run return.
+func (s *InteractiveShell) Close() error {
+	shutdown(s.c, true)
+	return nil
+}
+
+// watchSize sets the remote terminal size, and updates it when the local terminal is resized, until stopCh is
+// closed.
+func (s *InteractiveShell) watchSize(stopCh chan struct{}) {
+	_ = updateTermSize(s.c)
+	if _, _, err := getWinSize(); err != nil {
+		// the default size was set, and there's nothing to watch
+		return
+	}
+
+	t := time.NewTicker(ResizeSleepInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-s.c.Done():
+			return
+		case <-t.C:
+			_ = updateTermSize(s.c)
+		}
+	}
+}
@@ -0,0 +1,497 @@
+package ssmclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dweidenfeld/ssm-session-client/datachannel"
+)
+
+// ErrInvalidLocalAddress is the error returned when the local listener address or network is not valid, or the
+// address does not belong to the requested address family.
+var ErrInvalidLocalAddress = errors.New("invalid local address")
+
+const (
+	// authTimeout is how long a client has to send the authentication token after connecting.
+	authTimeout = 10 * time.Second
+	// maxAuthTokenLen is the maximum length of the authentication token line sent by the client.
+	maxAuthTokenLen = 1024
+	// staleSocketTimeout is how long to wait when connecting to an existing unix socket to check if it's in use.
+	staleSocketTimeout = time.Second
+	// npipeScheme is the prefix of local addresses selecting a Windows named pipe listener.
+	npipeScheme = "npipe://"
+)
+
+// createListener creates the local listener for a port forwarding session.  The muxing parameter reports the
+// session multiplexes streams, so the number of connections is only limited if MaxConnections is provided.
+func createListener(opts *PortForwardingInput, muxing bool) (net.Listener, error) {
+	network, addr, err := listenAddress(opts, "tcp")
+	if err != nil {
+		return nil, err
+	}
+
+	if network == "unix" || network == "npipe" {
+		if len(opts.AllowedNetworks) > 0 {
+			return nil, fmt.Errorf("%w: AllowedNetworks is not supported for %s listeners", ErrInvalidLocalAddress,
+				network)
+		}
+	}
+
+	var l net.Listener
+	switch network {
+	case "npipe":
+		l, err = listenPipe(addr)
+	case "unix":
+		if err = removeStaleSocket(addr); err != nil {
+			return nil, err
+		}
+		fallthrough
+	default:
+		lc := net.ListenConfig{KeepAlive: opts.KeepAlive}
+		l, err = lc.Listen(context.Background(), network, addr)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error creating listener: %w", err)
+	}
+
+	if opts.DisableNoDelay {
+		l = &noDelayListener{Listener: l, noDelay: false}
+	}
+
+	if len(opts.AllowedNetworks) > 0 {
+		nets, e := parseNetworks(opts.AllowedNetworks)
+		if e != nil {
+			_ = l.Close()
+			return nil, e
+		}
+		l = &allowListener{Listener: l, allowed: nets}
+	}
+
+	if opts.TLSConfig != nil {
+		l = tls.NewListener(l, opts.TLSConfig)
+	}
+
+	if opts.TLSConfig != nil || len(opts.AuthToken) > 0 {
+		l = newAuthListener(l, []byte(opts.AuthToken))
+	}
+
+	// non-muxing sessions only handle a single connection at a time, so that's the default
+	// REF: https://github.com/aws/amazon-ssm-agent/blob/master/agent/session/plugins/port/port_mux.go
+	maxConns := opts.MaxConnections
+	if maxConns < 1 && !muxing {
+		maxConns = 1
+	}
+	return newLimitListener(l, maxConns, opts.IdleTimeout), nil
+}
+
+// listenAddress validates the local listener configuration and returns the network and address to listen on.
+// The proto parameter is the transport protocol (tcp or udp) used to listen, and the address family suffix of
+// opts.LocalNetwork (if any) is applied to it.  Unix sockets are only supported for tcp, and the address is the
+// path of the socket.  Named pipes are selected using an npipe:// address (or the "npipe" network), like the
+// npipe:////./pipe/name addresses used by Docker, and the returned address is the Windows path of the pipe.
+func listenAddress(opts *PortForwardingInput, proto string) (network, address string, err error) {
+	if opts.LocalNetwork == "npipe" || strings.HasPrefix(opts.LocalAddress, npipeScheme) {
+		path := strings.TrimPrefix(strings.TrimSpace(opts.LocalAddress), npipeScheme)
+		switch {
+		case proto != "tcp":
+			return "", "", fmt.Errorf("%w: named pipes are not supported for %s forwarding", ErrInvalidLocalAddress, proto)
+		case len(path) < 1:
+			return "", "", fmt.Errorf("%w: the name of the pipe is required", ErrInvalidLocalAddress)
+		}
+		return "npipe", strings.ReplaceAll(path, "/", `\`), nil
+	}
+
+	var family string
+	switch opts.LocalNetwork {
+	case "unix":
+		path := strings.TrimSpace(opts.LocalAddress)
+		switch {
+		case proto != "tcp":
+			return "", "", fmt.Errorf("%w: unix sockets are not supported for %s forwarding", ErrInvalidLocalAddress, proto)
+		case len(path) < 1:
+			return "", "", fmt.Errorf("%w: the path of the unix socket is required", ErrInvalidLocalAddress)
+		}
+		return "unix", path, nil
+	case "", "tcp":
+	case "tcp4":
+		family = "4"
+	case "tcp6":
+		family = "6"
+	default:
+		return "", "", fmt.Errorf("%w: unsupported network %s", ErrInvalidLocalAddress, opts.LocalNetwork)
+	}
+
+	host := strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(opts.LocalAddress), "["), "]")
+
+	// strip any IPv6 zone (ex. fe80::1%eth0) before checking the address family
+	if ip := net.ParseIP(strings.SplitN(host, "%", 2)[0]); ip != nil {
+		is4 := ip.To4() != nil
+		if (family == "4" && !is4) || (family == "6" && is4) {
+			return "", "", fmt.Errorf("%w: %s is not a tcp%s address", ErrInvalidLocalAddress, host, family)
+		}
+	}
+
+	return proto + family, net.JoinHostPort(host, strconv.Itoa(opts.LocalPort)), nil
+}
+
+// removeStaleSocket removes a unix socket left behind at the path, for example by a session which was interrupted.
+// The socket is removed when the listener is closed, so it's only left behind if the program exits without closing
+// it.  A socket which still accepts connections belongs to a running listener, and is left alone with an "address
+// in use" error.  Files which are not sockets are left alone, so creating the listener fails.
+func removeStaleSocket(path string) error {
+	if fi, err := os.Lstat(path); err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+
+	conn, err := net.DialTimeout("unix", path, staleSocketTimeout)
+	switch {
+	case err == nil:
+		_ = conn.Close()
+		return fmt.Errorf("%w: address in use, %s is accepting connections", ErrInvalidLocalAddress, path)
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ENOENT):
+		logf(datachannel.LevelInfo, "removing stale unix socket %s", path)
+		_ = os.Remove(path)
+		return nil
+	default:
+		return fmt.Errorf("%w: unable to check if %s is in use: %v", ErrInvalidLocalAddress, path, err)
+	}
+}
+
+// noDelayListener sets the TCP_NODELAY option on each accepted TCP connection.
+type noDelayListener struct {
+	net.Listener
+	noDelay bool
+}
+
+func (l *noDelayListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if tc, ok := conn.(*net.TCPConn); ok {
+		if err = tc.SetNoDelay(l.noDelay); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("error setting TCP_NODELAY: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// allowListener only accepts connections from clients whose address is contained in one of the allowed networks.
+// Connections from other addresses are closed immediately.
+type allowListener struct {
+	net.Listener
+	allowed []*net.IPNet
+}
+
+func (l *allowListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if l.isAllowed(conn.RemoteAddr()) {
+			return conn, nil
+		}
+
+		logf(datachannel.LevelWarn, "rejecting connection from %s, address is not allowed", conn.RemoteAddr())
+		_ = conn.Close()
+	}
+}
+
+func (l *allowListener) isAllowed(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, n := range l.allowed {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNetworks converts a list of CIDR blocks to net.IPNet types.  A bare IP address is treated as a network
+// containing only that address.
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+
+		if ip := net.ParseIP(c); ip != nil {
+			bits := 8 * net.IPv6len
+			if v4 := ip.To4(); v4 != nil {
+				ip = v4
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid allowed network %s", ErrInvalidLocalAddress, c)
+		}
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+// authListener completes the TLS handshake (for TLS listeners), and requires each client to send the authentication
+// token (if any), followed by a newline, before the connection is accepted.  Connections are authenticated in their
+// own goroutine, so a slow client doesn't hold up the others, and connections which don't complete the
+// authentication within the authTimeout are closed.
+type authListener struct {
+	net.Listener
+	token  []byte
+	connCh chan net.Conn
+	errCh  chan error
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newAuthListener(l net.Listener, token []byte) *authListener {
+	al := &authListener{
+		Listener: l,
+		token:    token,
+		connCh:   make(chan net.Conn),
+		errCh:    make(chan error),
+		done:     make(chan struct{}),
+	}
+	go al.acceptLoop()
+	return al
+}
+
+func (l *authListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.connCh:
+		return conn, nil
+	case err := <-l.errCh:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *authListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// acceptLoop accepts connections from the wrapped listener, and authenticates each of them in a goroutine, until the
+// listener is closed.  Accept errors are passed on to Accept.
+func (l *authListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errCh <- err:
+			case <-l.done:
+				return
+			}
+
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		go l.handle(conn)
+	}
+}
+
+// handle authenticates the connection, and hands it to Accept, or closes it if the authentication fails.
+func (l *authListener) handle(conn net.Conn) {
+	if err := l.authenticate(conn); err != nil {
+		logf(datachannel.LevelWarn, "rejecting connection from %s: %v", conn.RemoteAddr(), err)
+		_ = conn.Close()
+		return
+	}
+
+	select {
+	case l.connCh <- conn:
+	case <-l.done:
+		_ = conn.Close()
+	}
+}
+
+func (l *authListener) authenticate(conn net.Conn) error {
+	if err := conn.SetReadDeadline(time.Now().Add(authTimeout)); err != nil {
+		return err
+	}
+
+	if tc, ok := conn.(*tls.Conn); ok {
+		// the handshake also writes, so limit both directions
+		_ = conn.SetWriteDeadline(time.Now().Add(authTimeout))
+		if err := tc.Handshake(); err != nil {
+			return fmt.Errorf("TLS handshake failed: %w", err)
+		}
+		if err := conn.SetWriteDeadline(time.Time{}); err != nil {
+			return err
+		}
+	}
+
+	if len(l.token) < 1 {
+		return conn.SetReadDeadline(time.Time{})
+	}
+
+	// read a byte at a time, so nothing after the token is consumed
+	line := make([]byte, 0, len(l.token)+2)
+	b := make([]byte, 1)
+	for {
+		if _, err := conn.Read(b); err != nil {
+			return fmt.Errorf("error reading authentication token: %w", err)
+		}
+
+		if b[0] == '\n' {
+			break
+		}
+
+		if line = append(line, b[0]); len(line) > maxAuthTokenLen {
+			return errors.New("authentication token too long")
+		}
+	}
+
+	if subtle.ConstantTimeCompare(bytes.TrimSuffix(line, []byte{'\r'}), l.token) != 1 {
+		return errors.New("invalid authentication token")
+	}
+
+	return conn.SetReadDeadline(time.Time{})
+}
+
+// limitListener restricts the number of concurrently open connections accepted from the wrapped listener (unless
+// the limit is less than 1), and optionally closes connections which have been idle for too long.  Unlike
+// netutil.LimitListener, the returned connections preserve the CloseRead and CloseWrite methods of the underlying
+// connection, if available.
+type limitListener struct {
+	net.Listener
+	sem         chan struct{}
+	idleTimeout time.Duration
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+func newLimitListener(l net.Listener, n int, idleTimeout time.Duration) *limitListener {
+	l2 := &limitListener{
+		Listener:    l,
+		idleTimeout: idleTimeout,
+		done:        make(chan struct{}),
+	}
+
+	if n > 0 {
+		l2.sem = make(chan struct{}, n)
+	}
+	return l2
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	if l.sem == nil {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		return newLocalConn(conn, l.idleTimeout, func() {}), nil
+	}
+
+	select {
+	case l.sem <- struct{}{}:
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+
+	return newLocalConn(conn, l.idleTimeout, func() { <-l.sem }), nil
+}
+
+func (l *limitListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// localConn is a connection accepted by a limitListener.  The release func is called once when the connection
+// is closed, and if timeout is set, the connection is closed after no data has been read or written for that
+// long.
+type localConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newLocalConn(conn net.Conn, timeout time.Duration, release func()) *localConn {
+	c := &localConn{Conn: conn, release: release, timeout: timeout}
+
+	if timeout > 0 {
+		c.timer = time.AfterFunc(timeout, func() {
+			logf(datachannel.LevelInfo, "closing idle connection from %s", conn.RemoteAddr())
+			_ = c.Close()
+		})
+	}
+	return c
+}
+
+func (c *localConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *localConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *localConn) Close() error {
+	c.once.Do(func() {
+		if c.timer != nil {
+			c.timer.Stop()
+		}
+		c.release()
+	})
+	return c.Conn.Close()
+}
+
+// CloseRead shuts down the reading side of the underlying connection, if supported.
+func (c *localConn) CloseRead() error {
+	return datachannel.CloseRead(c.Conn)
+}
+
+// CloseWrite shuts down the writing side of the underlying connection, if supported.
+func (c *localConn) CloseWrite() error {
+	return datachannel.CloseWrite(c.Conn)
+}
+
+func (c *localConn) touch() {
+	if c.timer != nil {
+		c.timer.Reset(c.timeout)
+	}
+}
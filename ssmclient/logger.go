@@ -0,0 +1,16 @@
+package ssmclient
+
+import (
+	"github.com/dweidenfeld/ssm-session-client/datachannel"
+)
+
+// Logger is the Logger used by the session helpers of this package, and set on the data channels they create.  The
+// default writes messages of datachannel.LevelInfo and above to the standard logger of the log package, so programs
+// still show things like the address of the port forwarding listener.  Set it to nil to discard all messages, or to
+// datachannel.NewLevelLogger(datachannel.StdLogger, datachannel.LevelDebug) to troubleshoot sessions.
+var Logger datachannel.Logger = datachannel.NewLevelLogger(datachannel.StdLogger, datachannel.LevelInfo)
+
+// logf writes a message to the Logger.
+func logf(level datachannel.Level, format string, v ...interface{}) {
+	datachannel.Logf(Logger, level, format, v...)
+}
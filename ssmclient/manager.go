@@ -0,0 +1,249 @@
+package ssmclient
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/dweidenfeld/ssm-session-client/datachannel"
+)
+
+// SessionManager runs multiple concurrent sessions (for example a shell and a couple of port forwarding tunnels)
+// sharing a single AWS configuration and target resolution cache, with a common lifecycle.  Background sessions are
+// logged by name when they start and end, and Shutdown terminates every session started by the manager.
+//
+// Sessions started by the manager do not install the signal handlers used by the package level session functions,
+// callers should call Shutdown when the program is interrupted.
+type SessionManager struct {
+	cfg      aws.Config
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	targets  map[string]string
+	channels map[*datachannel.SsmDataChannel]bool
+	closers  map[io.Closer]bool
+	closed   bool
+}
+
+// NewSessionManager creates a SessionManager which uses the aws.Config parameter to call the AWS APIs.
+func NewSessionManager(cfg aws.Config) *SessionManager {
+	return &SessionManager{
+		cfg:      cfg,
+		targets:  make(map[string]string),
+		channels: make(map[*datachannel.SsmDataChannel]bool),
+		closers:  make(map[io.Closer]bool),
+	}
+}
+
+// Config returns the AWS configuration used by the manager.
+func (m *SessionManager) Config() aws.Config {
+	return m.cfg
+}
+
+// ResolveTarget finds the instance ID of the target using ResolveTarget, caching the result for the life of the
+// manager.
+func (m *SessionManager) ResolveTarget(target string) (string, error) {
+	m.mu.Lock()
+	inst, ok := m.targets[target]
+	m.mu.Unlock()
+
+	if ok {
+		return inst, nil
+	}
+
+	inst, err := ResolveTarget(target, m.cfg)
+	if err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	m.targets[target] = inst
+	m.mu.Unlock()
+	return inst, nil
+}
+
+// Open starts a session using the StartSession API input, and returns the open data channel.  The channel is
+// terminated and closed by Shutdown.
+func (m *SessionManager) Open(in *ssm.StartSessionInput) (*datachannel.SsmDataChannel, error) {
+	return m.OpenContext(context.Background(), in)
+}
+
+// OpenContext is Open, the context cancels starting the session.
+func (m *SessionManager) OpenContext(ctx context.Context,
+	in *ssm.StartSessionInput) (*datachannel.SsmDataChannel, error) {
+	target, err := m.ResolveTarget(aws.ToString(in.Target))
+	if err != nil {
+		return nil, err
+	}
+
+	req := *in
+	req.Target = aws.String(target)
+
+	c, err := openDataChannelContext(ctx, m.cfg, &req)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		shutdown(c, true)
+		return nil, io.ErrClosedPipe
+	}
+	m.channels[c] = true
+	return c, nil
+}
+
+// Terminate sends the TerminateSession message for a data channel returned from Open, and closes it.  Programs which
+// open many short-lived sessions should call it when they are done with each session, instead of leaving them for
+// Shutdown.
+func (m *SessionManager) Terminate(c *datachannel.SsmDataChannel) {
+	m.untrack(c)
+	shutdown(c, true)
+}
+
+// StartPortForwarding runs a port forwarding session in the background, see PortForwardingSession.  The name
+// identifies the session in log messages.
+func (m *SessionManager) StartPortForwarding(name string, opts *PortForwardingInput) {
+	m.run(name, opts.Target, func(target string) error {
+		o := *opts
+		o.Target = target
+		return portForwardingSession(m, m.cfg, &o)
+	})
+}
+
+// StartUDPForwarding runs a UDP forwarding session in the background, see UDPForwardingSession.  The name
+// identifies the session in log messages.
+func (m *SessionManager) StartUDPForwarding(name string, opts *PortForwardingInput) {
+	m.run(name, opts.Target, func(target string) error {
+		o := *opts
+		o.Target = target
+		return udpForwardingSession(m, m.cfg, &o)
+	})
+}
+
+// Shell runs a shell session in the foreground, see ShellSession.  Only a single session using the local terminal
+// can be active at a time.
+func (m *SessionManager) Shell(opts *ShellInput, initCmd ...io.Reader) error {
+	target, err := m.ResolveTarget(opts.Target)
+	if err != nil {
+		return err
+	}
+
+	o := *opts
+	o.Target = target
+	return terminalSession(m, m.cfg, o.StartSessionInput(), o.Transcript, o.Stderr, initCmd...)
+}
+
+// Command runs a command session in the foreground, see CommandSession.  Only a single session using the local
+// terminal can be active at a time.
+func (m *SessionManager) Command(opts *CommandInput) error {
+	target, err := m.ResolveTarget(opts.Target)
+	if err != nil {
+		return err
+	}
+
+	o := *opts
+	o.Target = target
+	return terminalSession(m, m.cfg, o.StartSessionInput(), o.Transcript, o.Stderr)
+}
+
+// Wait blocks until all background sessions have ended.
+func (m *SessionManager) Wait() {
+	m.wg.Wait()
+}
+
+// Shutdown terminates all sessions started by the manager, and waits for the background sessions to end.  No new
+// sessions can be started after Shutdown is called.
+func (m *SessionManager) Shutdown() {
+	m.mu.Lock()
+	m.closed = true
+	channels := m.channels
+	closers := m.closers
+	m.channels = make(map[*datachannel.SsmDataChannel]bool)
+	m.closers = make(map[io.Closer]bool)
+	m.mu.Unlock()
+
+	for c, owned := range channels {
+		m.stop(c, owned)
+	}
+
+	for cl := range closers {
+		_ = cl.Close()
+	}
+
+	m.wg.Wait()
+}
+
+// run starts a background session, after resolving the target.
+func (m *SessionManager) run(name, target string, fn func(target string) error) {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+
+		inst, err := m.ResolveTarget(target)
+		if err == nil {
+			logf(datachannel.LevelInfo, "%s: starting session with %s", name, inst)
+			err = fn(inst)
+		}
+
+		if err != nil {
+			logf(datachannel.LevelError, "%s: session ended with error: %v", name, err)
+			return
+		}
+		logf(datachannel.LevelInfo, "%s: session ended", name)
+	}()
+}
+
+// track registers a resource used by a session run by the manager, so it is shut down by Shutdown.  Data channels
+// are terminated, and other resources are closed.  The resource is shut down immediately if the manager is already
+// shut down.  Safe to call on a nil SessionManager.
+func (m *SessionManager) track(r io.Closer) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, isChannel := r.(*datachannel.SsmDataChannel)
+	switch {
+	case m.closed && isChannel:
+		m.stop(c, false)
+	case m.closed:
+		_ = r.Close()
+	case isChannel:
+		m.channels[c] = false
+	default:
+		m.closers[r] = true
+	}
+}
+
+// untrack removes a resource registered with track, once the session is done with it.  Safe to call on a nil
+// SessionManager.
+func (m *SessionManager) untrack(r io.Closer) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if c, ok := r.(*datachannel.SsmDataChannel); ok {
+		delete(m.channels, c)
+		return
+	}
+	delete(m.closers, r)
+}
+
+// stop ends a data channel.  Channels returned from Open are owned by the manager, and are fully shut down, others
+// belong to a running session which will close the channel once the agent acknowledges the termination.
+func (m *SessionManager) stop(c *datachannel.SsmDataChannel, owned bool) {
+	if owned {
+		shutdown(c, true)
+		return
+	}
+	_ = c.TerminateSession()
+}
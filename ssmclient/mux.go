@@ -0,0 +1,164 @@
+package ssmclient
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/dweidenfeld/ssm-session-client/datachannel"
+	"github.com/xtaci/smux"
+)
+
+// muxSession multiplexes local connections as smux streams over a port forwarding session, the same way as the
+// session manager plugin does with agents which support it.  The agent runs the server side of the smux session, the
+// client side is connected to the data channel through an in-memory pipe.
+type muxSession struct {
+	c    *datachannel.SsmDataChannel
+	sess *smux.Session
+	pipe net.Conn
+}
+
+// newMuxSession starts the client side of the smux session, the keepAlive parameter is the MuxKeepAlive capability
+// of the agent.
+func newMuxSession(c *datachannel.SsmDataChannel, keepAlive bool) (*muxSession, error) {
+	local, remote := net.Pipe()
+
+	cfg := smux.DefaultConfig()
+	cfg.KeepAliveDisabled = !keepAlive
+
+	sess, err := smux.Client(local, cfg)
+	if err != nil {
+		_ = local.Close()
+		_ = remote.Close()
+		return nil, fmt.Errorf("error creating smux session: %w", err)
+	}
+
+	m := &muxSession{c: c, sess: sess, pipe: remote}
+	go func() {
+		// smux frames written by the streams are sent to the agent as session input
+		if _, e := io.Copy(c, remote); e != nil {
+			logf(datachannel.LevelError, "mux send error: %v", e)
+		}
+	}()
+	return m, nil
+}
+
+// close shuts down the smux session and its streams, the data channel is left open.
+func (m *muxSession) close() {
+	_ = m.sess.Close()
+	_ = m.pipe.Close()
+}
+
+// serveMux accepts local connections, and forwards each of them concurrently as a separate smux stream, until the
+// listener or the session is closed, and then waits for the open streams to finish.
+func (f *PortForwarder) serveMux() error {
+	go f.receiveMux()
+
+	for {
+		conn, err := f.lsnr.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				// listener was shut down, let the open streams finish
+				f.wg.Wait()
+				return nil
+			}
+
+			// not fatal, just wait for next
+			logf(datachannel.LevelWarn, "%v", err)
+			continue
+		}
+		auditLog.forward(f.c, conn.RemoteAddr(), f.opts.remoteAddress())
+
+		stream, err := f.mux.sess.OpenStream()
+		if err != nil {
+			_ = conn.Close()
+			if f.mux.sess.IsClosed() {
+				f.wg.Wait()
+				return nil
+			}
+
+			logf(datachannel.LevelWarn, "error opening stream: %v", err)
+			continue
+		}
+
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			joinStreams(stream, conn)
+		}()
+	}
+}
+
+// receiveMux delivers session output to the smux session until the data channel is closed, which stops the
+// listener so serveMux returns.
+func (f *PortForwarder) receiveMux() {
+	defer f.lsnr.Close()
+	f.mux.receive(f.inCh, f.errCh)
+}
+
+// receive delivers session output from messageChannel to the smux session until the data channel is closed, and
+// then closes the smux session.
+func (m *muxSession) receive(inCh chan []byte, errCh chan error) {
+	defer m.close()
+
+	for {
+		select {
+		case data, ok := <-inCh:
+			if !ok {
+				// incoming websocket channel is closed, which is fatal
+				return
+			}
+
+			if _, err := m.pipe.Write(data); err != nil {
+				logf(datachannel.LevelError, "%v", err)
+				return
+			}
+		case er := <-errCh:
+			if errors.Is(er, datachannel.ErrConnectToPort) {
+				// the agent resets the stream, the session is still usable
+				logf(datachannel.LevelWarn, "%v", er)
+				continue
+			}
+
+			logf(datachannel.LevelError, "%v", er)
+			return
+		}
+	}
+}
+
+// joinStreams copies data in both directions between the smux stream and the local connection.  When one direction
+// is done the writing side of its destination is shut down (a half-close), so the peer sees EOF while the other
+// direction keeps going, and both are closed once both directions are done.  smux streams can't be half-closed, and
+// closing one also stops reading from it, so when the local connection is done sending the stream is left open until
+// the agent finishes, like BridgeContext does with the data channel.  Closing the session (or the stream) closes the
+// connection.
+func joinStreams(stream *smux.Stream, conn net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		// closing the session ends its streams, which ends a half-closed connection too
+		<-stream.GetDieCh()
+		_ = conn.Close()
+	}()
+
+	go func() {
+		defer wg.Done()
+		// the stream is left open, see above
+		_, _ = io.Copy(stream, conn)
+	}()
+
+	go func() {
+		defer wg.Done()
+		// a failed stream (like when the session is closed) can't take more data either, so close the connection
+		if _, err := io.Copy(conn, stream); err != nil || datachannel.CloseWrite(conn) != nil {
+			_ = conn.Close()
+		}
+	}()
+
+	wg.Wait()
+	_ = stream.Close()
+	_ = conn.Close()
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+// +build !windows
+
+package ssmclient
+
+import (
+	"fmt"
+	"net"
+)
+
+// listenPipe fails, named pipes are only available on Windows.
+func listenPipe(path string) (net.Listener, error) {
+	return nil, fmt.Errorf("%w: named pipes are only supported on Windows", ErrInvalidLocalAddress)
+}
@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package ssmclient
+
+import (
+	"net"
+
+	"github.com/Microsoft/go-winio"
+)
+
+// listenPipe creates a listener on the named pipe, with the default security descriptor (the pipe is accessible to
+// the current user and administrators).
+func listenPipe(path string) (net.Listener, error) {
+	return winio.ListenPipe(path, nil)
+}
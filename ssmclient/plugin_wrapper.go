@@ -2,6 +2,7 @@ package ssmclient
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/aws/SSMCLI/src/datachannel"
 	"github.com/aws/SSMCLI/src/log"
@@ -16,12 +17,12 @@ import (
 func PluginSession(cfg aws.Config, input *ssm.StartSessionInput) error {
 	out, err := ssm.NewFromConfig(cfg).StartSession(context.Background(), input)
 	if err != nil {
-		return err
+		return fmt.Errorf("error calling StartSession: %w", err)
 	}
 
 	ep, err := ssm.NewDefaultEndpointResolver().ResolveEndpoint(cfg.Region, ssm.EndpointResolverOptions{})
 	if err != nil {
-		return err
+		return fmt.Errorf("error resolving SSM endpoint: %w", err)
 	}
 
 	ssmSession := new(session.Session)
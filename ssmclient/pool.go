@@ -0,0 +1,304 @@
+package ssmclient
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/dweidenfeld/ssm-session-client/datachannel"
+)
+
+// ErrPoolClosed is returned when getting a session from a SessionPool which has been closed.
+var ErrPoolClosed = errors.New("session pool is closed")
+
+// SessionPoolInput configures the policies of a SessionPool.
+// MaxPerTarget is the maximum number of open sessions (idle or in use) with a single target.  If not provided, the
+// number of sessions per target is not limited.
+// MaxSessions is the maximum number of open sessions across all targets, effectively a limit for the AWS account of
+// the SessionManager.  If not provided, the total number of sessions is not limited.
+// IdleTimeout is how long a session may be idle in the pool before it is terminated.  If not provided, idle sessions
+// are kept until the pool is closed.
+type SessionPoolInput struct {
+	MaxPerTarget int
+	MaxSessions  int
+	IdleTimeout  time.Duration
+}
+
+// PoolStats contains the counters of a SessionPool.  Hits and Misses count the calls to Get which re-used an idle
+// session, and which opened a new session.  Expired is the number of idle sessions terminated by the IdleTimeout.
+// Open and Idle are the current number of open and idle sessions.
+type PoolStats struct {
+	Hits    int64
+	Misses  int64
+	Expired int64
+	Open    int
+	Idle    int
+}
+
+// SessionPool keeps sessions opened with a SessionManager for re-use, which is useful for programs which open
+// many short-lived sessions with the same targets, like CI systems opening tunnels.  Sessions are returned to the
+// pool with Put when the caller is done with them, and must be in a state where they can be re-used (for example,
+// DisconnectPort has been sent for a port forwarding session).
+type SessionPool struct {
+	m         *SessionManager
+	in        SessionPoolInput
+	mu        sync.Mutex
+	idle      map[string][]*idleSession
+	keys      map[*datachannel.SsmDataChannel]string
+	perTarget map[string]int
+	releaseCh chan struct{}
+	stats     PoolStats
+	doneCh    chan struct{}
+	closed    bool
+}
+
+type idleSession struct {
+	c     *datachannel.SsmDataChannel
+	since time.Time
+}
+
+// NewSessionPool creates a SessionPool which opens sessions using the SessionManager.
+func NewSessionPool(m *SessionManager, opts *SessionPoolInput) *SessionPool {
+	p := &SessionPool{
+		m:         m,
+		in:        *opts,
+		idle:      make(map[string][]*idleSession),
+		keys:      make(map[*datachannel.SsmDataChannel]string),
+		perTarget: make(map[string]int),
+		releaseCh: make(chan struct{}),
+		doneCh:    make(chan struct{}),
+	}
+
+	if p.in.IdleTimeout > 0 {
+		go p.expire()
+	}
+	return p
+}
+
+// Get returns an idle session matching the StartSession API input, or opens a new session if there are none.  If
+// opening a session would exceed the limits of the pool, Get waits for a session to be released, or the context
+// to be cancelled.
+func (p *SessionPool) Get(ctx context.Context, in *ssm.StartSessionInput) (*datachannel.SsmDataChannel, error) {
+	key := poolKey(in)
+	target := aws.ToString(in.Target)
+
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+
+		if c := p.takeIdle(key); c != nil {
+			p.stats.Hits++
+			p.mu.Unlock()
+			return c, nil
+		}
+
+		if p.available(target) {
+			// reserve the slot while the session is opened
+			p.perTarget[target]++
+			p.stats.Open++
+			p.stats.Misses++
+			p.mu.Unlock()
+			break
+		}
+
+		releaseCh := p.releaseCh
+		p.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-releaseCh:
+		}
+	}
+
+	c, err := p.m.Open(in)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err != nil {
+		p.release(target)
+		return nil, err
+	}
+	p.keys[c] = key
+	return c, nil
+}
+
+// Put returns a session obtained from Get to the pool, so it can be re-used.  Sessions which have been closed are
+// discarded.
+func (p *SessionPool) Put(c *datachannel.SsmDataChannel) {
+	select {
+	case <-c.Done():
+		p.Discard(c)
+		return
+	default:
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key, ok := p.keys[c]
+	if !ok {
+		return
+	}
+
+	if p.closed {
+		p.drop(c, key)
+		return
+	}
+
+	p.idle[key] = append(p.idle[key], &idleSession{c: c, since: time.Now()})
+	p.stats.Idle++
+	p.notify()
+}
+
+// Discard terminates a session obtained from Get, instead of returning it to the pool.
+func (p *SessionPool) Discard(c *datachannel.SsmDataChannel) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[c]; ok {
+		p.drop(c, key)
+	}
+}
+
+// Stats returns a snapshot of the pool counters.
+func (p *SessionPool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+// Close terminates the idle sessions, and stops the pool.  Sessions in use are terminated when they are returned
+// to the pool.
+func (p *SessionPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return
+	}
+	p.closed = true
+	close(p.doneCh)
+
+	for key, sessions := range p.idle {
+		for _, s := range sessions {
+			p.drop(s.c, key)
+		}
+	}
+	p.idle = make(map[string][]*idleSession)
+	p.stats.Idle = 0
+	p.notify()
+}
+
+// expire periodically terminates sessions which have been idle for longer than the IdleTimeout.
+func (p *SessionPool) expire() {
+	t := time.NewTicker(p.in.IdleTimeout / 2)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-p.doneCh:
+			return
+		case <-t.C:
+		}
+
+		p.mu.Lock()
+		for key, sessions := range p.idle {
+			var keep []*idleSession
+			for _, s := range sessions {
+				if time.Since(s.since) < p.in.IdleTimeout {
+					keep = append(keep, s)
+					continue
+				}
+				p.drop(s.c, key)
+				p.stats.Idle--
+				p.stats.Expired++
+			}
+			p.idle[key] = keep
+		}
+		p.mu.Unlock()
+	}
+}
+
+// takeIdle removes an open idle session for the key from the pool, must be called with the lock held.
+func (p *SessionPool) takeIdle(key string) *datachannel.SsmDataChannel {
+	for len(p.idle[key]) > 0 {
+		sessions := p.idle[key]
+		s := sessions[len(sessions)-1]
+		p.idle[key] = sessions[:len(sessions)-1]
+		p.stats.Idle--
+
+		select {
+		case <-s.c.Done():
+			// closed by the agent while idle
+			p.drop(s.c, key)
+		default:
+			return s.c
+		}
+	}
+	return nil
+}
+
+// available reports if a new session with the target is allowed, must be called with the lock held.
+func (p *SessionPool) available(target string) bool {
+	if p.in.MaxSessions > 0 && p.stats.Open >= p.in.MaxSessions {
+		return false
+	}
+	return p.in.MaxPerTarget < 1 || p.perTarget[target] < p.in.MaxPerTarget
+}
+
+// drop terminates the session, and frees its slot in the pool, must be called with the lock held.
+func (p *SessionPool) drop(c *datachannel.SsmDataChannel, key string) {
+	delete(p.keys, c)
+	p.release(strings.SplitN(key, "\n", 2)[0])
+
+	p.m.untrack(c)
+	go shutdown(c, true)
+}
+
+// release frees a slot for the target, and wakes up any callers waiting in Get, must be called with the lock held.
+func (p *SessionPool) release(target string) {
+	p.perTarget[target]--
+	if p.perTarget[target] < 1 {
+		delete(p.perTarget, target)
+	}
+	p.stats.Open--
+	p.notify()
+}
+
+// notify wakes up any callers waiting in Get, must be called with the lock held.
+func (p *SessionPool) notify() {
+	close(p.releaseCh)
+	p.releaseCh = make(chan struct{})
+}
+
+// poolKey identifies sessions which are interchangeable, the target must be the first line of the key.
+func poolKey(in *ssm.StartSessionInput) string {
+	var sb strings.Builder
+	sb.WriteString(aws.ToString(in.Target))
+	sb.WriteString("\n")
+	sb.WriteString(aws.ToString(in.DocumentName))
+
+	names := make([]string, 0, len(in.Parameters))
+	for k := range in.Parameters {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	for _, k := range names {
+		sb.WriteString("\n")
+		sb.WriteString(k)
+		sb.WriteString("=")
+		sb.WriteString(strings.Join(in.Parameters[k], ","))
+	}
+	return sb.String()
+}
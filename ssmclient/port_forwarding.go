@@ -1,157 +1,356 @@
 package ssmclient
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
-	"log"
 	"net"
 	"os"
 	"os/signal"
-	"strconv"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"github.com/dweidenfeld/ssm-session-client/datachannel"
-	"golang.org/x/net/netutil"
 )
 
-// PortForwardingInput configures the port forwarding session parameters.
-// Target is the EC2 instance ID to establish the session with.
-// RemotePort is the port on the EC2 instance to connect to.
-// LocalPort is the port on the local host to listen to.  If not provided, a random port will be used.
-type PortForwardingInput struct {
-	Target     string
-	RemotePort int
-	LocalPort  int
-}
+// ErrInvalidRemoteAddress is the error returned when the remote host or port of a port forwarding session is not
+// valid.
+var ErrInvalidRemoteAddress = errors.New("invalid remote address")
+
+// ErrRemotePortUnavailable is returned when the readiness probe finds the remote port is not accepting connections.
+var ErrRemotePortUnavailable = errors.New("remote port is not accepting connections")
 
 // PortForwardingSession starts a port forwarding session using the PortForwardingInput parameters to
 // configure the session.  The aws.Config parameter will be used to call the AWS SSM StartSession
 // API, which is used as part of establishing the websocket communication channel.
-//
-//nolint:funlen,gocognit // it's long, but not overly hard to read despite what the gocognit says
 func PortForwardingSession(cfg aws.Config, opts *PortForwardingInput) error {
-	c, err := openDataChannel(cfg, opts)
+	return portForwardingSession(nil, cfg, opts)
+}
+
+// portForwardingSession runs the port forwarding session, registering its resources with the SessionManager (if
+// not nil) so they are shut down with the manager.
+func portForwardingSession(m *SessionManager, cfg aws.Config, opts *PortForwardingInput) error {
+	f, err := newPortForwarder(m, cfg, opts)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		// Both the basic and muxing plugins support TerminateSession on the agent side.
-		_ = c.TerminateSession()
-		_ = c.Close()
-	}()
+	// Both the basic and muxing plugins support TerminateSession on the agent side.
+	defer f.Close()
 
 	// use a signal handler vs. defer since defer operates after an escape from the outer loop
 	// and we can't trust the data channel connection state at that point.  Intercepting signals
 	// means we're probably trying to shutdown somewhere in the outer loop, and there's a good
-	// possibility that the data channel is still valid
-	installSignalHandler(c)
+	// possibility that the data channel is still valid.  Managed sessions leave signals to the manager.
+	if m == nil {
+		installSignalHandler(f.c)
+	}
+
+	return f.Serve()
+}
+
+// PortForwarder is a port forwarding session with a local listener.  It does the same work as PortForwardingSession
+// (accepting local connections, and copying their data over the data channel), but leaves the lifecycle to the
+// caller, so it can be embedded in larger programs.  No signal handlers are installed, and Close terminates the
+// session.
+type PortForwarder struct {
+	m     *SessionManager
+	c     *datachannel.SsmDataChannel
+	lsnr  net.Listener
+	opts  *PortForwardingInput
+	mux   *muxSession
+	inCh  chan []byte
+	errCh chan error
+	done  chan struct{}
+	once  sync.Once
+	wg    sync.WaitGroup
+}
+
+// NewPortForwarder starts a port forwarding session using the PortForwardingInput parameters, and creates the local
+// listener once the handshake is complete (and the remote port is ready, if a ReadinessProbe is configured).  The
+// aws.Config parameter will be used to call the AWS SSM StartSession API.  Connections are accepted once Serve is
+// called.
+func NewPortForwarder(cfg aws.Config, opts *PortForwardingInput) (*PortForwarder, error) {
+	return newPortForwarder(nil, cfg, opts)
+}
+
+// newPortForwarder creates the PortForwarder, registering its resources with the SessionManager (if not nil).
+func newPortForwarder(m *SessionManager, cfg aws.Config, opts *PortForwardingInput) (*PortForwarder, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	c, err := openDataChannel(cfg, opts.StartSessionInput())
+	if err != nil {
+		return nil, err
+	}
+	m.track(c)
+
+	if opts.Multiplex {
+		c.SetClientVersion(datachannel.MuxingClientVersion)
+	}
+
+	f := &PortForwarder{m: m, c: c, opts: opts, errCh: make(chan error, 1), done: make(chan struct{})}
+	if err = f.listen(); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return f, nil
+}
 
-	if err = c.WaitForHandshakeComplete(); err != nil {
+// listen waits for the handshake, starts stream multiplexing if requested and supported by the agent, probes the
+// remote port, and creates the local listener.
+func (f *PortForwarder) listen() error {
+	if err := f.c.WaitForHandshakeComplete(); err != nil {
 		return err
 	}
 
-	lsnr, err := createListener(opts.LocalPort)
+	if caps := f.c.Capabilities(); f.opts.Multiplex && caps.Muxing {
+		mux, err := newMuxSession(f.c, caps.MuxKeepAlive)
+		if err != nil {
+			return err
+		}
+		f.mux = mux
+	}
+
+	f.inCh = messageChannel(f.c, f.errCh, f.done)
+
+	if err := f.probe(); err != nil {
+		return err
+	}
+
+	lsnr, err := createListener(f.opts, f.mux != nil)
 	if err != nil {
 		return err
 	}
-	defer lsnr.Close()
-	log.Printf("listening on %s", lsnr.Addr())
+	logf(datachannel.LevelInfo, "listening on %s", lsnr.Addr())
+
+	f.lsnr = lsnr
+	f.m.track(lsnr)
+	return nil
+}
+
+// Addr returns the address of the local listener, which is useful to find the port when LocalPort is not provided.
+func (f *PortForwarder) Addr() net.Addr {
+	return f.lsnr.Addr()
+}
+
+// DataChannel returns the data channel of the session.
+func (f *PortForwarder) DataChannel() *datachannel.SsmDataChannel {
+	return f.c
+}
+
+// Serve accepts local connections, and forwards them to the remote port until the listener or the session is closed.
+// Connections are forwarded one at a time, unless the session multiplexes streams (see PortForwardingInput).  Returns
+// nil when the forwarding ends because of Close, or the agent closing the session.
+//
+//nolint:funlen,gocognit // it's long, but not overly hard to read despite what the gocognit says
+func (f *PortForwarder) Serve() error {
+	if f.mux != nil {
+		return f.serveMux()
+	}
 
-	doneCh := make(chan bool)
-	errCh := make(chan error)
-	inCh := messageChannel(c, errCh)
+	c, opts := f.c, f.opts
 
 outer:
 	for {
-		var conn net.Conn
-		conn, err = lsnr.Accept()
+		conn, err := f.lsnr.Accept()
 		if err != nil {
-			// not fatal, just wait for next (maybe unless lsnr is dead?)
-			log.Print(err)
+			if errors.Is(err, net.ErrClosed) {
+				// listener was shut down
+				return nil
+			}
+
+			// not fatal, just wait for next
+			logf(datachannel.LevelWarn, "%v", err)
 			continue
 		}
+		auditLog.forward(c, conn.RemoteAddr(), opts.remoteAddress())
 
+		// each connection has its own channel, so a copy which is still running once the connection is dropped
+		// can't be mistaken for the copy of the next connection
+		sw := &streamWriter{c: c}
+		copyCh := make(chan error, 1)
 		go func() {
-			// handle incoming messages from AWS in the background
-			if _, e := io.Copy(c, conn); e != nil {
-				errCh <- e
-			}
-			doneCh <- true
+			// send the data from the local connection in the background
+			_, e := io.Copy(sw, conn)
+			copyCh <- e
 		}()
 
+		var attempt int
+		// retryCh is only set while waiting to retry the connection to the remote port
+		var retryCh <-chan time.Time
 	inner:
 		for {
 			select {
-			case <-doneCh:
+			case <-retryCh:
+				retryCh = nil
+				if !sw.replay() {
+					break inner
+				}
+			case e := <-copyCh:
+				copyCh = nil
+				if e != nil {
+					logf(datachannel.LevelWarn, "%v", e)
+				}
+
 				// basic (non-muxing) connections support DisconnectPort to signal to the remote agent that
 				// we are shutting down this particular connection on our end, and possibly expect a new one.
 				_ = c.DisconnectPort()
 				break inner
-			case data, ok := <-inCh:
+			case data, ok := <-f.inCh:
 				if !ok {
 					// incoming websocket channel is closed, which is fatal
 					_ = conn.Close()
 					break outer
 				}
 
+				sw.answered()
 				if _, err = conn.Write(data); err != nil {
-					log.Print(err)
+					logf(datachannel.LevelWarn, "%v", err)
 				}
-			case er, ok := <-errCh:
+			case er, ok := <-f.errCh:
 				if !ok {
 					// I can't think of a good reason why we'd ever end up here, but if we do
 					// we should stop the world
-					log.Print("errCh closed")
+					logf(datachannel.LevelError, "errCh closed")
 					_ = conn.Close()
 					break outer
 				}
 
-				// any write to errCh means at least 1 of the goroutines has exited
-				log.Print(er)
+				if errors.Is(er, datachannel.ErrConnectToPort) {
+					if retryCh != nil {
+						// already waiting to retry
+						continue
+					}
+					if d, ok := retryDelay(opts.ConnectRetry, &attempt); ok {
+						retryCh = time.After(d)
+						continue
+					}
+				}
+
+				// a connection failure which is not retried, or a failure of the message reader, ends the connection
+				logf(datachannel.LevelWarn, "%v", er)
 				break inner
 			}
 		}
 
+		// closing the connection ends the copy, wait for it so it can't send data for the next connection
 		_ = conn.Close()
+		if copyCh != nil {
+			<-copyCh
+		}
 	}
 	return nil
 }
 
+// drain stops accepting local connections, without ending the connections already accepted, so Serve returns once
+// they are done.
+func (f *PortForwarder) drain() {
+	if f.lsnr != nil {
+		_ = f.lsnr.Close()
+	}
+}
+
+// Close stops the local listener, and terminates the session, which makes Serve return.
+func (f *PortForwarder) Close() error {
+	f.once.Do(func() {
+		close(f.done)
+		if f.lsnr != nil {
+			_ = f.lsnr.Close()
+			f.m.untrack(f.lsnr)
+		}
+		if f.mux != nil {
+			f.mux.close()
+		}
+		f.m.untrack(f.c)
+		shutdown(f.c, true)
+	})
+	return nil
+}
+
 // PortPluginSession delegates the execution of the SSM port forwarding to the AWS-managed session manager plugin code,
 // bypassing this libraries internal websocket code and connection management.
 func PortPluginSession(cfg aws.Config, opts *PortForwardingInput) error {
-	in := &ssm.StartSessionInput{
-		DocumentName: aws.String("AWS-StartPortForwardingSession"),
-		Target:       aws.String(opts.Target),
-		Parameters: map[string][]string{
-			"localPortNumber": {strconv.Itoa(opts.LocalPort)},
-			"portNumber":      {strconv.Itoa(opts.RemotePort)},
-		},
+	return PluginSession(cfg, opts.StartSessionInput())
+}
+
+// probe checks the remote port is accepting connections, by sending an empty message which makes the agent connect
+// to it, and waiting up to the ReadinessProbe timeout for the agent to report a failure (ConnectToPortError, or the
+// session ending).  Output from the remote port, or no failure within the timeout, means the port is ready.
+// Multiplexed sessions are not probed, since the agent connects to the remote port for each stream.  Messages must be
+// processed (see messageChannel) while probing.
+func (f *PortForwarder) probe() error {
+	timeout := f.opts.ReadinessProbe
+	if timeout <= 0 || f.mux != nil {
+		return nil
 	}
 
-	return PluginSession(cfg, in)
-}
+	// an empty message makes the agent connect to the remote port, without sending anything to it
+	if _, err := f.c.Write(nil); err != nil {
+		return fmt.Errorf("%w: %v", ErrRemotePortUnavailable, err)
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
 
-func openDataChannel(cfg aws.Config, opts *PortForwardingInput) (*datachannel.SsmDataChannel, error) {
-	in := &ssm.StartSessionInput{
-		DocumentName: aws.String("AWS-StartPortForwardingSession"),
-		Target:       aws.String(opts.Target),
-		Parameters: map[string][]string{
-			"localPortNumber": {strconv.Itoa(opts.LocalPort)},
-			"portNumber":      {strconv.Itoa(opts.RemotePort)},
-		},
+	select {
+	case <-t.C:
+	case _, ok := <-f.inCh:
+		if !ok {
+			return ErrRemotePortUnavailable
+		}
+	case err := <-f.errCh:
+		return fmt.Errorf("%w: %v", ErrRemotePortUnavailable, err)
+	}
+
+	// close the probe connection, so the first local connection gets a connection of its own, and drop a failure
+	// reported after the timeout, so it isn't taken as a failure of that connection
+	if err := f.c.DisconnectPort(); err != nil {
+		return err
+	}
+	select {
+	case err := <-f.errCh:
+		logf(datachannel.LevelDebug, "ignoring error reported after the readiness probe: %v", err)
+	default:
 	}
+	return nil
+}
+
+func openDataChannel(cfg aws.Config, in *ssm.StartSessionInput) (*datachannel.SsmDataChannel, error) {
+	return openDataChannelContext(context.Background(), cfg, in)
+}
 
-	c := new(datachannel.SsmDataChannel)
-	if err := c.Open(cfg, in); err != nil {
+// openDataChannelContext is openDataChannel, the context cancels starting the session.
+func openDataChannelContext(ctx context.Context, cfg aws.Config,
+	in *ssm.StartSessionInput) (*datachannel.SsmDataChannel, error) {
+	c := datachannel.NewDataChannel(datachannel.WithLogger(Logger))
+	if err := c.OpenContext(ctx, cfg, in); err != nil {
 		return nil, err
 	}
+	auditLog.start(cfg, in, c)
 	return c, nil
 }
 
-// read messages from websocket and write payload to the returned channel.
-func messageChannel(c datachannel.DataChannel, errCh chan error) chan []byte {
+// shutdown sends the TerminateSession message to the agent (if terminate is true), closes the data channel, and
+// records the end of the session in the audit log.  A summary of the session is logged for troubleshooting.
+func shutdown(c datachannel.DataChannel, terminate bool) {
+	if terminate {
+		_ = c.TerminateSession()
+	}
+	_ = c.Close()
+	auditLog.stop(c)
+
+	if sc, ok := c.(interface{ Summary() datachannel.Summary }); ok {
+		logf(datachannel.LevelInfo, "%v", sc.Summary())
+	}
+}
+
+// read messages from websocket and write payload to the returned channel, until reading fails or done is closed.
+func messageChannel(c datachannel.DataChannel, errCh chan error, done chan struct{}) chan []byte {
 	inCh := make(chan []byte)
 
 	buf := make([]byte, 4096)
@@ -162,19 +361,34 @@ func messageChannel(c datachannel.DataChannel, errCh chan error) chan []byte {
 
 		for {
 			nr, err := c.Read(buf)
+			if errors.Is(err, io.ErrShortBuffer) {
+				// the message is kept for the next read
+				buf = make([]byte, 2*len(buf))
+				continue
+			}
 			if err != nil {
-				errCh <- err
+				sendErr(errCh, err, done)
 				return
 			}
 
 			payload, err = c.HandleMsg(buf[:nr])
 			if err != nil {
-				errCh <- err
+				if !sendErr(errCh, err, done) {
+					return
+				}
+				if errors.Is(err, datachannel.ErrConnectToPort) {
+					// the session is still usable
+					continue
+				}
 				return
 			}
 
 			if len(payload) > 0 {
-				inCh <- payload
+				select {
+				case inCh <- payload:
+				case <-done:
+					return
+				}
 			}
 		}
 	}()
@@ -182,15 +396,14 @@ func messageChannel(c datachannel.DataChannel, errCh chan error) chan []byte {
 	return inCh
 }
 
-func createListener(port int) (net.Listener, error) {
-	l, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(port)))
-	if err != nil {
-		return nil, err
+// sendErr sends the error to errCh, unless done is closed first.  Returns false if done was closed.
+func sendErr(errCh chan error, err error, done chan struct{}) bool {
+	select {
+	case errCh <- err:
+		return true
+	case <-done:
+		return false
 	}
-
-	// use limit listener for now, eventually maybe we'll add muxing
-	// REF: https://github.com/aws/amazon-ssm-agent/blob/master/agent/session/plugins/port/port_mux.go
-	return netutil.LimitListener(l, 1), nil
 }
 
 // shared with ssh.go.
@@ -199,10 +412,9 @@ func installSignalHandler(c datachannel.DataChannel) {
 	signal.Notify(sigCh, os.Interrupt, syscall.SIGQUIT, syscall.SIGTERM)
 	go func() {
 		sig := <-sigCh
-		log.Printf("Got signal: %s, shutting down", sig.String())
+		logf(datachannel.LevelInfo, "Got signal: %s, shutting down", sig.String())
 
-		_ = c.TerminateSession()
-		_ = c.Close()
+		shutdown(c, true)
 
 		os.Exit(0)
 	}()
@@ -0,0 +1,116 @@
+package ssmclient
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/dweidenfeld/ssm-session-client/datachannel"
+)
+
+// RunCommand runs the command on the target instance, using the AWS-StartInteractiveCommand document, and returns
+// the output and exit status of the command once it exits.  See StreamCommand for details.
+func RunCommand(cfg aws.Config, target, command string) ([]byte, int, error) {
+	buf := new(bytes.Buffer)
+	code, err := StreamCommand(cfg, &CommandInput{Target: target, Command: command}, buf)
+	return buf.Bytes(), code, err
+}
+
+// StreamCommand runs the command specified in the CommandInput parameter on the target instance, writing the output
+// to out as it arrives, and returns the exit status of the command once the session ends.  Unlike CommandSession,
+// the local terminal is not used, so it is suitable for programs running commands in the background.  Nothing is
+// sent to the command's stdin, and the remote terminal has a fixed size.
+//
+// The exit status is -1 if the agent does not report it, which is the case for interactive command sessions with
+// agents which don't separate the exit status from the output (see datachannel.Capabilities).  A non-zero exit
+// status is not treated as an error.
+func StreamCommand(cfg aws.Config, opts *CommandInput, out io.Writer) (int, error) {
+	c, err := openDataChannel(cfg, opts.StartSessionInput())
+	if err != nil {
+		return -1, err
+	}
+	return streamOutput(c, out, opts.Transcript, opts.Stderr)
+}
+
+// streamOutput writes the output of the open data channel to out (and transcript, if not nil) until the session
+// ends, and then shuts it down.  Returns the exit status of the command, or -1 if the agent did not report it.
+func streamOutput(c *datachannel.SsmDataChannel, out, transcript, stderr io.Writer) (int, error) {
+	defer shutdown(c, false)
+
+	if stderr != nil {
+		c.SetStderr(stderr)
+	}
+
+	if err := c.SetTerminalSize(defaultTermRows, defaultTermCols); err != nil {
+		return -1, err
+	}
+
+	if transcript != nil {
+		out = io.MultiWriter(out, transcript)
+	}
+
+	if _, err := io.Copy(out, c); err != nil && !errors.Is(err, io.EOF) {
+		return -1, err
+	}
+
+	if code, ok := c.ExitCode(); ok {
+		return code, nil
+	}
+	return -1, nil
+}
+
+// CommandOutput is the result of a command run by RunNonInteractiveCommand.  Stdout and Stderr are the complete
+// output of the command, and ExitCode is its exit status, or -1 if the agent did not report it.
+type CommandOutput struct {
+	Stdout   []byte
+	Stderr   []byte
+	ExitCode int
+}
+
+// RunNonInteractiveCommand runs the command specified in the CommandInput parameter on the target instance, using a
+// NonInteractiveCommands session, and returns the complete output once the agent closes the channel.  The session
+// uses the AWS-StartNonInteractiveCommand document, unless DocumentName is provided.  The agent does not allocate a
+// terminal for these sessions, and sends the stderr output and exit status separately from the standard output,
+// which makes them a better fit than interactive commands for batch automation.  If Stderr or Transcript are set in
+// the CommandInput, they also receive the output as it arrives.
+func RunNonInteractiveCommand(cfg aws.Config, opts *CommandInput) (*CommandOutput, error) {
+	o := *opts
+	if len(o.DocumentName) < 1 {
+		o.DocumentName = nonInteractiveCmdDoc
+	}
+
+	c, err := openDataChannel(cfg, o.StartSessionInput())
+	if err != nil {
+		return nil, err
+	}
+	defer shutdown(c, false)
+
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+
+	var errOut io.Writer = stderr
+	if opts.Stderr != nil {
+		errOut = io.MultiWriter(stderr, opts.Stderr)
+	}
+	c.SetStderr(errOut)
+
+	var out io.Writer = stdout
+	if opts.Transcript != nil {
+		out = io.MultiWriter(stdout, opts.Transcript)
+	}
+
+	if _, err = io.Copy(out, c); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	// the output is complete once the agent sends ChannelClosed
+	if _, err = c.Wait(); err != nil {
+		return nil, err
+	}
+
+	res := &CommandOutput{Stdout: stdout.Bytes(), Stderr: stderr.Bytes(), ExitCode: -1}
+	if code, ok := c.ExitCode(); ok {
+		res.ExitCode = code
+	}
+	return res, nil
+}
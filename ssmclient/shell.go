@@ -2,25 +2,75 @@ package ssmclient
 
 import (
 	"errors"
+	"fmt"
 	"io"
-	"log"
 	"os"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"github.com/dweidenfeld/ssm-session-client/datachannel"
 )
 
-// ShellSession starts a shell session with the instance specified in the target parameter.  The aws.Config
+const (
+	ResizeSleepInterval = time.Millisecond * 500
+
+	// terminal size used when the size of the local terminal is not available
+	defaultTermRows = 45
+	defaultTermCols = 132
+)
+
+// ExitError is returned from a command session when the agent reports that the command exited with a non-zero
+// status, so callers (like CI scripts) can propagate the failure.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("command exited with status %d", e.Code)
+}
+
+// ShellSession starts a shell session with the instance specified in the ShellInput parameter.  The aws.Config
 // parameter will be used to call the AWS SSM StartSession API, which is used as part of establishing the
 // websocket communication channel.  A vararg slice of io.Readers can be provided to send data to the
 // instance before handing control of the terminal to the user.
-func ShellSession(cfg aws.Config, target string, initCmd ...io.Reader) error {
-	c := new(datachannel.SsmDataChannel)
-	if err := c.Open(cfg, &ssm.StartSessionInput{Target: aws.String(target)}); err != nil {
+func ShellSession(cfg aws.Config, opts *ShellInput, initCmd ...io.Reader) error {
+	return terminalSession(nil, cfg, opts.StartSessionInput(), opts.Transcript, opts.Stderr, initCmd...)
+}
+
+// CommandSession starts a session which runs the command specified in the CommandInput parameter on the target
+// instance, and streams the output to Stdout.  Like a shell session, Stdin is sent to the running command, and
+// the session ends when the command exits.  The aws.Config parameter will be used to call the AWS SSM StartSession
+// API, which is used as part of establishing the websocket communication channel.  If the agent reports the exit
+// status of the command, a non-zero status is returned as an *ExitError.
+func CommandSession(cfg aws.Config, opts *CommandInput) error {
+	return terminalSession(nil, cfg, opts.StartSessionInput(), opts.Transcript, opts.Stderr)
+}
+
+// terminalSession wires the local terminal to the data channel for session types which interact with a remote
+// terminal (shell and interactive command sessions).  If transcript is not nil, it receives a copy of the output.
+// If stderr is not nil, it receives the stderr output sent separately by the agent.  The data channel is registered
+// with the SessionManager (if not nil) so it is shut down with the manager.
+func terminalSession(m *SessionManager, cfg aws.Config, in *ssm.StartSessionInput, transcript, stderr io.Writer,
+	initCmd ...io.Reader) error {
+	c, err := openDataChannel(cfg, in)
+	if err != nil {
 		return err
 	}
-	defer c.Close()
+	return runTerminal(m, c, transcript, stderr, initCmd...)
+}
+
+// runTerminal wires the local terminal to the open data channel until the session ends, and then shuts it down.
+func runTerminal(m *SessionManager, c *datachannel.SsmDataChannel, transcript, stderr io.Writer,
+	initCmd ...io.Reader) error {
+	defer shutdown(c, false)
+
+	if stderr != nil {
+		c.SetStderr(stderr)
+	}
+
+	m.track(c)
+	defer m.untrack(c)
 
 	// do platform-specific setup ... signal handling, stdin modification, etc...
 	if err := initialize(c); err != nil {
@@ -30,8 +80,8 @@ func ShellSession(cfg aws.Config, target string, initCmd ...io.Reader) error {
 
 	errCh := make(chan error, 5)
 	go func() {
-		if _, err := io.Copy(c, os.Stdin); err != nil {
-			errCh <- err
+		if _, e := io.Copy(c, os.Stdin); e != nil {
+			errCh <- e
 		}
 	}()
 
@@ -39,23 +89,35 @@ func ShellSession(cfg aws.Config, target string, initCmd ...io.Reader) error {
 		_, _ = io.Copy(c, cmd)
 	}
 
-	if _, err := io.Copy(os.Stdout, c); err != nil {
+	var out io.Writer = os.Stdout
+	if transcript != nil {
+		out = io.MultiWriter(os.Stdout, transcript)
+	}
+
+	if _, err := io.Copy(out, c); err != nil {
 		if !errors.Is(err, io.EOF) {
 			errCh <- err
 		}
 		close(errCh)
 	}
 
-	return <-errCh
+	if err := <-errCh; err != nil {
+		return err
+	}
+
+	if code, ok := c.ExitCode(); ok && code != 0 {
+		return &ExitError{Code: code}
+	}
+	return nil
 }
 
 func updateTermSize(c datachannel.DataChannel) error {
 	rows, cols, err := getWinSize()
 	if err != nil {
 		// make sure we set some default terminal size with contrived values
-		cols = 132
-		rows = 45
-		log.Printf("Could not get size of the terminal: %s, using width %d height %d\n", err, cols, rows)
+		cols = defaultTermCols
+		rows = defaultTermRows
+		logf(datachannel.LevelWarn, "Could not get size of the terminal: %s, using width %d height %d", err, cols, rows)
 	}
 
 	return c.SetTerminalSize(rows, cols)
@@ -63,6 +125,12 @@ func updateTermSize(c datachannel.DataChannel) error {
 
 // ShellPluginSession delegates the execution of the SSM shell session to the AWS-managed session manager plugin code,
 // bypassing this libraries internal websocket code and session management.
-func ShellPluginSession(cfg aws.Config, target string) error {
-	return PluginSession(cfg, &ssm.StartSessionInput{Target: aws.String(target)})
+func ShellPluginSession(cfg aws.Config, opts *ShellInput) error {
+	return PluginSession(cfg, opts.StartSessionInput())
+}
+
+// CommandPluginSession delegates the execution of the SSM command session to the AWS-managed session manager plugin
+// code, bypassing this libraries internal websocket code and session management.
+func CommandPluginSession(cfg aws.Config, opts *CommandInput) error {
+	return PluginSession(cfg, opts.StartSessionInput())
 }
@@ -3,8 +3,10 @@
 package ssmclient
 
 import (
-	"golang.org/x/sys/unix"
+	"fmt"
 	"os"
+
+	"golang.org/x/sys/unix"
 )
 
 func cleanup() error {
@@ -19,7 +21,7 @@ func cleanup() error {
 func configureStdin() (err error) {
 	origTermios, err = unix.IoctlGetTermios(int(os.Stdin.Fd()), unix.TIOCGETA)
 	if err != nil {
-		return err
+		return fmt.Errorf("error reading terminal settings: %w", err)
 	}
 
 	// unsetting ISIG means that this process will no longer respond to the INT, QUIT, SUSP
@@ -28,5 +30,8 @@ func configureStdin() (err error) {
 	newTermios := *origTermios
 	newTermios.Lflag = origTermios.Lflag ^ unix.ICANON ^ unix.ECHO ^ unix.ISIG
 
-	return unix.IoctlSetTermios(int(os.Stdin.Fd()), unix.TIOCSETAF, &newTermios)
+	if err = unix.IoctlSetTermios(int(os.Stdin.Fd()), unix.TIOCSETAF, &newTermios); err != nil {
+		return fmt.Errorf("error configuring terminal settings: %w", err)
+	}
+	return nil
 }
@@ -4,7 +4,7 @@
 package ssmclient
 
 import (
-	"log"
+	"fmt"
 	"os"
 	"os/signal"
 	"time"
@@ -13,10 +13,6 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-const (
-	ResizeSleepInterval = time.Millisecond * 500
-)
-
 var origTermios *unix.Termios
 
 func initialize(c datachannel.DataChannel) error {
@@ -42,9 +38,9 @@ func installSignalHandlers(c datachannel.DataChannel) chan os.Signal {
 			// plus, does Go implement sigwinch internally for windows? (we know the OS proper doesn't)
 			_ = updateTermSize(c) // todo handle error? (datachannel.SetTerminalSize error)
 		case os.Interrupt, unix.SIGQUIT, unix.SIGTERM:
-			log.Print("exiting")
+			logf(datachannel.LevelDebug, "exiting")
 			_ = cleanup()
-			_ = c.Close()
+			shutdown(c, false)
 			os.Exit(0)
 		}
 	}()
@@ -58,7 +54,7 @@ func getWinSize() (rows, cols uint32, err error) {
 
 	sz, err = unix.IoctlGetWinsize(int(os.Stdin.Fd()), unix.TIOCGWINSZ)
 	if err != nil {
-		return 0, 0, err
+		return 0, 0, fmt.Errorf("error reading terminal size: %w", err)
 	}
 
 	return uint32(sz.Row), uint32(sz.Col), nil
@@ -17,6 +17,11 @@ func initialize(c datachannel.DataChannel) error {
 	return nil
 }
 
+func configureStdin() error {
+	// todo - put the console in raw mode
+	return nil
+}
+
 func cleanup() error {
 	// todo - reset stdin to original settings
 	return nil
@@ -3,87 +3,72 @@ package ssmclient
 import (
 	"errors"
 	"io"
-	"log"
 	"os"
-	"strconv"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"github.com/dweidenfeld/ssm-session-client/datachannel"
 )
 
 // SSHSession starts a specialized port forwarding session to allow SSH connectivity to the target instance over
-// the SSM session.  It listens for data from Stdin and sends output to Stdout.  Like a port forwarding session,
-// use a PortForwardingInput type to configure the session properties.  Any LocalPort information is ignored, and
-// if no RemotePort is specified, the default SSH port (22) will be used. The aws.Config parameter is used to call
-// the AWS SSM StartSession API, which is used as part of establishing the websocket communication channel.
-func SSHSession(cfg aws.Config, opts *PortForwardingInput) error {
-	var port = "22"
-	if opts.RemotePort > 0 {
-		port = strconv.Itoa(opts.RemotePort)
-	}
-
-	in := &ssm.StartSessionInput{
-		DocumentName: aws.String("AWS-StartSSHSession"),
-		Target:       aws.String(opts.Target),
-		Parameters: map[string][]string{
-			"portNumber": {port},
-		},
-	}
-
-	c := new(datachannel.SsmDataChannel)
-	if err := c.Open(cfg, in); err != nil {
+// the SSM session.  It listens for data from Stdin and sends output to Stdout.  Use an SSHInput type to configure
+// the session properties.  If no RemotePort is specified, the default SSH port (22) will be used. The aws.Config
+// parameter is used to call the AWS SSM StartSession API, which is used as part of establishing the websocket
+// communication channel.
+//
+// This is suitable for use as an ssh ProxyCommand, including with Windows OpenSSH.  No terminal setup is done,
+// stdio is copied unmodified (binary-safe, no newline translation), and the ssh client closing its end of the stdio
+// pipes is treated as the normal end of the session, so nil is returned unless the session failed.
+func SSHSession(cfg aws.Config, opts *SSHInput) error {
+	c, err := openDataChannel(cfg, opts.StartSessionInput())
+	if err != nil {
 		return err
 	}
-	defer func() {
-		_ = c.TerminateSession()
-		_ = c.Close()
-	}()
+	defer shutdown(c, true)
 
 	installSignalHandler(c)
 
-	log.Print("waiting for handshake")
-	if err := c.WaitForHandshakeComplete(); err != nil {
+	logf(datachannel.LevelDebug, "waiting for handshake")
+	if err = c.WaitForHandshakeComplete(); err != nil {
 		return err
 	}
-	log.Print("handshake complete")
+	logf(datachannel.LevelDebug, "handshake complete")
+
+	return ProxyStdio(c, os.Stdin, os.Stdout)
+}
 
-	errCh := make(chan error, 5)
+// ProxyStdio copies in to the session, and the session output to out, until the session ends or out is closed.  The
+// handshake must be complete before calling it.  This is the stdio forwarding used by SSHSession, and is useful for
+// programs which open the data channel themselves (for example using a SessionManager) and act as an ssh
+// ProxyCommand, or forward other stdio based protocols.  Closed stdio pipes are treated as the normal end of the
+// session, so nil is returned unless the session failed.  The session is not terminated.
+func ProxyStdio(c datachannel.DataChannel, in io.Reader, out io.Writer) error {
+	// the input copy is the only sender, and may still be running when this returns, so the channel is never closed
+	errCh := make(chan error, 1)
 	go func() {
-		if _, err := io.Copy(c, os.Stdin); err != nil {
-			log.Printf("error copying from stdin to websocket: %v", err)
-			errCh <- err
+		if _, e := io.Copy(c, in); e != nil && !isClosedPipe(e) {
+			logf(datachannel.LevelError, "error copying from stdin to websocket: %v", e)
+			errCh <- e
 		}
-		log.Print("copy from stdin to websocket finished")
+		logf(datachannel.LevelDebug, "copy from stdin to websocket finished")
 	}()
 
-	if _, err := io.Copy(os.Stdout, c); err != nil {
-		if !errors.Is(err, io.EOF) {
-			log.Printf("error copying from websocket to stdout: %v", err)
-			errCh <- err
-		}
-		log.Print("EOF received from websocket -> stdout copy")
-		close(errCh)
+	if _, err := io.Copy(out, c); err != nil && !errors.Is(err, io.EOF) && !isClosedPipe(err) {
+		logf(datachannel.LevelError, "error copying from websocket to stdout: %v", err)
+		return err
 	}
+	logf(datachannel.LevelDebug, "EOF received from websocket -> stdout copy")
 
-	return <-errCh
+	// report an input failure which happened before the session ended
+	select {
+	case err := <-errCh:
+		return err
+	default:
+		return nil
+	}
 }
 
 // SSHPluginSession delegates the execution of the SSM SSH integration to the AWS-managed session manager plugin code,
 // bypassing this libraries internal websocket code and connection management.
-func SSHPluginSession(cfg aws.Config, opts *PortForwardingInput) error {
-	var port = "22"
-	if opts.RemotePort > 0 {
-		port = strconv.Itoa(opts.RemotePort)
-	}
-
-	in := &ssm.StartSessionInput{
-		DocumentName: aws.String("AWS-StartSSHSession"),
-		Target:       aws.String(opts.Target),
-		Parameters: map[string][]string{
-			"portNumber": {port},
-		},
-	}
-
-	return PluginSession(cfg, in)
+func SSHPluginSession(cfg aws.Config, opts *SSHInput) error {
+	return PluginSession(cfg, opts.StartSessionInput())
 }
@@ -0,0 +1,100 @@
+package ssmclient
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/dweidenfeld/ssm-session-client/datachannel"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// SSHClient starts an SSH session with the target instance (see SSHSession), and runs an SSH client over it, so Go
+// programs can run remote commands, or open SFTP sessions, without running an external ssh program.  The
+// ssh.ClientConfig parameter configures the user, authentication methods, and host key verification of the client.
+// The aws.Config parameter will be used to call the AWS SSM StartSession API.
+//
+// Closing the returned client terminates the session, and the client is closed when the agent ends the session.
+func SSHClient(cfg aws.Config, opts *SSHInput, clientCfg *ssh.ClientConfig) (*ssh.Client, error) {
+	c, err := openDataChannel(cfg, opts.StartSessionInput())
+	if err != nil {
+		return nil, err
+	}
+
+	if err = c.WaitForHandshakeComplete(); err != nil {
+		shutdown(c, true)
+		return nil, err
+	}
+
+	local, remote := net.Pipe()
+	go func() {
+		if e := c.Bridge(remote); e != nil {
+			logf(datachannel.LevelError, "ssh client bridge error: %v", e)
+		}
+	}()
+
+	port := defaultSSHPort
+	if opts.RemotePort > 0 {
+		port = opts.RemotePort
+	}
+	addr := net.JoinHostPort(opts.Target, strconv.Itoa(port))
+
+	conn := &sshConn{Conn: local, c: c}
+	sc, chans, reqs, err := ssh.NewClientConn(conn, addr, clientCfg)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("error creating ssh connection: %w", err)
+	}
+	return ssh.NewClient(sc, chans, reqs), nil
+}
+
+// SSHAgentAuth returns an ssh.AuthMethod using the keys of the running ssh agent, found using the SSH_AUTH_SOCK
+// environment variable.
+func SSHAgentAuth() (ssh.AuthMethod, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if len(sock) < 1 {
+		return nil, errors.New("error connecting to ssh agent: SSH_AUTH_SOCK is not set")
+	}
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to ssh agent: %w", err)
+	}
+	return ssh.PublicKeysCallback(agent.NewClient(conn).Signers), nil
+}
+
+// SSHKeyAuth returns an ssh.AuthMethod using the PEM encoded private key.  Encrypted keys are decrypted using the
+// passphrase, which is ignored for unencrypted keys.
+func SSHKeyAuth(pemBytes, passphrase []byte) (ssh.AuthMethod, error) {
+	var signer ssh.Signer
+	var err error
+
+	if len(passphrase) > 0 {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pemBytes, passphrase)
+	} else {
+		signer, err = ssh.ParsePrivateKey(pemBytes)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error parsing ssh private key: %w", err)
+	}
+	return ssh.PublicKeys(signer), nil
+}
+
+// sshConn is the connection used by the SSH client, closing it terminates the session.
+type sshConn struct {
+	net.Conn
+	c    *datachannel.SsmDataChannel
+	once sync.Once
+}
+
+func (s *sshConn) Close() error {
+	err := s.Conn.Close()
+	s.once.Do(func() { shutdown(s.c, true) })
+	return err
+}
@@ -0,0 +1,112 @@
+package ssmclient
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/dweidenfeld/ssm-session-client/datachannel"
+)
+
+// SsmListener is a net.Listener which hands out connections to the remote port of a port forwarding session, so
+// code written around a listener (like a server accepting connections to proxy them elsewhere) can use SSM
+// forwarding without a local TCP listener.  Each call to Accept returns a connection over a new session, or over a
+// new stream of a single multiplexed session if Multiplex is set in the PortForwardingInput and the agent supports
+// it.  Accept does not block waiting for a client, it connects to the remote port immediately.
+type SsmListener struct {
+	m       *SessionManager
+	opts    PortForwardingInput
+	mux     *muxSession
+	c       *datachannel.SsmDataChannel
+	closeCh chan struct{}
+	once    sync.Once
+}
+
+// NewSsmListener creates an SsmListener which starts sessions using the SessionManager.  The local listener
+// configuration of the PortForwardingInput is not used.  If Multiplex is set, the multiplexed session is started
+// before returning.
+func NewSsmListener(m *SessionManager, opts *PortForwardingInput) (*SsmListener, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	l := &SsmListener{m: m, opts: *opts, closeCh: make(chan struct{})}
+	if opts.Multiplex {
+		if err := l.startMux(); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// Accept returns a new connection to the remote port.  Returns net.ErrClosed once the listener is closed.
+func (l *SsmListener) Accept() (net.Conn, error) {
+	select {
+	case <-l.closeCh:
+		return nil, net.ErrClosed
+	default:
+	}
+
+	if l.mux != nil {
+		stream, err := l.mux.sess.OpenStream()
+		if err != nil {
+			return nil, err
+		}
+		return stream, nil
+	}
+
+	return dialSession(context.Background(), l.m, &l.opts)
+}
+
+// Close stops the listener, and terminates the multiplexed session (if any).  Connections over separate sessions
+// are left open.
+func (l *SsmListener) Close() error {
+	l.once.Do(func() {
+		close(l.closeCh)
+		if l.mux != nil {
+			l.mux.close()
+			l.m.Terminate(l.c)
+		}
+	})
+	return nil
+}
+
+// Addr returns the remote address of the connections, as a *datachannel.Addr.
+func (l *SsmListener) Addr() net.Addr {
+	return &datachannel.Addr{ID: l.opts.remoteAddress()}
+}
+
+// startMux starts the multiplexed session, falling back to a session per connection if the agent does not
+// support multiplexing.
+func (l *SsmListener) startMux() error {
+	c, err := l.m.Open(l.opts.StartSessionInput())
+	if err != nil {
+		return err
+	}
+	c.SetClientVersion(datachannel.MuxingClientVersion)
+
+	if err = c.WaitForHandshakeComplete(); err != nil {
+		l.m.Terminate(c)
+		return err
+	}
+
+	caps := c.Capabilities()
+	if !caps.Muxing {
+		logf(datachannel.LevelInfo, "agent version %s does not support multiplexing, using a session per connection",
+			caps.AgentVersion)
+		l.m.Terminate(c)
+		return nil
+	}
+
+	mux, err := newMuxSession(c, caps.MuxKeepAlive)
+	if err != nil {
+		l.m.Terminate(c)
+		return err
+	}
+
+	errCh := make(chan error)
+	go mux.receive(messageChannel(c, errCh, nil), errCh)
+
+	l.c, l.mux = c, mux
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package ssmclient
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// isClosedPipe reports if the error is the result of the other end of a stdio pipe going away, as happens when the
+// ssh client which started a ProxyCommand exits.
+func isClosedPipe(err error) bool {
+	return errors.Is(err, syscall.EPIPE) || errors.Is(err, os.ErrClosed)
+}
@@ -0,0 +1,20 @@
+//go:build windows
+// +build windows
+
+package ssmclient
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// isClosedPipe reports if the error is the result of the other end of a stdio pipe going away, as happens when the
+// ssh client which started a ProxyCommand exits.  Windows reports this as ERROR_BROKEN_PIPE when reading, and
+// ERROR_NO_DATA when writing.
+func isClosedPipe(err error) bool {
+	return errors.Is(err, syscall.ERROR_BROKEN_PIPE) || errors.Is(err, windows.ERROR_NO_DATA) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, os.ErrClosed)
+}
@@ -0,0 +1,123 @@
+package ssmclient
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// ParseTargetARN returns the instance ID and region of a target given as the ARN of an EC2 instance
+// (arn:aws:ec2:<region>:<account>:instance/i-...) or a managed instance
+// (arn:aws:ssm:<region>:<account>:managed-instance/mi-...).  Returns false if the target is not such an ARN.
+func ParseTargetARN(target string) (string, string, bool) {
+	a, err := arn.Parse(strings.TrimSpace(target))
+	if err != nil {
+		return "", "", false
+	}
+
+	var prefix string
+	switch a.Service {
+	case "ec2":
+		prefix = "instance/"
+	case "ssm":
+		prefix = "managed-instance/"
+	default:
+		return "", "", false
+	}
+
+	if !strings.HasPrefix(a.Resource, prefix) || len(a.Region) < 1 {
+		return "", "", false
+	}
+	return strings.TrimPrefix(a.Resource, prefix), a.Region, true
+}
+
+// TargetConfig returns a copy of the aws.Config using the region of the target, and the instance ID of the target.
+// If the target is an ARN, the region is taken from the ARN.  Otherwise, if regions are provided, the target is
+// searched for in each of them (see FindTargetRegion), and a single "*" searches all regions enabled in the account.
+// If the target is not an ARN and no regions are provided, the configuration and target are returned unchanged.
+func TargetConfig(cfg aws.Config, target string, regions ...string) (aws.Config, string, error) {
+	if id, region, ok := ParseTargetARN(target); ok {
+		out := cfg.Copy()
+		out.Region = region
+		return out, id, nil
+	}
+
+	if len(regions) < 1 {
+		return cfg, target, nil
+	}
+
+	if len(regions) == 1 && regions[0] == "*" {
+		regions = nil
+	}
+
+	region, err := FindTargetRegion(cfg, target, regions...)
+	if err != nil {
+		return cfg, target, err
+	}
+
+	out := cfg.Copy()
+	out.Region = region
+	return out, target, nil
+}
+
+// FindTargetRegion searches the regions for the managed instance (using the SSM DescribeInstanceInformation API),
+// and returns the region where it is registered.  If no regions are provided, all regions enabled in the account
+// are searched.  The regions are searched concurrently, and ErrNoInstanceFound is returned if the instance is not
+// found in any of them.
+func FindTargetRegion(cfg aws.Config, target string, regions ...string) (string, error) {
+	if len(regions) < 1 {
+		var err error
+		if regions, err = enabledRegions(cfg); err != nil {
+			return "", err
+		}
+	}
+
+	in := &ssm.DescribeInstanceInformationInput{
+		Filters: []ssmtypes.InstanceInformationStringFilter{{Key: aws.String("InstanceIds"), Values: []string{target}}},
+	}
+
+	found := make(chan string, len(regions))
+	var wg sync.WaitGroup
+
+	for _, r := range regions {
+		wg.Add(1)
+		go func(region string) {
+			defer wg.Done()
+
+			out, err := ssm.NewFromConfig(cfg, func(o *ssm.Options) { o.Region = region }).
+				DescribeInstanceInformation(context.Background(), in)
+			if err == nil && len(out.InstanceInformationList) > 0 {
+				found <- region
+			}
+		}(r)
+	}
+
+	wg.Wait()
+	close(found)
+
+	if region, ok := <-found; ok {
+		return region, nil
+	}
+	return "", ErrNoInstanceFound
+}
+
+// enabledRegions returns the regions enabled in the account, using the EC2 DescribeRegions API.
+func enabledRegions(cfg aws.Config) ([]string, error) {
+	out, err := ec2.NewFromConfig(cfg).DescribeRegions(context.Background(), new(ec2.DescribeRegionsInput))
+	if err != nil {
+		return nil, fmt.Errorf("error calling DescribeRegions: %w", err)
+	}
+
+	regions := make([]string, 0, len(out.Regions))
+	for _, r := range out.Regions {
+		regions = append(regions, aws.ToString(r.RegionName))
+	}
+	return regions, nil
+}
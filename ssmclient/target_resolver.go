@@ -4,7 +4,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
 	"net"
 	"regexp"
 	"strings"
@@ -12,6 +11,8 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/dweidenfeld/ssm-session-client/datachannel"
 )
 
 var (
@@ -20,6 +21,10 @@ var (
 	// ErrNoInstanceFound is the error returned if a resolver was unable to find an instance.
 	ErrNoInstanceFound = errors.New("no instances returned from lookup")
 
+	// EC2 private DNS names, ip-<address>.ec2.internal in us-east-1, and ip-<address>.<region>.compute.internal
+	// elsewhere.
+	privateDNSPattern = regexp.MustCompile(`^ip-[0-9-]+\.(ec2|[a-z0-9-]+\.compute)\.internal$`)
+
 	// RFC 1918 and 6598 address blocks.
 	privateNets = []net.IPNet{
 		{IP: net.ParseIP("10.0.0.0"), Mask: net.IPv4Mask(0xff, 0, 0, 0)},       // 10.0/8
@@ -36,24 +41,27 @@ type TargetResolver interface {
 
 // ResolveTarget attempts to find the instance ID of the target using a pre-defined resolution order.
 // The first check will see if the target is already in the format of an EC2 instance ID.  Next, if
-// the cfg parameter is not nil, checking by EC2 instance tags or private IPv4 IP address is performed.
-// Finally, resolving by DNS TXT record will be attempted.
+// the cfg parameter is not nil, checking by EC2 instance tags, IPv4 IP address, or private DNS name is
+// performed, followed by the computer name or IP address reported by the SSM agent.  Finally, resolving
+// by DNS TXT record will be attempted.
 func ResolveTarget(target string, cfg aws.Config) (string, error) {
 	resolvers := []TargetResolver{
 		NewTagResolver(cfg),
 		NewIPResolver(cfg),
+		NewPrivateDNSResolver(cfg),
+		NewSSMResolver(cfg),
 	}
 
 	return ResolveTargetChain(strings.TrimSpace(target), append(resolvers, NewDNSResolver())...)
 }
 
 // ResolveTargetChain attempts to find the instance ID of the target using the provided list of TargetResolvers.
-// The first check will always be to see if the target is already in the format of an EC2 instance ID before
-// moving on to the resolution logic of the provided TargetResolvers.  If a resolver returns an error, the next
-// resolver in the chain is checked.  If all resolvers fail to find an instance ID an error is returned.
+// The first check will always be to see if the target is already in the format of an EC2 instance ID (or an
+// on-premises managed instance ID, like mi-0123456789abcdef0), or the ARN of one, before moving on to the
+// resolution logic of the provided TargetResolvers.  If a resolver returns an error, the next resolver in the chain is checked.  If all resolvers fail to find an instance ID an error is returned.
 func ResolveTargetChain(target string, resolvers ...TargetResolver) (inst string, err error) {
 	var matched bool
-	matched, err = regexp.MatchString(`^i-[[:xdigit:]]{8,}$`, target)
+	matched, err = regexp.MatchString(`^m?i-[[:xdigit:]]{8,}$`, target)
 	if err != nil {
 		return "", err
 	}
@@ -62,6 +70,11 @@ func ResolveTargetChain(target string, resolvers ...TargetResolver) (inst string
 		return target, nil
 	}
 
+	if id, _, ok := ParseTargetARN(target); ok {
+		// the region of the ARN is applied by TargetConfig
+		return id, nil
+	}
+
 	for _, res := range resolvers {
 		inst, err = res.Resolve(target)
 		if err != nil {
@@ -82,6 +95,17 @@ func NewIPResolver(cfg aws.Config) *IPResolver {
 	return &IPResolver{&EC2Resolver{cfg: cfg}}
 }
 
+// NewPrivateDNSResolver is a TargetResolver which knows how to find an EC2 instance using the private DNS name.
+func NewPrivateDNSResolver(cfg aws.Config) *PrivateDNSResolver {
+	return &PrivateDNSResolver{&EC2Resolver{cfg: cfg}}
+}
+
+// NewSSMResolver is a TargetResolver which knows how to find a managed instance using the information reported by
+// the SSM agent.
+func NewSSMResolver(cfg aws.Config) *SSMResolver {
+	return &SSMResolver{cfg: cfg}
+}
+
 // NewDNSResolver is a TargetResolver which knows how to find an EC2 instance using DNS TXT record lookups.
 func NewDNSResolver() *DNSResolver {
 	return new(DNSResolver)
@@ -89,7 +113,7 @@ func NewDNSResolver() *DNSResolver {
 
 /*
  * DNS Resolver attempts to find an instance using a DNS TXT record lookup.  The DNS record is expected
- * to resolve to the EC2 instance ID associated with the DNS name.  If the DNS record is not found, or if
+ * to resolve to the EC2 (or managed) instance ID associated with the DNS name.  If the DNS record is not found, or if
  * there is nothing which looks like an EC2 instance ID in the record data, and error is returned.
  */
 type DNSResolver bool
@@ -97,10 +121,10 @@ type DNSResolver bool
 func (r *DNSResolver) Resolve(target string) (string, error) {
 	rr, err := net.LookupTXT(strings.TrimSpace(target))
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("error looking up DNS TXT record: %w", err)
 	}
 
-	re := regexp.MustCompile(`^i-[[:xdigit:]]{8,}$`)
+	re := regexp.MustCompile(`^m?i-[[:xdigit:]]{8,}$`)
 	for _, rec := range rr {
 		if re.MatchString(rec) {
 			return rec, nil
@@ -112,18 +136,26 @@ func (r *DNSResolver) Resolve(target string) (string, error) {
 
 /*
  *  Tag Resolver attempts to find an instance using instance tags.  The expected format is tag_key:tag_value
- *  (ex. hostname:web0).  If the target to resolve doesn't look like a a colon-separated tag key:value pair,
- *  or no instance is found, an error is returned.  At most, 1 instance ID is returned; if more than 1 match
- *  is found, only the 1st element of the instances list is returned.  The nature of the AWS EC2 API will not
- *  guarantee ordering of the instances list.
+ *  (ex. hostname:web0), or tag:tag_key=tag_value (ex. tag:Name=web-1).  If the target to resolve doesn't look
+ *  like a tag key and value pair, or no instance is found, an error is returned.  At most, 1 instance ID is
+ *  returned; if more than 1 match is found, only the 1st element of the instances list is returned.  The nature
+ *  of the AWS EC2 API will not guarantee ordering of the instances list.
  */
 type TagResolver struct {
 	*EC2Resolver
 }
 
 func (r *TagResolver) Resolve(target string) (string, error) {
-	spec := strings.SplitN(strings.TrimSpace(target), `:`, 2)
-	if len(spec) < 2 {
+	trimmed := strings.TrimSpace(target)
+
+	var spec []string
+	if strings.HasPrefix(trimmed, `tag:`) {
+		spec = strings.SplitN(strings.TrimPrefix(trimmed, `tag:`), `=`, 2)
+	} else {
+		spec = strings.SplitN(trimmed, `:`, 2)
+	}
+
+	if len(spec) < 2 || len(spec[0]) < 1 {
 		return "", ErrInvalidTargetFormat
 	}
 
@@ -194,6 +226,64 @@ func (r *IPResolver) Resolve(target string) (string, error) {
 	return r.EC2Resolver.Resolve(f)
 }
 
+/*
+ *  Private DNS Resolver attempts to find an instance by its private DNS name (ex. ip-10-0-3-17.ec2.internal) using
+ *  the EC2 API.  These names only resolve inside the VPC, so they can't be found by the IP Resolver when running
+ *  elsewhere.  If the target doesn't look like an EC2 private DNS name, or no instance is found, an error is
+ *  returned.
+ */
+type PrivateDNSResolver struct {
+	*EC2Resolver
+}
+
+func (r *PrivateDNSResolver) Resolve(target string) (string, error) {
+	name := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(target), `.`))
+	if !privateDNSPattern.MatchString(name) {
+		return "", ErrInvalidTargetFormat
+	}
+
+	f := types.Filter{
+		Name:   aws.String(`private-dns-name`),
+		Values: []string{name},
+	}
+	return r.EC2Resolver.Resolve(f)
+}
+
+/*
+ *  SSM Resolver attempts to find a managed instance using the computer name or IP address reported by the SSM agent,
+ *  using the SSM DescribeInstanceInformation API.  This also finds on-premises managed instances, which are not
+ *  known to EC2.  The computer name is matched without regard to case, and may omit the domain.  If no instance
+ *  is found, an error is returned.  All managed instances are listed, which may be slow in large accounts.
+ */
+type SSMResolver struct {
+	cfg aws.Config
+}
+
+func (r *SSMResolver) Resolve(target string) (string, error) {
+	trimmed := strings.TrimSpace(target)
+	if len(trimmed) < 1 {
+		return "", ErrInvalidTargetFormat
+	}
+
+	p := ssm.NewDescribeInstanceInformationPaginator(ssm.NewFromConfig(r.cfg), new(ssm.DescribeInstanceInformationInput))
+	for p.HasMorePages() {
+		o, err := p.NextPage(context.Background())
+		if err != nil {
+			return "", fmt.Errorf("error calling DescribeInstanceInformation: %w", err)
+		}
+
+		for _, info := range o.InstanceInformationList {
+			name := aws.ToString(info.ComputerName)
+			if aws.ToString(info.IPAddress) == trimmed || strings.EqualFold(name, trimmed) ||
+				strings.EqualFold(strings.SplitN(name, `.`, 2)[0], trimmed) {
+				return aws.ToString(info.InstanceId), nil
+			}
+		}
+	}
+
+	return "", ErrNoInstanceFound
+}
+
 func isPrivateAddr(addr net.IP) bool {
 	for _, n := range privateNets {
 		if n.Contains(addr) {
@@ -215,13 +305,13 @@ func (r *EC2Resolver) Resolve(filter ...types.Filter) (string, error) {
 	filter = append(filter, types.Filter{Name: aws.String("instance-state-name"), Values: []string{"running"}})
 	o, err := ec2.NewFromConfig(r.cfg).DescribeInstances(context.Background(), &ec2.DescribeInstancesInput{Filters: filter})
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("error calling DescribeInstances: %w", err)
 	}
 
 	for _, res := range o.Reservations {
 		if len(res.Instances) > 0 {
 			if len(res.Instances) > 1 {
-				log.Print("WARNING: more than 1 instance found, using 1st value")
+				logf(datachannel.LevelWarn, "more than 1 instance found, using 1st value")
 			}
 
 			return *res.Instances[0].InstanceId, nil
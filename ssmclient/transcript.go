@@ -0,0 +1,216 @@
+package ssmclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+// Encrypted transcript format: the magic value, the 2 byte length of the KMS encrypted data key, and the encrypted
+// data key, followed by records.  Each record is a 1 byte flag, the 4 byte length of the ciphertext, and the AES-GCM
+// sealed ciphertext of the data.  Record nonces are the record number, and the flag is authenticated with the record
+// so the final record (which is always empty) can't be forged, making truncation detectable.
+const (
+	transcriptMagic     = "SSMTRAN1"
+	transcriptMaxRecord = 64 * 1024
+	recordData          = byte(0)
+	recordFinal         = byte(1)
+)
+
+var (
+	// ErrInvalidTranscript is returned when decrypting data which is not an encrypted transcript.
+	ErrInvalidTranscript = errors.New("invalid encrypted transcript")
+
+	// ErrTranscriptTruncated is returned when an encrypted transcript ends without the final record, which means the
+	// transcript was not closed, or data was removed from the end.
+	ErrTranscriptTruncated = errors.New("encrypted transcript is truncated")
+)
+
+// EncryptedTranscript is an io.WriteCloser which encrypts data written to it using envelope encryption before
+// writing it to the underlying writer, so sensitive session output is protected at rest.  A data key is generated
+// with KMS for each transcript, and the KMS encrypted copy of the key is stored at the start of the output, so
+// the transcript can only be read by identities allowed to decrypt with the KMS key (see DecryptTranscript).
+// Close must be called to mark the end of the transcript, it does not close the underlying writer.
+type EncryptedTranscript struct {
+	mu     sync.Mutex
+	w      io.Writer
+	aead   cipher.AEAD
+	seq    uint64
+	closed bool
+}
+
+// NewEncryptedTranscript generates a data key using the KMS key identified by keyID (a key ID, ARN, or alias), and
+// writes the transcript header to w.  The aws.Config parameter is used to call the KMS GenerateDataKey API.  The
+// returned EncryptedTranscript can be used as the Transcript of a ShellInput or CommandInput.
+func NewEncryptedTranscript(cfg aws.Config, keyID string, w io.Writer) (*EncryptedTranscript, error) {
+	out, err := kms.NewFromConfig(cfg).GenerateDataKey(context.Background(), &kms.GenerateDataKeyInput{
+		KeyId:   aws.String(keyID),
+		KeySpec: types.DataKeySpecAes256,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error generating transcript data key: %w", err)
+	}
+
+	aead, err := newTranscriptCipher(out.Plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := make([]byte, len(transcriptMagic)+2, len(transcriptMagic)+2+len(out.CiphertextBlob))
+	copy(hdr, transcriptMagic)
+	binary.BigEndian.PutUint16(hdr[len(transcriptMagic):], uint16(len(out.CiphertextBlob)))
+	hdr = append(hdr, out.CiphertextBlob...)
+
+	if _, err = w.Write(hdr); err != nil {
+		return nil, fmt.Errorf("error writing transcript header: %w", err)
+	}
+
+	return &EncryptedTranscript{w: w, aead: aead}, nil
+}
+
+// Write encrypts p and writes it to the underlying writer.  Each call is written as one or more complete records, so
+// the transcript is readable up to the last successful Write, even if the transcript is never closed.
+func (t *EncryptedTranscript) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	var n int
+	for len(p) > 0 {
+		sz := len(p)
+		if sz > transcriptMaxRecord {
+			sz = transcriptMaxRecord
+		}
+
+		if err := t.writeRecord(recordData, p[:sz]); err != nil {
+			return n, err
+		}
+		n += sz
+		p = p[sz:]
+	}
+	return n, nil
+}
+
+// Close writes the final record of the transcript.  The underlying writer is not closed.
+func (t *EncryptedTranscript) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+
+	return t.writeRecord(recordFinal, nil)
+}
+
+// writeRecord seals and writes a single record, must be called with the lock held.
+func (t *EncryptedTranscript) writeRecord(flag byte, data []byte) error {
+	ct := t.aead.Seal(nil, transcriptNonce(t.seq, t.aead.NonceSize()), data, []byte{flag})
+	t.seq++
+
+	rec := make([]byte, 5, 5+len(ct))
+	rec[0] = flag
+	binary.BigEndian.PutUint32(rec[1:], uint32(len(ct)))
+	rec = append(rec, ct...)
+
+	if _, err := t.w.Write(rec); err != nil {
+		return fmt.Errorf("error writing transcript: %w", err)
+	}
+	return nil
+}
+
+// DecryptTranscript reads an encrypted transcript created by an EncryptedTranscript from r, and writes the decrypted
+// data to w.  The aws.Config parameter is used to call the KMS Decrypt API to recover the data key.  Data is written
+// to w as each record is verified, and ErrTranscriptTruncated is returned if the transcript was not closed.
+func DecryptTranscript(cfg aws.Config, r io.Reader, w io.Writer) error {
+	br := bufio.NewReader(r)
+
+	hdr := make([]byte, len(transcriptMagic)+2)
+	if _, err := io.ReadFull(br, hdr); err != nil || !bytes.Equal(hdr[:len(transcriptMagic)], []byte(transcriptMagic)) {
+		return ErrInvalidTranscript
+	}
+
+	key := make([]byte, binary.BigEndian.Uint16(hdr[len(transcriptMagic):]))
+	if _, err := io.ReadFull(br, key); err != nil {
+		return ErrInvalidTranscript
+	}
+
+	out, err := kms.NewFromConfig(cfg).Decrypt(context.Background(), &kms.DecryptInput{CiphertextBlob: key})
+	if err != nil {
+		return fmt.Errorf("error decrypting transcript data key: %w", err)
+	}
+
+	aead, err := newTranscriptCipher(out.Plaintext)
+	if err != nil {
+		return err
+	}
+
+	rec := make([]byte, 5)
+	for seq := uint64(0); ; seq++ {
+		if _, err = io.ReadFull(br, rec); err != nil {
+			if errors.Is(err, io.EOF) {
+				return ErrTranscriptTruncated
+			}
+			return fmt.Errorf("error reading transcript: %w", err)
+		}
+
+		size := binary.BigEndian.Uint32(rec[1:])
+		if size > transcriptMaxRecord+uint32(aead.Overhead()) {
+			return ErrInvalidTranscript
+		}
+
+		ct := make([]byte, size)
+		if _, err = io.ReadFull(br, ct); err != nil {
+			return ErrTranscriptTruncated
+		}
+
+		data, err := aead.Open(nil, transcriptNonce(seq, aead.NonceSize()), ct, rec[:1])
+		if err != nil {
+			return fmt.Errorf("error decrypting transcript: %w", err)
+		}
+
+		if rec[0] == recordFinal {
+			return nil
+		}
+
+		if _, err = w.Write(data); err != nil {
+			return fmt.Errorf("error writing decrypted transcript: %w", err)
+		}
+	}
+}
+
+func newTranscriptCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating transcript cipher: %w", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("error creating transcript cipher: %w", err)
+	}
+	return aead, nil
+}
+
+// transcriptNonce returns the nonce for the record number, each data key is only used for a single transcript so
+// the record number is unique for the key.
+func transcriptNonce(seq uint64, size int) []byte {
+	nonce := make([]byte, size)
+	binary.BigEndian.PutUint64(nonce[size-8:], seq)
+	return nonce
+}
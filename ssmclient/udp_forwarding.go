@@ -0,0 +1,144 @@
+package ssmclient
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/dweidenfeld/ssm-session-client/datachannel"
+)
+
+// maxDatagramSize is the largest datagram which can be described by the 2 byte length prefix.
+const maxDatagramSize = 65535
+
+// UDPForwardingSession starts a port forwarding session which carries UDP datagrams received on the local UDP port
+// over the SSM session.  SSM port forwarding only supports TCP, so each datagram is sent over the session prefixed
+// with its length as a 2 byte big-endian integer, and data returned from the remote port must use the same framing.
+// This is the framing used by DNS over TCP, so DNS queries can be forwarded directly to a DNS server port.  Other
+// services require a small relay on the remote side which translates the framed datagrams to real UDP traffic.
+//
+// This is best-effort UDP support: all local clients share a single stream, and datagrams returned from the remote
+// port are delivered to the local client which most recently sent a datagram.  The PortForwardingInput is used the
+// same as PortForwardingSession, with the LocalPort and LocalAddress being the UDP port and address to listen on,
+// and the address family of LocalNetwork (if any) applied to the UDP listener.
+func UDPForwardingSession(cfg aws.Config, opts *PortForwardingInput) error {
+	return udpForwardingSession(nil, cfg, opts)
+}
+
+// udpForwardingSession runs the UDP forwarding session, registering its resources with the SessionManager (if not
+// nil) so they are shut down with the manager.
+func udpForwardingSession(m *SessionManager, cfg aws.Config, opts *PortForwardingInput) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	c, err := openDataChannel(cfg, opts.StartSessionInput())
+	if err != nil {
+		return err
+	}
+	defer shutdown(c, true)
+
+	if m == nil {
+		installSignalHandler(c)
+	}
+	m.track(c)
+	defer m.untrack(c)
+
+	if err = c.WaitForHandshakeComplete(); err != nil {
+		return err
+	}
+
+	network, addr, err := listenAddress(opts, "udp")
+	if err != nil {
+		return err
+	}
+
+	pc, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return fmt.Errorf("error creating UDP listener: %w", err)
+	}
+	defer pc.Close()
+	logf(datachannel.LevelInfo, "listening on %s/udp", pc.LocalAddr())
+
+	m.track(pc)
+	defer m.untrack(pc)
+
+	// the net.Addr of the local client which most recently sent a datagram
+	peer := new(atomic.Value)
+
+	errCh := make(chan error, 2)
+	go func() {
+		errCh <- sendDatagrams(c, pc, peer)
+	}()
+
+	go func() {
+		_, e := c.WriteTo(&datagramWriter{pc: pc, peer: peer})
+		if errors.Is(e, io.EOF) {
+			e = nil
+		}
+		errCh <- e
+	}()
+
+	return <-errCh
+}
+
+// sendDatagrams reads datagrams from the local UDP socket, and writes them to the data channel as length-prefixed
+// frames.  Frames larger than the data channel maximum payload size are split across multiple messages.
+func sendDatagrams(c datachannel.DataChannel, pc net.PacketConn, peer *atomic.Value) error {
+	buf := make([]byte, maxDatagramSize)
+
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return fmt.Errorf("error reading datagram: %w", err)
+		}
+		peer.Store(addr)
+
+		frame := make([]byte, 2+n)
+		binary.BigEndian.PutUint16(frame, uint16(n))
+		copy(frame[2:], buf[:n])
+
+		if _, err = c.ReadFrom(bytes.NewReader(frame)); err != nil {
+			return err
+		}
+	}
+}
+
+// datagramWriter reassembles the length-prefixed frames written to it into datagrams, and sends each complete
+// datagram to the most recently seen local client.
+type datagramWriter struct {
+	pc   net.PacketConn
+	peer *atomic.Value
+	buf  bytes.Buffer
+}
+
+func (w *datagramWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+
+	for w.buf.Len() >= 2 {
+		size := int(binary.BigEndian.Uint16(w.buf.Bytes()))
+		if w.buf.Len() < 2+size {
+			// wait for the rest of the frame
+			break
+		}
+		w.buf.Next(2)
+		datagram := w.buf.Next(size)
+
+		addr, ok := w.peer.Load().(net.Addr)
+		if !ok {
+			logf(datachannel.LevelWarn, "dropping datagram, no local client to deliver it to")
+			continue
+		}
+
+		if _, err := w.pc.WriteTo(datagram, addr); err != nil {
+			return 0, fmt.Errorf("error writing datagram: %w", err)
+		}
+	}
+
+	return len(p), nil
+}